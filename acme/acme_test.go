@@ -0,0 +1,224 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/acme/acmetest"
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// newTestManager returns a manager of a storage directory talking to srv.
+func newTestManager(t *testing.T, srv *acmetest.Server, storage string, challenges ...string) (*Manager, config.ACME) {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, srv.CACertPEM(), 0o600); err != nil {
+		t.Fatalf("Failed to write ca: %v", err)
+	}
+	cfg := config.ACME{
+		DirectoryURL: srv.DirectoryURL(),
+		Email:        "admin@example.com",
+		CACert:       caFile,
+		StorageDir:   storage,
+		Challenges:   challenges,
+	}
+	m := NewManager()
+	t.Cleanup(func() { _ = m.Configure(nil, nil) })
+	return m, cfg
+}
+
+// serveChallenges answers the challenges of m like the http and https
+// listeners do and returns their addresses.
+func serveChallenges(t *testing.T, m *Manager) (httpAddr, tlsAddr string) {
+	t.Helper()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyAuth, ok := m.HTTPChallenge(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(keyAuth))
+	}))
+	t.Cleanup(web.Close)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: []string{ALPNProto},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, ok := m.ALPNCertificate(hello.ServerName)
+			if !ok {
+				return nil, net.ErrClosed
+			}
+			return cert, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	return strings.TrimPrefix(web.URL, "http://"), ln.Addr().String()
+}
+
+func waitForCert(t *testing.T, m *Manager, host string) *tls.Certificate {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if cert, err := m.Certificate(host); err == nil {
+			return cert
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the certificate of %s", host)
+		}
+	}
+}
+
+func TestManager_Obtain(t *testing.T) {
+	for _, challenge := range []string{config.ChallengeHTTP01, config.ChallengeTLSALPN01} {
+		t.Run(challenge, func(t *testing.T) {
+			srv := acmetest.NewServer("", "")
+			defer srv.Close()
+			m, cfg := newTestManager(t, srv, t.TempDir(), challenge)
+			srv.HTTPAddr, srv.TLSAddr = serveChallenges(t, m)
+
+			host := challenge + ".example.com"
+			if err := m.Configure(&cfg, []string{host}); err != nil {
+				t.Fatalf("Failed to configure: %v", err)
+			}
+			cert := waitForCert(t, m, host)
+
+			if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: srv.Roots()}); err != nil {
+				t.Errorf("Expected a certificate issued for %s: %v", host, err)
+			}
+			for _, f := range []string{"account.key", host + ".crt", host + ".key"} {
+				if _, err := os.Stat(filepath.Join(cfg.StorageDir, f)); err != nil {
+					t.Errorf("Expected %s in the storage: %v", f, err)
+				}
+			}
+			s := stat.GlobalStats.Snapshot().ACME[host]
+			if s.Renewals != 1 || s.Failures != 0 || !s.NotAfter.Equal(cert.Leaf.NotAfter) {
+				t.Errorf("Unexpected acme state %+v", s)
+			}
+			if !s.NextRenewal.Before(s.NotAfter.Add(-config.DefaultACMERenewBefore + time.Second)) {
+				t.Errorf("Expected the renewal to be due %s before expiry, got %s", config.DefaultACMERenewBefore, s.NextRenewal)
+			}
+		})
+	}
+}
+
+func TestManager_ManyHosts(t *testing.T) {
+	srv := acmetest.NewServer("", "")
+	defer srv.Close()
+	m, cfg := newTestManager(t, srv, t.TempDir(), config.ChallengeHTTP01)
+	srv.HTTPAddr, _ = serveChallenges(t, m)
+
+	// the orders of hosts configured together run side by side
+	var hosts []string
+	for i := 0; i < 8; i++ {
+		hosts = append(hosts, fmt.Sprintf("host%d.example.com", i))
+	}
+	if err := m.Configure(&cfg, hosts); err != nil {
+		t.Fatalf("Failed to configure: %v", err)
+	}
+	for _, host := range hosts {
+		if cert := waitForCert(t, m, host); cert.Leaf.Subject.CommonName != host {
+			t.Errorf("Expected a certificate for %s, got %s", host, cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestManager_Storage(t *testing.T) {
+	srv := acmetest.NewServer("", "")
+	defer srv.Close()
+	storage := t.TempDir()
+
+	m, cfg := newTestManager(t, srv, storage, config.ChallengeHTTP01)
+	srv.HTTPAddr, _ = serveChallenges(t, m)
+	if err := m.Configure(&cfg, []string{"stored.example.com"}); err != nil {
+		t.Fatalf("Failed to configure: %v", err)
+	}
+	first := waitForCert(t, m, "stored.example.com")
+	_ = m.Configure(nil, nil)
+	if _, err := m.Certificate("stored.example.com"); err == nil {
+		t.Error("Expected no certificate once unmanaged")
+	}
+
+	// a restart serves the stored certificate without ordering a new one
+	srv.HTTPAddr = "127.0.0.1:1"
+	restarted, _ := newTestManager(t, srv, storage)
+	if err := restarted.Configure(&cfg, []string{"stored.example.com"}); err != nil {
+		t.Fatalf("Failed to configure: %v", err)
+	}
+	if cert := waitForCert(t, restarted, "stored.example.com"); !cert.Leaf.Equal(first.Leaf) {
+		t.Error("Expected the stored certificate")
+	}
+	if s := stat.GlobalStats.Snapshot().ACME["stored.example.com"]; s.Failures != 0 || s.NotAfter.IsZero() {
+		t.Errorf("Unexpected acme state %+v", s)
+	}
+}
+
+func TestManager_Failure(t *testing.T) {
+	srv := acmetest.NewServer("127.0.0.1:1", "")
+	defer srv.Close()
+	m, cfg := newTestManager(t, srv, t.TempDir(), config.ChallengeHTTP01)
+	if err := m.Configure(&cfg, []string{"broken.example.com"}); err != nil {
+		t.Fatalf("Failed to configure: %v", err)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		s := stat.GlobalStats.Snapshot().ACME["broken.example.com"]
+		if s.Failures > 0 {
+			if s.TotalFailures != s.Failures || !strings.Contains(s.LastError, "http-01") || !s.NextRenewal.After(time.Now()) {
+				t.Errorf("Unexpected acme state %+v", s)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the failure")
+		}
+	}
+	if _, err := m.Certificate("broken.example.com"); err == nil {
+		t.Error("Expected no certificate")
+	}
+
+	_ = m.Configure(&cfg, nil)
+	if _, ok := stat.GlobalStats.Snapshot().ACME["broken.example.com"]; ok {
+		t.Error("Expected the host to be forgotten once dropped")
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	now := time.Now()
+	long := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	if got, want := renewalTime(long, 30*24*time.Hour), now.Add(60*24*time.Hour); !got.Equal(want) {
+		t.Errorf("Expected renewal at %s, got %s", want, got)
+	}
+	short := &x509.Certificate{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}
+	if got, want := renewalTime(short, 30*24*time.Hour), now.Add(4*24*time.Hour); !got.Equal(want) {
+		t.Errorf("Expected renewal after two thirds of the lifetime at %s, got %s", want, got)
+	}
+
+	if backoff(1) != retryDelay || backoff(100) != maxRetryDelay {
+		t.Errorf("Unexpected backoff %s, %s", backoff(1), backoff(100))
+	}
+}
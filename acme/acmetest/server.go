@@ -0,0 +1,534 @@
+// Package acmetest runs an ACME server for tests. It validates http-01 and
+// tls-alpn-01 challenges against given addresses instead of ports 80 and
+// 443 of the hosts and issues certificates from a throwaway CA.
+package acmetest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Server is an ACME server whose directory is at URL + "/directory".
+type Server struct {
+	*httptest.Server
+
+	// HTTPAddr and TLSAddr receive the validation requests of http-01 and
+	// tls-alpn-01 challenges.
+	HTTPAddr string
+	TLSAddr  string
+	// Challenges are the challenge types offered, both if empty.
+	Challenges []string
+	// Validity is the lifetime of issued certificates, 90 days if zero.
+	Validity time.Duration
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	seq      int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	orders   map[string]*order
+	authzs   map[string]*authz
+	certs    map[string][]byte
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Identifiers    []ident  `json:"identifiers"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate,omitempty"`
+
+	account string
+}
+
+type ident struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type authz struct {
+	Status     string       `json:"status"`
+	Identifier ident        `json:"identifier"`
+	Challenges []*challenge `json:"challenges"`
+
+	account string
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error,omitempty"`
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// NewServer starts a server validating challenges against httpAddr and
+// tlsAddr.
+func NewServer(httpAddr, tlsAddr string) *Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	s := &Server{
+		HTTPAddr: httpAddr,
+		TLSAddr:  tlsAddr,
+		caCert:   ca,
+		caKey:    key,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		orders:   make(map[string]*order),
+		authzs:   make(map[string]*authz),
+		certs:    make(map[string][]byte),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// DirectoryURL is the url clients are configured with.
+func (s *Server) DirectoryURL() string {
+	return s.URL + "/directory"
+}
+
+// CACertPEM is the certificate the api of s is served with.
+func (s *Server) CACertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+// Roots trusts the certificates s issues.
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	return pool
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeProblem(w, http.StatusMethodNotAllowed, "malformed", "post expected")
+		return
+	}
+
+	payload, account, jwk, err := s.verify(r)
+	if err != nil {
+		kind := "malformed"
+		if strings.Contains(err.Error(), "nonce") {
+			kind = "badNonce"
+		}
+		writeProblem(w, http.StatusBadRequest, kind, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case kind == "account" && id == "":
+		s.newAccount(w, jwk)
+	case kind == "order" && id == "":
+		s.newOrder(w, account, payload)
+	case kind == "order":
+		if o := s.orders[id]; o != nil && o.account == account {
+			writeJSON(w, http.StatusOK, o)
+			return
+		}
+		writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+	case kind == "authz":
+		if a := s.authzs[id]; a != nil && a.account == account {
+			writeJSON(w, http.StatusOK, a)
+			return
+		}
+		writeProblem(w, http.StatusNotFound, "malformed", "no such authorization")
+	case kind == "chall":
+		s.validate(w, account, id)
+	case kind == "finalize":
+		s.finalize(w, account, id, payload)
+	case kind == "cert":
+		if c, ok := s.certs[id]; ok {
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			_, _ = w.Write(c)
+			return
+		}
+		writeProblem(w, http.StatusNotFound, "malformed", "no such certificate")
+	default:
+		writeProblem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// verify checks the jws of r and returns its payload and the account url
+// or, for new accounts, the key it is signed with.
+func (s *Server) verify(r *http.Request) ([]byte, string, *ecdsa.PublicKey, error) {
+	var msg struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return nil, "", nil, err
+	}
+	protected, err := b64.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var header struct {
+		Alg, Nonce, URL, KID string
+		JWK                  *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, "", nil, err
+	}
+
+	s.mu.Lock()
+	known := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	key := s.accounts[header.KID]
+	s.mu.Unlock()
+
+	if !known {
+		return nil, "", nil, fmt.Errorf("unknown nonce %q", header.Nonce)
+	}
+	if header.Alg != "ES256" {
+		return nil, "", nil, fmt.Errorf("unsupported alg %s", header.Alg)
+	}
+	if header.URL != s.URL+r.URL.Path {
+		return nil, "", nil, fmt.Errorf("signed for %s, posted to %s", header.URL, r.URL.Path)
+	}
+	if header.JWK != nil {
+		x, errX := b64.DecodeString(header.JWK.X)
+		y, errY := b64.DecodeString(header.JWK.Y)
+		if errX != nil || errY != nil || header.JWK.Crv != "P-256" {
+			return nil, "", nil, fmt.Errorf("bad jwk")
+		}
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if key == nil {
+		return nil, "", nil, fmt.Errorf("unknown account %q", header.KID)
+	}
+
+	sig, err := b64.DecodeString(msg.Signature)
+	if err != nil || len(sig) != 64 {
+		return nil, "", nil, fmt.Errorf("bad signature")
+	}
+	digest := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", nil, fmt.Errorf("signature does not verify")
+	}
+
+	payload, err := b64.DecodeString(msg.Payload)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return payload, header.KID, key, nil
+}
+
+func (s *Server) newAccount(w http.ResponseWriter, key *ecdsa.PublicKey) {
+	for kid, k := range s.accounts {
+		if k.Equal(key) {
+			w.Header().Set("Location", kid)
+			writeJSON(w, http.StatusOK, map[string]string{"status": "valid"})
+			return
+		}
+	}
+	kid := s.URL + "/acct/" + s.nextID()
+	s.accounts[kid] = key
+	w.Header().Set("Location", kid)
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, account string, payload []byte) {
+	var req struct {
+		Identifiers []ident `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		writeProblem(w, http.StatusBadRequest, "malformed", "no identifiers")
+		return
+	}
+
+	id := s.nextID()
+	o := &order{
+		Status:      "pending",
+		Identifiers: req.Identifiers,
+		Finalize:    s.URL + "/finalize/" + id,
+		account:     account,
+	}
+	types := s.Challenges
+	if len(types) == 0 {
+		types = []string{"http-01", "tls-alpn-01"}
+	}
+	for _, ident := range req.Identifiers {
+		authzID := s.nextID()
+		a := &authz{Status: "pending", Identifier: ident, account: account}
+		for _, typ := range types {
+			token := make([]byte, 16)
+			_, _ = rand.Read(token)
+			a.Challenges = append(a.Challenges, &challenge{
+				Type:   typ,
+				URL:    s.URL + "/chall/" + authzID + "-" + typ,
+				Token:  b64.EncodeToString(token),
+				Status: "pending",
+			})
+		}
+		s.authzs[authzID] = a
+		o.Authorizations = append(o.Authorizations, s.URL+"/authz/"+authzID)
+	}
+	s.orders[id] = o
+	w.Header().Set("Location", s.URL+"/order/"+id)
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// validate checks the challenge id right away, the mutex of s held.
+func (s *Server) validate(w http.ResponseWriter, account, id string) {
+	authzID, typ, _ := strings.Cut(id, "-")
+	a := s.authzs[authzID]
+	if a == nil || a.account != account {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	var ch *challenge
+	for _, c := range a.Challenges {
+		if c.Type == typ {
+			ch = c
+		}
+	}
+	if ch == nil {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+
+	keyAuth := ch.Token + "." + thumbprint(s.accounts[account])
+	var err error
+	if typ == "http-01" {
+		err = s.validateHTTP(a.Identifier.Value, ch.Token, keyAuth)
+	} else {
+		err = s.validateTLSALPN(a.Identifier.Value, keyAuth)
+	}
+	if err != nil {
+		ch.Status, a.Status = "invalid", "invalid"
+		ch.Error = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error(), Status: http.StatusForbidden}
+	} else {
+		ch.Status, a.Status = "valid", "valid"
+	}
+
+	for _, o := range s.orders {
+		if o.Status != "pending" || !slices.Contains(o.Authorizations, s.URL+"/authz/"+authzID) {
+			continue
+		}
+		o.Status = "ready"
+		for _, url := range o.Authorizations {
+			switch s.authzs[strings.TrimPrefix(url, s.URL+"/authz/")].Status {
+			case "invalid":
+				o.Status = "invalid"
+			case "pending":
+				if o.Status == "ready" {
+					o.Status = "pending"
+				}
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (s *Server) validateHTTP(host, token, keyAuth string) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("http-01 of %s answered %s %q", host, resp.Status, body)
+	}
+	return nil
+}
+
+func (s *Server) validateTLSALPN(host, keyAuth string) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", s.TLSAddr, &tls.Config{
+		ServerName:         host,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("tls-alpn-01 of %s negotiated %q", host, state.NegotiatedProtocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != host {
+		return fmt.Errorf("tls-alpn-01 certificate of %s is for %v", host, cert.DNSNames)
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil || !ext.Critical || !bytes.Equal(got, want[:]) {
+			return fmt.Errorf("tls-alpn-01 certificate of %s has a wrong acmeIdentifier", host)
+		}
+		return nil
+	}
+	return fmt.Errorf("tls-alpn-01 certificate of %s has no acmeIdentifier", host)
+}
+
+func (s *Server) finalize(w http.ResponseWriter, account, id string, payload []byte) {
+	o := s.orders[id]
+	if o == nil || o.account != account {
+		writeProblem(w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	if o.Status != "ready" {
+		writeProblem(w, http.StatusForbidden, "orderNotReady", "order is "+o.Status)
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	_ = json.Unmarshal(payload, &req)
+	der, err := b64.DecodeString(req.CSR)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	var names []string
+	for _, ident := range o.Identifiers {
+		names = append(names, ident.Value)
+	}
+	if !slices.Equal(csr.DNSNames, names) {
+		writeProblem(w, http.StatusBadRequest, "badCSR", fmt.Sprintf("csr names %v, ordered %v", csr.DNSNames, names))
+		return
+	}
+
+	validity := s.Validity
+	if validity == 0 {
+		validity = 90 * 24 * time.Hour
+	}
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	s.certs[id] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+
+	o.Status = "valid"
+	o.Certificate = s.URL + "/cert/" + id
+	w.Header().Set("Location", s.URL+"/order/"+id)
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) newNonce() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	nonce := b64.EncodeToString(b)
+	s.mu.Lock()
+	s.nonces[nonce] = true
+	s.mu.Unlock()
+	return nonce
+}
+
+func (s *Server) nextID() string {
+	s.seq++
+	return fmt.Sprint(s.seq)
+}
+
+func thumbprint(key *ecdsa.PublicKey) string {
+	data := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	sum := sha256.Sum256([]byte(data))
+	return b64.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, status int, kind, detail string) {
+	writeJSON(w, status, problem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: status})
+}
@@ -0,0 +1,111 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// HTTPChallengePath prefixes the paths of http-01 challenge requests.
+const HTTPChallengePath = "/.well-known/acme-challenge/"
+
+// ALPNProto is negotiated by the handshakes of tls-alpn-01 challenges.
+const ALPNProto = "acme-tls/1"
+
+// idPeACMEIdentifier is the extension carrying the key authorization digest
+// in a tls-alpn-01 certificate, RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Present makes the challenge of token answerable on the listeners.
+func (m *Manager) Present(typ, host, token, keyAuth string) error {
+	switch typ {
+	case config.ChallengeHTTP01:
+		m.tokens.Store(token, keyAuth)
+	case config.ChallengeTLSALPN01:
+		cert, err := alpnCertificate(host, keyAuth)
+		if err != nil {
+			return err
+		}
+		m.alpnCerts.Store(host, cert)
+	default:
+		return fmt.Errorf("unsupported challenge %s", typ)
+	}
+	return nil
+}
+
+// CleanUp stops answering the challenge of token.
+func (m *Manager) CleanUp(typ, host, token string) {
+	switch typ {
+	case config.ChallengeHTTP01:
+		m.tokens.Delete(token)
+	case config.ChallengeTLSALPN01:
+		m.alpnCerts.Delete(host)
+	}
+}
+
+// HTTPChallenge returns the body answering an http-01 challenge request for
+// path, false if path requests no pending challenge.
+func (m *Manager) HTTPChallenge(path string) (string, bool) {
+	token, ok := strings.CutPrefix(path, HTTPChallengePath)
+	if !ok {
+		return "", false
+	}
+	keyAuth, ok := m.tokens.Load(token)
+	if !ok {
+		return "", false
+	}
+	return keyAuth.(string), true
+}
+
+// ALPNCertificate returns the certificate answering the tls-alpn-01
+// challenge pending for host.
+func (m *Manager) ALPNCertificate(host string) (*tls.Certificate, bool) {
+	cert, ok := m.alpnCerts.Load(host)
+	if !ok {
+		return nil, false
+	}
+	return cert.(*tls.Certificate), true
+}
+
+// alpnCertificate is a self signed certificate for host carrying the digest
+// of keyAuth.
+func alpnCertificate(host, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: host},
+		DNSNames:        []string{host},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
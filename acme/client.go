@@ -0,0 +1,142 @@
+// Package acme obtains certificates from an ACME (RFC 8555) server like
+// Let's Encrypt, answering http-01 and tls-alpn-01 challenges on the
+// listeners of yarp, and renews them before they expire.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+// Solver makes a challenge answerable until it is cleaned up.
+type Solver interface {
+	Present(typ, host, token, keyAuth string) error
+	CleanUp(typ, host, token string)
+}
+
+// Client obtains certificates for one account, for any number of hosts at
+// once.
+type Client struct {
+	api   *xacme.Client
+	email string
+
+	// mu guards registering the account, the only state the orders share
+	mu         sync.Mutex
+	registered bool
+}
+
+// Obtain orders a certificate for host with the public key of key,
+// answering one of challenges per authorization with solver, and returns its
+// DER encoded chain.
+func (c *Client) Obtain(ctx context.Context, host string, key crypto.Signer, challenges []string, solver Solver) ([][]byte, error) {
+	if err := c.register(ctx); err != nil {
+		return nil, fmt.Errorf("register account: %w", err)
+	}
+
+	o, err := c.api.AuthorizeOrder(ctx, xacme.DomainIDs(host))
+	if err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	for _, url := range o.AuthzURLs {
+		if err := c.authorize(ctx, url, challenges, solver); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := c.api.WaitOrder(ctx, o.URI); err != nil {
+		return nil, fmt.Errorf("order: %w", err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := c.api.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize: %w", err)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate in the downloaded chain")
+	}
+	return chain, nil
+}
+
+// register creates the account, or finds the existing one of the key of c,
+// once.
+func (c *Client) register(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.registered {
+		return nil
+	}
+
+	account := &xacme.Account{}
+	if c.email != "" {
+		account.Contact = []string{"mailto:" + c.email}
+	}
+	if _, err := c.api.Register(ctx, account, xacme.AcceptTOS); err != nil && !errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		return err
+	}
+	c.registered = true
+	return nil
+}
+
+// authorize proves control over the identifier of the authorization at url.
+func (c *Client) authorize(ctx context.Context, url string, challenges []string, solver Solver) error {
+	a, err := c.api.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if a.Status == xacme.StatusValid {
+		return nil
+	}
+	if a.Status != xacme.StatusPending {
+		return fmt.Errorf("authorization of %s is %s", a.Identifier.Value, a.Status)
+	}
+
+	var ch *xacme.Challenge
+	for _, typ := range challenges {
+		for _, offered := range a.Challenges {
+			if offered.Type == typ {
+				ch = offered
+				break
+			}
+		}
+		if ch != nil {
+			break
+		}
+	}
+	if ch == nil {
+		var offered []string
+		for _, c := range a.Challenges {
+			offered = append(offered, c.Type)
+		}
+		return fmt.Errorf("no supported challenge for %s, offered %s", a.Identifier.Value, strings.Join(offered, ", "))
+	}
+
+	host := a.Identifier.Value
+	// the key authorization is the same for both challenge types
+	keyAuth, err := c.api.HTTP01ChallengeResponse(ch.Token)
+	if err != nil {
+		return err
+	}
+	if err := solver.Present(ch.Type, host, ch.Token, keyAuth); err != nil {
+		return fmt.Errorf("%s challenge of %s: %w", ch.Type, host, err)
+	}
+	defer solver.CleanUp(ch.Type, host, ch.Token)
+
+	if _, err := c.api.Accept(ctx, ch); err != nil {
+		return fmt.Errorf("%s challenge of %s: %w", ch.Type, host, err)
+	}
+	if _, err := c.api.WaitAuthorization(ctx, url); err != nil {
+		return fmt.Errorf("%s challenge of %s failed: %w", ch.Type, host, err)
+	}
+	return nil
+}
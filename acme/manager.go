@@ -0,0 +1,339 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// Global obtains the certificates of the rules of all listeners.
+var Global = NewManager()
+
+// the delay before retrying a failed attempt doubles from retryDelay up to
+// maxRetryDelay, obtainTimeout bounding each attempt
+var (
+	retryDelay    = time.Minute
+	maxRetryDelay = 6 * time.Hour
+	obtainTimeout = 5 * time.Minute
+)
+
+// Manager keeps a certificate for every configured host, obtaining it at
+// first and renewing it before it expires.
+type Manager struct {
+	mu     sync.Mutex
+	cfg    *config.ACME
+	client *Client
+	hosts  map[string]*managedHost
+
+	// tokens maps the tokens of pending http-01 challenges to their key
+	// authorization, alpnCerts the hosts of pending tls-alpn-01 challenges
+	// to the certificate answering them.
+	tokens    sync.Map
+	alpnCerts sync.Map
+}
+
+type managedHost struct {
+	name   string
+	cert   atomic.Pointer[tls.Certificate]
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewManager() *Manager {
+	return &Manager{hosts: make(map[string]*managedHost)}
+}
+
+// Configure applies cfg and manages the certificates of hosts. Certificates
+// of hosts dropped are no longer renewed, nil cfg stops managing any.
+func (m *Manager) Configure(cfg *config.ACME, hosts []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next *config.ACME
+	if cfg != nil {
+		c := cfg.WithDefaults()
+		next = &c
+	}
+	if !reflect.DeepEqual(m.cfg, next) {
+		for name, h := range m.hosts {
+			h.stop()
+			delete(m.hosts, name)
+		}
+		m.cfg, m.client = next, nil
+		if next != nil {
+			client, err := newClient(*next)
+			if err != nil {
+				m.cfg = nil
+				return err
+			}
+			m.client = client
+		}
+	}
+	if m.cfg == nil {
+		return nil
+	}
+
+	wanted := make(map[string]bool, len(hosts))
+	for _, name := range hosts {
+		wanted[name] = true
+		if _, ok := m.hosts[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		h := &managedHost{name: name, cancel: cancel, done: make(chan struct{})}
+		m.hosts[name] = h
+		go m.manage(ctx, h, m.client, *m.cfg)
+	}
+	for name, h := range m.hosts {
+		if !wanted[name] {
+			h.stop()
+			delete(m.hosts, name)
+		}
+	}
+	return nil
+}
+
+// stop stops renewing h and forgets it in the stats.
+func (h *managedHost) stop() {
+	h.cancel()
+	<-h.done
+	stat.GlobalStats.RemoveACME(h.name)
+}
+
+// Certificate returns the certificate obtained for host.
+func (m *Manager) Certificate(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	h := m.hosts[host]
+	m.mu.Unlock()
+
+	if h == nil {
+		return nil, fmt.Errorf("no acme certificate managed for %s", host)
+	}
+	cert := h.cert.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("no acme certificate obtained for %s yet", host)
+	}
+	return cert, nil
+}
+
+// manage keeps the certificate of h valid until ctx is done.
+func (m *Manager) manage(ctx context.Context, h *managedHost, client *Client, cfg config.ACME) {
+	defer close(h.done)
+
+	certFile, keyFile := storagePaths(cfg, h.name)
+	if cert, err := loadCert(certFile, keyFile); err == nil {
+		h.cert.Store(cert)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		klog.Warningf("[acme] ignoring the stored certificate of %s: %v", h.name, err)
+	}
+	defer stat.GlobalStats.RemoveCert("acme:"+h.name, certFile)
+
+	failures := 0
+	for {
+		due := time.Now()
+		if cert := h.cert.Load(); cert != nil {
+			due = renewalTime(cert.Leaf, cfg.RenewBefore)
+			if failures == 0 {
+				stat.GlobalStats.ACMEScheduled(h.name, cert.Leaf.NotAfter, due)
+				stat.GlobalStats.SetCert("acme:"+h.name, certFile, stat.NewCertState(cert.Leaf))
+			}
+		}
+		if failures > 0 {
+			due = time.Now().Add(backoff(failures))
+		}
+		if err := sleep(ctx, time.Until(due)); err != nil {
+			return
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, obtainTimeout)
+		cert, err := m.obtain(attemptCtx, client, h.name, cfg.Challenges, certFile, keyFile)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+			retry := time.Now().Add(backoff(failures))
+			klog.Errorf("[acme] obtaining a certificate for %s failed, retrying at %s: %v", h.name, retry.Format(time.RFC3339), err)
+			stat.GlobalStats.ACMEFailed(h.name, err, retry)
+			continue
+		}
+
+		failures = 0
+		h.cert.Store(cert)
+		klog.Infof("[acme] obtained a certificate for %s valid until %s", h.name, cert.Leaf.NotAfter.Format(time.RFC3339))
+		stat.GlobalStats.ACMERenewed(h.name, cert.Leaf.NotAfter, renewalTime(cert.Leaf, cfg.RenewBefore))
+	}
+}
+
+// obtain orders a certificate for host with a new key and stores both.
+func (m *Manager) obtain(ctx context.Context, client *Client, host string, challenges []string, certFile, keyFile string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := client.Obtain(ctx, host, key, challenges, m)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return nil, err
+	}
+	if err := writeFile(certFile, certPEM); err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// renewalTime is renewBefore ahead of the expiry of cert, or after two
+// thirds of its lifetime if it lives no longer than renewBefore.
+func renewalTime(cert *x509.Certificate, renewBefore time.Duration) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= renewBefore {
+		return cert.NotBefore.Add(lifetime * 2 / 3)
+	}
+	return cert.NotAfter.Add(-renewBefore)
+}
+
+func backoff(failures int) time.Duration {
+	d := retryDelay
+	for i := 1; i < failures && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// newClient sets up the client of cfg with the account key in its storage,
+// generating one the first time.
+func newClient(cfg config.ACME) (*Client, error) {
+	if err := os.MkdirAll(cfg.StorageDir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadAccountKey(filepath.Join(cfg.StorageDir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Client{
+		api: &xacme.Client{
+			Key:          key,
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+			UserAgent:    "yarp",
+		},
+		email: cfg.Email,
+	}, nil
+}
+
+func loadAccountKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no pem data", file)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return key, nil
+}
+
+func storagePaths(cfg config.ACME, host string) (certFile, keyFile string) {
+	return filepath.Join(cfg.StorageDir, host+".crt"), filepath.Join(cfg.StorageDir, host+".key")
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// writeFile replaces file at once so a crash never leaves half of it.
+func writeFile(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
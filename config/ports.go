@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SplitPortRange splits "host:port" or "host:first-last" into its host and
+// port range. A single port gives first == last.
+func SplitPortRange(addr string) (host string, first, last int, err error) {
+	if addr == "" {
+		return "", 0, 0, errors.New("must not be empty")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	lo, hi, isRange := strings.Cut(port, "-")
+	if first, err = parsePort(lo); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid port %q in %q", port, addr)
+	}
+	last = first
+	if isRange {
+		if last, err = parsePort(hi); err != nil || last < first {
+			return "", 0, 0, fmt.Errorf("invalid port range %q in %q", port, addr)
+		}
+	}
+
+	return host, first, last, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p <= 0 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// IsPortRange reports whether the bindAddr of r is a port range.
+func (r IPRule) IsPortRange() bool {
+	_, first, last, err := SplitPortRange(r.BindAddr)
+	return err == nil && first != last
+}
+
+// Expand turns a rule forwarding a port range into one rule per port, bound
+// to that port and forwarding to the matching port of every target. Targets
+// with a single port get all ports of the range. A rule without a range is
+// returned as is.
+func (r IPRule) Expand() ([]IPRule, error) {
+	if _, port, err := net.SplitHostPort(r.BindAddr); err == nil && !strings.Contains(port, "-") {
+		// a single port, possibly 0 to pick a free one
+		return []IPRule{r}, nil
+	}
+	if _, ok := UnixPath(r.BindAddr); ok {
+		return []IPRule{r}, nil
+	}
+
+	host, first, last, err := SplitPortRange(r.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	if first == last {
+		return []IPRule{r}, nil
+	}
+
+	size := last - first + 1
+	mapPort := func(addr string) (func(i int) string, error) {
+		if _, ok := UnixPath(addr); ok {
+			return func(int) string { return addr }, nil
+		}
+		targetHost, lo, hi, err := SplitPortRange(addr)
+		if err != nil {
+			return nil, err
+		}
+		if lo != hi && hi-lo+1 != size {
+			return nil, fmt.Errorf("port range of %q does not match %q", addr, r.BindAddr)
+		}
+		return func(i int) string {
+			if lo == hi {
+				return net.JoinHostPort(targetHost, strconv.Itoa(lo))
+			}
+			return net.JoinHostPort(targetHost, strconv.Itoa(lo+i))
+		}, nil
+	}
+
+	var target func(int) string
+	if r.Target != "" {
+		if target, err = mapPort(r.Target); err != nil {
+			return nil, err
+		}
+	}
+	targets := make([]func(int) string, len(r.Targets))
+	for i, t := range r.Targets {
+		if targets[i], err = mapPort(t.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	rules := make([]IPRule, 0, size)
+	for i := 0; i < size; i++ {
+		port := r
+		port.BindAddr = net.JoinHostPort(host, strconv.Itoa(first+i))
+		if target != nil {
+			port.Target = target(i)
+		}
+		port.Targets = make([]Target, len(r.Targets))
+		for n, t := range r.Targets {
+			port.Targets[n] = Target{Addr: targets[n](i), Weight: t.Weight}
+		}
+		rules = append(rules, port)
+	}
+	return rules, nil
+}
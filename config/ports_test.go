@@ -0,0 +1,48 @@
+package config
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestIPRule_Expand(t *testing.T) {
+	rule := IPRule{
+		BindAddr: "0.0.0.0:30000-30002",
+		Target:   "10.0.0.5:40000-40002",
+		Targets:  []Target{{Addr: "10.0.0.6:22", Weight: 2}},
+	}
+
+	got, err := rule.Expand()
+	if err != nil {
+		t.Fatalf("Failed to expand: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(got))
+	}
+	for i, r := range got {
+		if want := "0.0.0.0:" + strconv.Itoa(30000+i); r.BindAddr != want {
+			t.Errorf("rule %d: expected bindAddr %s, got %s", i, want, r.BindAddr)
+		}
+		if want := "10.0.0.5:" + strconv.Itoa(40000+i); r.Target != want {
+			t.Errorf("rule %d: expected target %s, got %s", i, want, r.Target)
+		}
+		if want := []Target{{Addr: "10.0.0.6:22", Weight: 2}}; !reflect.DeepEqual(r.Targets, want) {
+			t.Errorf("rule %d: expected targets %v, got %v", i, want, r.Targets)
+		}
+	}
+
+	single := IPRule{BindAddr: "0.0.0.0:80", Target: "10.0.0.5:8080"}
+	if got, err := single.Expand(); err != nil || !reflect.DeepEqual(got, []IPRule{single}) {
+		t.Errorf("Expected a single port rule to stay as is, got %v, %v", got, err)
+	}
+	free := IPRule{BindAddr: "127.0.0.1:0", Target: "10.0.0.5:8080"}
+	if got, err := free.Expand(); err != nil || !reflect.DeepEqual(got, []IPRule{free}) {
+		t.Errorf("Expected port 0 to stay as is, got %v, %v", got, err)
+	}
+
+	mismatch := IPRule{BindAddr: "0.0.0.0:80-81", Target: "10.0.0.5:1-3"}
+	if _, err := mismatch.Expand(); err == nil {
+		t.Error("Expected ranges of different length to fail")
+	}
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a rule terminating tls forwards the decrypted connections.
+const (
+	ForwardTCP  = "tcp"
+	ForwardHTTP = "http"
+)
+
+// How a rule terminating tls authenticates clients by their certificate.
+const (
+	ClientAuthRequire       = "require"
+	ClientAuthVerifyIfGiven = "verify-if-given"
+)
+
+// CertPair names the PEM files of a certificate and its key.
+type CertPair struct {
+	Cert string
+	Key  string
+}
+
+// Terminates reports whether r terminates tls instead of passing it through.
+func (r HostRule) Terminates() bool {
+	return r.Cert != "" || r.CertDir != "" || r.ACME
+}
+
+// CertPairs returns the certificates r terminates tls with, Cert and Key
+// followed by every name.crt in CertDir with its name.key.
+func (r HostRule) CertPairs() ([]CertPair, error) {
+	var pairs []CertPair
+	if r.Cert != "" {
+		pairs = append(pairs, CertPair{Cert: r.Cert, Key: r.Key})
+	}
+	if r.CertDir == "" {
+		return pairs, nil
+	}
+
+	entries, err := os.ReadDir(r.CertDir)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".crt")
+		if !ok || e.IsDir() {
+			continue
+		}
+		found = true
+		pairs = append(pairs, CertPair{
+			Cert: filepath.Join(r.CertDir, e.Name()),
+			Key:  filepath.Join(r.CertDir, name+".key"),
+		})
+	}
+	if !found {
+		return nil, fmt.Errorf("no .crt files in %s", r.CertDir)
+	}
+	return pairs, nil
+}
+
+// UpstreamTLS is how a rule encrypts the connections to its targets.
+type UpstreamTLS struct {
+	Enable bool `mapstructure:"enable"`
+	// ServerName is sent as SNI and verified against the certificate of
+	// the target, the host of its address by default.
+	ServerName string `mapstructure:"serverName"`
+	// CA is a PEM bundle trusted instead of the system roots.
+	CA string `mapstructure:"ca"`
+	// Cert and Key, PEM files, are the client certificate presented to the
+	// targets.
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// InsecureSkipVerify accepts any certificate, for labs only.
+	InsecureSkipVerify bool `mapstructure:"insecureSkipVerify"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3, DefaultUpstreamTLSMinVersion if
+	// empty.
+	MinVersion string `mapstructure:"minVersion"`
+}
+
+const DefaultUpstreamTLSMinVersion = "1.2"
+
+// Enabled reports whether u makes a rule speak tls to its targets.
+func (u *UpstreamTLS) Enabled() bool {
+	return u != nil && u.Enable
+}
+
+// TLSVersion returns the tls.Version* constant of a MinVersion.
+func TLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q, want 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ACME configures the client obtaining the certificates of the https rules
+// with acme set.
+type ACME struct {
+	// DirectoryURL is the ACME server, DefaultACMEDirectory if empty.
+	DirectoryURL string `mapstructure:"directoryURL"`
+	Email        string `mapstructure:"email"`
+	// CACert is a PEM bundle trusted for the directory besides the system
+	// roots, for test servers like Pebble.
+	CACert string `mapstructure:"caCert"`
+	// StorageDir keeps the account key and the certificates,
+	// DefaultACMEStorage if empty.
+	StorageDir string `mapstructure:"storageDir"`
+	// RenewBefore is how long before it expires a certificate is renewed,
+	// DefaultACMERenewBefore if zero. Certificates living shorter than that
+	// are renewed after two thirds of their lifetime.
+	RenewBefore time.Duration `mapstructure:"renewBefore"`
+	// Challenges are the challenge types to answer in order of preference,
+	// tls-alpn-01 on the https listeners and http-01 on the http listeners,
+	// which must be reachable on ports 443 and 80. Defaults to both.
+	Challenges []string `mapstructure:"challenges"`
+}
+
+const (
+	DefaultACMEDirectory   = "https://acme-v02.api.letsencrypt.org/directory"
+	DefaultACMEStorage     = "./acme"
+	DefaultACMERenewBefore = 30 * 24 * time.Hour
+
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeHTTP01    = "http-01"
+)
+
+// WithDefaults returns a copy of a with every unset field filled in.
+func (a ACME) WithDefaults() ACME {
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = DefaultACMEDirectory
+	}
+	if a.StorageDir == "" {
+		a.StorageDir = DefaultACMEStorage
+	}
+	if a.RenewBefore == 0 {
+		a.RenewBefore = DefaultACMERenewBefore
+	}
+	if len(a.Challenges) == 0 {
+		a.Challenges = []string{ChallengeTLSALPN01, ChallengeHTTP01}
+	}
+	return a
+}
@@ -1,5 +1,11 @@
 package config
 
+import (
+	"net/netip"
+	"strings"
+	"time"
+)
+
 type YARPConfig struct {
 	TCP *[]IPRule `mapstructure:"tcp"`
 	UDP *[]IPRule `mapstructure:"udp"`
@@ -7,23 +13,382 @@ type YARPConfig struct {
 	Http  *[]Http `mapstructure:"http"`
 	Https *[]Http `mapstructure:"https"`
 
+	Mux *[]Mux `mapstructure:"mux"`
+
 	Dashboard *Dashboard `mapstructure:"dashboard"`
+
+	// DrainTimeout is how long a shutdown waits for in-flight connections.
+	DrainTimeout time.Duration `mapstructure:"drainTimeout"`
+	// LingerTimeout is how long a connection whose one side shut down its
+	// writes keeps waiting for the other side to finish.
+	LingerTimeout time.Duration `mapstructure:"lingerTimeout"`
+
+	Guard *Guard `mapstructure:"guard"`
+
+	ACME *ACME `mapstructure:"acme"`
 }
 
+const (
+	DefaultDrainTimeout   = 30 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultLingerTimeout  = 30 * time.Second
+	DefaultUDPIdleTimeout = 90 * time.Second
+	DefaultSniffTimeout   = 3 * time.Second
+)
+
 type IPRule struct {
-	BindAddr string `mapstructure:"bindAddr"`
-	Target   string `mapstructure:"target"`
+	// BindAddr may be a port range like "0.0.0.0:30000-30100", listening on
+	// every port of it. Targets then either have a range of the same length,
+	// port n going to port n of it, or a single port all of them go to.
+	// tcp rules may also bind and target unix sockets, see UnixPrefix.
+	BindAddr    string       `mapstructure:"bindAddr"`
+	Target      string       `mapstructure:"target"`
+	Targets     []Target     `mapstructure:"targets"`
+	Strategy    string       `mapstructure:"strategy"`
+	HealthCheck *HealthCheck `mapstructure:"healthCheck"`
+	Outlier     *Outlier     `mapstructure:"outlier"`
+
+	// ConnectTimeout bounds every dial to a target, Retries is how many
+	// other targets are tried when a dial fails, waiting RetryBackoff before
+	// the first retry and twice as long before every further one.
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout"`
+	Retries        int           `mapstructure:"retries"`
+	RetryBackoff   time.Duration `mapstructure:"retryBackoff"`
+
+	// ProxyProtocol is the PROXY protocol version, v1 or v2, announcing the
+	// client to the target. Empty sends none.
+	ProxyProtocol string `mapstructure:"proxyProtocol"`
+
+	// AcceptProxyProtocol makes the listener read the real client address
+	// from a PROXY protocol v1 or v2 header, which the sources listed in
+	// TrustedProxies must send. Others are taken as direct clients, all of
+	// them if TrustedProxies is empty.
+	AcceptProxyProtocol bool     `mapstructure:"acceptProxyProtocol"`
+	TrustedProxies      []string `mapstructure:"trustedProxies"`
+
+	// Allow and Deny are lists of ips and cidrs checked against the client
+	// address. Deny wins, a non empty Allow denies everyone else.
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+
+	// MaxConns caps the concurrent connections, or udp sessions, of the rule
+	// and MaxConnsPerIP those of a single client ip, zero is unlimited. A
+	// connection over a limit is rejected, or waits up to QueueTimeout for
+	// a free slot. udp rules do not queue.
+	MaxConns      int           `mapstructure:"maxConns"`
+	MaxConnsPerIP int           `mapstructure:"maxConnsPerIP"`
+	QueueTimeout  time.Duration `mapstructure:"queueTimeout"`
+
+	Bandwidth *Bandwidth `mapstructure:"bandwidth"`
+
+	// IdleTimeout closes a connection once no bytes moved in either
+	// direction for that long and MaxLifetime once it lived that long, zero
+	// never does. udp sessions expire after DefaultUDPIdleTimeout unless
+	// IdleTimeout is set and do not support MaxLifetime.
+	IdleTimeout time.Duration `mapstructure:"idleTimeout"`
+	MaxLifetime time.Duration `mapstructure:"maxLifetime"`
+
+	Socket *SocketOptions `mapstructure:"socket"`
+
+	// PerPortStats reports every port of a range on its own instead of
+	// adding them up under the rule. Limits and bandwidth always cover the
+	// whole range.
+	PerPortStats bool `mapstructure:"perPortStats"`
+
+	// UpstreamTLS encrypts the connections to the targets, tcp rules only.
+	UpstreamTLS *UpstreamTLS `mapstructure:"upstreamTLS"`
+}
+
+func (r IPRule) Upstreams() []Target {
+	return upstreams(r.Target, r.Targets)
 }
 
 type Http struct {
 	BindAddr string     `mapstructure:"bindAddr"`
 	Rules    []HostRule `mapstructure:"rules"`
+
+	// see IPRule
+	AcceptProxyProtocol bool     `mapstructure:"acceptProxyProtocol"`
+	TrustedProxies      []string `mapstructure:"trustedProxies"`
+
+	// see IPRule, checked for every connection before its host is known
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+
+	// see IPRule. The limits are a setting of the listener: they are checked
+	// on accept, before the host is known, and shared by all of its rules.
+	MaxConns      int           `mapstructure:"maxConns"`
+	MaxConnsPerIP int           `mapstructure:"maxConnsPerIP"`
+	QueueTimeout  time.Duration `mapstructure:"queueTimeout"`
+
+	// see IPRule, the dial side covers the targets of all rules
+	Socket *SocketOptions `mapstructure:"socket"`
 }
 
 type HostRule struct {
-	Host   string `mapstructure:"host"`
-	Target string `mapstructure:"target"`
-	Ws     *bool  `mapstructure:"ws"`
+	Host        string       `mapstructure:"host"`
+	Target      string       `mapstructure:"target"`
+	Targets     []Target     `mapstructure:"targets"`
+	Strategy    string       `mapstructure:"strategy"`
+	HealthCheck *HealthCheck `mapstructure:"healthCheck"`
+	Outlier     *Outlier     `mapstructure:"outlier"`
+	Ws          *bool        `mapstructure:"ws"`
+
+	// see IPRule
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout"`
+	Retries        int           `mapstructure:"retries"`
+	RetryBackoff   time.Duration `mapstructure:"retryBackoff"`
+
+	// see IPRule, the v2 header carries the requested host name
+	ProxyProtocol string `mapstructure:"proxyProtocol"`
+
+	// see IPRule, checked once the host is known and after the lists of
+	// the listener
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+
+	Bandwidth *Bandwidth `mapstructure:"bandwidth"`
+
+	// see IPRule, covering passthrough and websocket connections
+	IdleTimeout time.Duration `mapstructure:"idleTimeout"`
+	MaxLifetime time.Duration `mapstructure:"maxLifetime"`
+
+	// Cert and Key, PEM files, make an https rule terminate tls instead of
+	// passing it through, as does CertDir, a directory of name.crt and
+	// name.key pairs. The certificate matching the SNI is served. Forward
+	// is how the decrypted connections reach the targets: ForwardTCP, the
+	// default, pipes them as they are, ForwardHTTP routes every request by
+	// its host among the rules of the listener forwarding http.
+	Cert    string `mapstructure:"cert"`
+	Key     string `mapstructure:"key"`
+	CertDir string `mapstructure:"certDir"`
+	Forward string `mapstructure:"forward"`
+	// ACME terminates tls with a certificate for Host obtained and renewed
+	// by the ACME client instead of Cert or CertDir.
+	ACME bool `mapstructure:"acme"`
+	// ClientCA, a PEM bundle, makes a terminating rule ask clients for a
+	// certificate issued by one of its CAs. ClientAuth is ClientAuthRequire,
+	// the default, or ClientAuthVerifyIfGiven to let clients without one in.
+	// ForwardHTTP only routes requests among the rules with the same
+	// ClientCA and ClientAuth as the rule matching the SNI.
+	ClientCA   string `mapstructure:"clientCA"`
+	ClientAuth string `mapstructure:"clientAuth"`
+
+	// UpstreamTLS encrypts the connections to the targets, websocket
+	// targets being dialed as wss://. Passthrough rules of tls listeners
+	// already carry the tls of the client and must terminate it first.
+	UpstreamTLS *UpstreamTLS `mapstructure:"upstreamTLS"`
+}
+
+func (r HostRule) Upstreams() []Target {
+	return upstreams(r.Target, r.Targets)
+}
+
+// Mux serves tls, http, ssh and any other tcp protocol on a single listener,
+// telling them apart by the first bytes a client sends.
+type Mux struct {
+	BindAddr string `mapstructure:"bindAddr"`
+
+	// SniffTimeout bounds waiting for those bytes, DefaultSniffTimeout if
+	// zero. A client that sent nothing recognized by then goes to Fallback,
+	// which keeps protocols where the server speaks first working.
+	SniffTimeout time.Duration `mapstructure:"sniffTimeout"`
+
+	// TLS routes tls connections by SNI like https rules and HTTP plain
+	// http requests by host like http rules.
+	TLS  []HostRule `mapstructure:"tls"`
+	HTTP []HostRule `mapstructure:"http"`
+	// SSH gets connections starting with an ssh banner.
+	SSH *MuxRoute `mapstructure:"ssh"`
+	// Matchers are tried in order before the protocols above.
+	Matchers []MuxRoute `mapstructure:"matchers"`
+	// Fallback gets every other connection, which is closed without it.
+	Fallback *MuxRoute `mapstructure:"fallback"`
+
+	// see Http. A PROXY protocol header sent by a trusted proxy is read
+	// before sniffing, but unlike on other listeners it is not required.
+	AcceptProxyProtocol bool           `mapstructure:"acceptProxyProtocol"`
+	TrustedProxies      []string       `mapstructure:"trustedProxies"`
+	Allow               []string       `mapstructure:"allow"`
+	Deny                []string       `mapstructure:"deny"`
+	MaxConns            int            `mapstructure:"maxConns"`
+	MaxConnsPerIP       int            `mapstructure:"maxConnsPerIP"`
+	QueueTimeout        time.Duration  `mapstructure:"queueTimeout"`
+	Socket              *SocketOptions `mapstructure:"socket"`
+}
+
+// MuxRoute forwards the connections a Mux sniffed like a tcp rule, listening
+// on the BindAddr of the mux and taking the Socket of the mux unless it has
+// its own. Matchers match connections starting with Prefix, or with the
+// bytes PrefixHex spells in hex.
+type MuxRoute struct {
+	Prefix    string `mapstructure:"prefix"`
+	PrefixHex string `mapstructure:"prefixHex"`
+
+	IPRule `mapstructure:",squash"`
+}
+
+// SocketOptions tune the sockets of a listener, the accept side, and of the
+// connections it dials to its targets. Zero values keep the system defaults.
+// Options of the listening socket itself, ReusePort, FastOpen and TOS on the
+// accept side, only change when it is bound again.
+type SocketOptions struct {
+	// KeepAlive is the tcp keepalive interval, negative disables it.
+	KeepAlive time.Duration `mapstructure:"keepAlive"`
+	// NoDelay sets TCP_NODELAY, which is on by default.
+	NoDelay *bool `mapstructure:"noDelay"`
+	// SendBuffer and RecvBuffer are the socket buffer sizes in bytes, for
+	// udp rules those of the listener and of every session.
+	SendBuffer int `mapstructure:"sendBuffer"`
+	RecvBuffer int `mapstructure:"recvBuffer"`
+	// ReusePort sets SO_REUSEPORT on the listener so that several processes
+	// may share its port.
+	ReusePort bool `mapstructure:"reusePort"`
+	// FastOpen enables TCP Fast Open on both sides.
+	FastOpen bool `mapstructure:"fastOpen"`
+	// TOS is the IP_TOS byte, or IPV6_TCLASS, of every packet sent, DSCP
+	// being its upper six bits.
+	TOS int `mapstructure:"tos"`
+	// SourceAddr is the local ip connections to the targets are dialed from.
+	SourceAddr string `mapstructure:"sourceAddr"`
+
+	// Mode, an octal string like "0660", Owner and Group, names or ids, set
+	// the permissions of the socket file a unix listener creates.
+	Mode  string `mapstructure:"mode"`
+	Owner string `mapstructure:"owner"`
+	Group string `mapstructure:"group"`
+}
+
+// Bandwidth limits the throughput of a rule as a whole, of each of its
+// connections and of all connections of a client ip.
+type Bandwidth struct {
+	Rule   Rate `mapstructure:"rule"`
+	Conn   Rate `mapstructure:"conn"`
+	Client Rate `mapstructure:"client"`
+}
+
+// Rate is a limit in bytes per second, zero is unlimited. Up is the client
+// to target direction, Down the other one. Burst is how many bytes may pass
+// at once after an idle period and defaults to one second worth of data.
+type Rate struct {
+	Up    int64 `mapstructure:"up"`
+	Down  int64 `mapstructure:"down"`
+	Burst int64 `mapstructure:"burst"`
+}
+
+// Target is one upstream of a rule. Weight is ignored by round-robin and
+// defaults to 1.
+type Target struct {
+	Addr   string `mapstructure:"addr"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// Load balancing strategies of a rule with more than one target.
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyWeighted   = "weighted"
+	StrategyLeastConn  = "least-conn"
+	StrategyRandom     = "random"
+	StrategyIPHash     = "ip-hash"
+	StrategyHostHash   = "host-hash"
+)
+
+// PROXY protocol versions
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// HealthCheck actively probes every target of a rule. A target is taken out
+// of selection after Fall failed probes in a row and put back after Rise
+// successful ones.
+type HealthCheck struct {
+	Type     string        `mapstructure:"type"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Rise     int           `mapstructure:"rise"`
+	Fall     int           `mapstructure:"fall"`
+
+	// http
+	Path         string `mapstructure:"path"`
+	Host         string `mapstructure:"host"`
+	ExpectStatus int    `mapstructure:"expectStatus"`
+
+	// tls
+	ServerName string `mapstructure:"serverName"`
+
+	// udp: Send is written to the target, which must answer with a payload
+	// containing Expect. An empty Expect accepts any answer.
+	Send   string `mapstructure:"send"`
+	Expect string `mapstructure:"expect"`
+}
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckTLS  = "tls"
+	HealthCheckUDP  = "udp"
+)
+
+// WithDefaults returns a copy of hc with every unset field filled in.
+func (hc HealthCheck) WithDefaults(network string) HealthCheck {
+	if hc.Type == "" {
+		hc.Type = network
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 3 * time.Second
+	}
+	if hc.Rise == 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall == 0 {
+		hc.Fall = 3
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.ExpectStatus == 0 {
+		hc.ExpectStatus = 200
+	}
+	return hc
+}
+
+// Outlier ejects a target after ConsecutiveFailures dial failures or
+// immediate resets seen in real traffic. The ejection starts at
+// BaseEjectionTime and doubles every time the target fails again right after
+// coming back, up to MaxEjectionTime.
+type Outlier struct {
+	ConsecutiveFailures int           `mapstructure:"consecutiveFailures"`
+	BaseEjectionTime    time.Duration `mapstructure:"baseEjectionTime"`
+	MaxEjectionTime     time.Duration `mapstructure:"maxEjectionTime"`
+}
+
+// WithDefaults returns a copy of o with every unset field filled in.
+func (o Outlier) WithDefaults() Outlier {
+	if o.ConsecutiveFailures == 0 {
+		o.ConsecutiveFailures = 5
+	}
+	if o.BaseEjectionTime == 0 {
+		o.BaseEjectionTime = 30 * time.Second
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = 5 * time.Minute
+	}
+	if o.MaxEjectionTime < o.BaseEjectionTime {
+		o.MaxEjectionTime = o.BaseEjectionTime
+	}
+	return o
+}
+
+// upstreams merges the single target shorthand with the targets list.
+func upstreams(target string, targets []Target) []Target {
+	if target == "" {
+		return targets
+	}
+	return append([]Target{{Addr: target}}, targets...)
 }
 
 type Dashboard struct {
@@ -31,3 +396,51 @@ type Dashboard struct {
 	HttpUser     string `mapstructure:"httpUser"`
 	HttpPassword string `mapstructure:"httpPassword"`
 }
+
+// Guard rate limits new connections of every client ip and bans the ones
+// that fail MaxFailures times within FailureWindow for BanTime. Failures are
+// broken handshakes, unmatched hosts and denied connections. Clients in
+// Exempt are never limited nor banned.
+type Guard struct {
+	// ConnRate is the number of new connections per second, zero is
+	// unlimited, ConnBurst how many may come at once and defaults to
+	// ConnRate.
+	ConnRate  float64 `mapstructure:"connRate"`
+	ConnBurst int     `mapstructure:"connBurst"`
+
+	// MaxFailures of zero never bans.
+	MaxFailures   int           `mapstructure:"maxFailures"`
+	FailureWindow time.Duration `mapstructure:"failureWindow"`
+	BanTime       time.Duration `mapstructure:"banTime"`
+
+	Exempt []string `mapstructure:"exempt"`
+}
+
+// WithDefaults returns g with the unset fields filled in.
+func (g Guard) WithDefaults() Guard {
+	if g.ConnBurst <= 0 {
+		g.ConnBurst = max(1, int(g.ConnRate))
+	}
+	if g.FailureWindow <= 0 {
+		g.FailureWindow = time.Minute
+	}
+	if g.BanTime <= 0 {
+		g.BanTime = 10 * time.Minute
+	}
+	return g
+}
+
+// ParsePrefix parses a CIDR or a single ip address, which is taken as the
+// prefix holding only itself.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
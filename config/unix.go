@@ -0,0 +1,12 @@
+package config
+
+import "strings"
+
+// UnixPrefix marks a bindAddr or target as a unix domain socket, as in
+// "unix:/run/app.sock". A path starting with @ names an abstract socket.
+const UnixPrefix = "unix:"
+
+// UnixPath returns the socket path of addr if it is a unix socket address.
+func UnixPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, UnixPrefix)
+}
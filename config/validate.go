@@ -0,0 +1,717 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate checks the whole config up front and reports every problem it
+// finds at once, each prefixed with its path in the config file.
+func (c *YARPConfig) Validate() error {
+	v := &validator{acme: c.ACME != nil}
+	tcpBinds := &bindings{}
+	udpBinds := &bindings{}
+
+	if c.TCP != nil {
+		for i, rule := range *c.TCP {
+			v.ipRule(fmt.Sprintf("tcp[%d]", i), "tcp", rule, tcpBinds)
+		}
+	}
+
+	if c.UDP != nil {
+		for i, rule := range *c.UDP {
+			v.ipRule(fmt.Sprintf("udp[%d]", i), "udp", rule, udpBinds)
+		}
+	}
+
+	if c.Http != nil {
+		for i, h := range *c.Http {
+			v.http(fmt.Sprintf("http[%d]", i), h, false, tcpBinds)
+		}
+	}
+
+	if c.Https != nil {
+		for i, h := range *c.Https {
+			v.http(fmt.Sprintf("https[%d]", i), h, true, tcpBinds)
+		}
+	}
+
+	if c.Mux != nil {
+		for i, m := range *c.Mux {
+			v.mux(fmt.Sprintf("mux[%d]", i), m, tcpBinds)
+		}
+	}
+
+	if c.Dashboard != nil {
+		v.singlePort("dashboard.bindAddr", v.bindAddr("dashboard.bindAddr", c.Dashboard.BindAddr, tcpBinds))
+	}
+
+	if c.Guard != nil {
+		g := c.Guard
+		if g.ConnRate < 0 {
+			v.errorf("guard.connRate", "must not be negative")
+		}
+		if g.ConnBurst < 0 {
+			v.errorf("guard.connBurst", "must not be negative")
+		}
+		if g.MaxFailures < 0 {
+			v.errorf("guard.maxFailures", "must not be negative")
+		}
+		if g.FailureWindow < 0 {
+			v.errorf("guard.failureWindow", "must not be negative")
+		}
+		if g.BanTime < 0 {
+			v.errorf("guard.banTime", "must not be negative")
+		}
+		v.prefixes("guard.exempt", g.Exempt)
+	}
+
+	if c.ACME != nil {
+		v.acmeClient("acme", *c.ACME)
+	}
+
+	if c.DrainTimeout < 0 {
+		v.errorf("drainTimeout", "must not be negative")
+	}
+	if c.LingerTimeout < 0 {
+		v.errorf("lingerTimeout", "must not be negative")
+	}
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+	// acme is set if the acme client is configured
+	acme bool
+}
+
+// bindings records the listen addresses seen so far in one network.
+type bindings []binding
+
+type binding struct {
+	addr string
+	path string
+}
+
+func (v *validator) errorf(path, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) ipRule(path, network string, rule IPRule, binds *bindings) {
+	if network == "udp" {
+		v.noUnix(path+".bindAddr", rule.BindAddr)
+		v.noUnix(path+".target", rule.Target)
+		for i, t := range rule.Targets {
+			v.noUnix(fmt.Sprintf("%s.targets[%d].addr", path, i), t.Addr)
+		}
+	}
+	ports := v.bindAddr(path+".bindAddr", rule.BindAddr, binds)
+	v.ipTargets(path, network, rule, ports)
+	v.acceptProxyProtocol(path, network, rule.AcceptProxyProtocol, rule.TrustedProxies)
+	if rule.PerPortStats && ports == 1 {
+		v.errorf(path+".perPortStats", "needs a port range in bindAddr")
+	}
+}
+
+// ipTargets checks everything of rule but how it listens.
+func (v *validator) ipTargets(path, network string, rule IPRule, ports int) {
+	v.upstreams(path, rule.Target, rule.Targets, ports)
+	if rule.Strategy == StrategyHostHash {
+		v.errorf(path+".strategy", "%q needs a host, use it on http/https rules", rule.Strategy)
+	} else {
+		v.strategy(path+".strategy", rule.Strategy)
+	}
+	v.healthCheck(path+".healthCheck", network, rule.HealthCheck)
+	v.outlier(path+".outlier", rule.Outlier)
+	v.retries(path, network, rule.ConnectTimeout, rule.Retries, rule.RetryBackoff)
+	v.proxyProtocol(path+".proxyProtocol", network, rule.ProxyProtocol)
+	v.prefixes(path+".allow", rule.Allow)
+	v.prefixes(path+".deny", rule.Deny)
+	v.connLimits(path, network, rule.MaxConns, rule.MaxConnsPerIP, rule.QueueTimeout)
+	v.bandwidth(path+".bandwidth", rule.Bandwidth)
+	v.timeouts(path, network, rule.IdleTimeout, rule.MaxLifetime)
+	v.socket(path+".socket", network, rule.Socket)
+	v.upstreamTLS(path+".upstreamTLS", network, rule.UpstreamTLS, rule.Target, rule.Targets)
+}
+
+func (v *validator) http(path string, h Http, tlsListener bool, binds *bindings) {
+	v.singlePort(path+".bindAddr", v.bindAddr(path+".bindAddr", h.BindAddr, binds))
+	v.acceptProxyProtocol(path, "tcp", h.AcceptProxyProtocol, h.TrustedProxies)
+	v.prefixes(path+".allow", h.Allow)
+	v.prefixes(path+".deny", h.Deny)
+	v.connLimits(path, "tcp", h.MaxConns, h.MaxConnsPerIP, h.QueueTimeout)
+	v.socket(path+".socket", "tcp", h.Socket)
+
+	if len(h.Rules) == 0 {
+		v.errorf(path+".rules", "no rules configured")
+	}
+	v.hostRules(path+".rules", h.Rules, tlsListener)
+}
+
+func (v *validator) mux(path string, m Mux, binds *bindings) {
+	v.singlePort(path+".bindAddr", v.bindAddr(path+".bindAddr", m.BindAddr, binds))
+	if m.SniffTimeout < 0 {
+		v.errorf(path+".sniffTimeout", "must not be negative")
+	}
+	v.acceptProxyProtocol(path, "tcp", m.AcceptProxyProtocol, m.TrustedProxies)
+	v.prefixes(path+".allow", m.Allow)
+	v.prefixes(path+".deny", m.Deny)
+	v.connLimits(path, "tcp", m.MaxConns, m.MaxConnsPerIP, m.QueueTimeout)
+	v.socket(path+".socket", "tcp", m.Socket)
+
+	if len(m.TLS) == 0 && len(m.HTTP) == 0 && m.SSH == nil && len(m.Matchers) == 0 && m.Fallback == nil {
+		v.errorf(path, "no routes configured")
+	}
+	v.hostRules(path+".tls", m.TLS, true)
+	v.hostRules(path+".http", m.HTTP, false)
+	if m.SSH != nil {
+		v.muxRoute(path+".ssh", *m.SSH, false)
+	}
+	for i, r := range m.Matchers {
+		v.muxRoute(fmt.Sprintf("%s.matchers[%d]", path, i), r, true)
+	}
+	if m.Fallback != nil {
+		v.muxRoute(path+".fallback", *m.Fallback, false)
+	}
+}
+
+func (v *validator) muxRoute(path string, r MuxRoute, matcher bool) {
+	if r.BindAddr != "" {
+		v.errorf(path+".bindAddr", "routes listen on the bindAddr of the mux")
+	}
+	if r.AcceptProxyProtocol || len(r.TrustedProxies) > 0 {
+		v.errorf(path+".acceptProxyProtocol", "set it on the mux")
+	}
+	if r.PerPortStats {
+		v.errorf(path+".perPortStats", "needs a port range in bindAddr")
+	}
+	v.ipTargets(path, "tcp", r.IPRule, 1)
+
+	if !matcher {
+		if r.Prefix != "" || r.PrefixHex != "" {
+			v.errorf(path+".prefix", "only matchers have a prefix")
+		}
+		return
+	}
+	switch {
+	case r.Prefix != "" && r.PrefixHex != "":
+		v.errorf(path+".prefix", "set either prefix or prefixHex")
+	case r.Prefix == "" && r.PrefixHex == "":
+		v.errorf(path+".prefix", "no prefix configured")
+	case r.PrefixHex != "":
+		if _, err := hex.DecodeString(r.PrefixHex); err != nil {
+			v.errorf(path+".prefixHex", "invalid hex: %v", err)
+		}
+	}
+}
+
+// hostRules checks the host rules of a listener, path naming their list.
+// Only the rules of tls listeners may terminate tls.
+func (v *validator) hostRules(path string, rules []HostRule, tlsListener bool) {
+	hosts := make(map[string]int)
+	for i, rule := range rules {
+		rulePath := fmt.Sprintf("%s[%d]", path, i)
+		v.host(rulePath+".host", rule.Host)
+		v.upstreams(rulePath, rule.Target, rule.Targets, 1)
+		v.strategy(rulePath+".strategy", rule.Strategy)
+		v.healthCheck(rulePath+".healthCheck", "tcp", rule.HealthCheck)
+		v.outlier(rulePath+".outlier", rule.Outlier)
+		v.retries(rulePath, "tcp", rule.ConnectTimeout, rule.Retries, rule.RetryBackoff)
+		v.proxyProtocol(rulePath+".proxyProtocol", "tcp", rule.ProxyProtocol)
+		v.prefixes(rulePath+".allow", rule.Allow)
+		v.prefixes(rulePath+".deny", rule.Deny)
+		v.bandwidth(rulePath+".bandwidth", rule.Bandwidth)
+		v.timeouts(rulePath, "tcp", rule.IdleTimeout, rule.MaxLifetime)
+		v.termination(rulePath, rule, tlsListener)
+		v.upstreamTLS(rulePath+".upstreamTLS", "tcp", rule.UpstreamTLS, rule.Target, rule.Targets)
+		if rule.UpstreamTLS.Enabled() && tlsListener && !rule.Terminates() {
+			v.errorf(rulePath+".upstreamTLS", "passthrough rules forward the tls of the client, terminate it to encrypt again")
+		}
+
+		host := strings.ToLower(rule.Host)
+		if j, ok := hosts[host]; ok {
+			v.errorf(rulePath+".host", "%q conflicts with %s[%d]", rule.Host, path, j)
+			continue
+		}
+		hosts[host] = i
+	}
+}
+
+func (v *validator) termination(path string, rule HostRule, tlsListener bool) {
+	if !rule.Terminates() {
+		if rule.Key != "" {
+			v.errorf(path+".key", "needs a cert")
+		}
+		if rule.Forward != "" {
+			v.errorf(path+".forward", "needs a cert to terminate tls")
+		}
+		if rule.ClientCA != "" || rule.ClientAuth != "" {
+			v.errorf(path+".clientCA", "needs a cert to terminate tls")
+		}
+		return
+	}
+	if !tlsListener {
+		field := ".cert"
+		if rule.ACME {
+			field = ".acme"
+		}
+		v.errorf(path+field, "only rules of tls listeners terminate tls")
+		return
+	}
+
+	switch rule.Forward {
+	case "", ForwardTCP, ForwardHTTP:
+	default:
+		v.errorf(path+".forward", "unknown forward %q, want tcp or http", rule.Forward)
+	}
+
+	switch rule.ClientAuth {
+	case "", ClientAuthRequire, ClientAuthVerifyIfGiven:
+	default:
+		v.errorf(path+".clientAuth", "unknown clientAuth %q, want %s or %s", rule.ClientAuth, ClientAuthRequire, ClientAuthVerifyIfGiven)
+	}
+	if rule.ClientCA != "" {
+		pem, err := os.ReadFile(rule.ClientCA)
+		if err != nil {
+			v.errorf(path+".clientCA", "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			v.errorf(path+".clientCA", "no certificates in %s", rule.ClientCA)
+		}
+	} else if rule.ClientAuth != "" {
+		v.errorf(path+".clientAuth", "needs a clientCA")
+	}
+
+	if rule.ACME {
+		if rule.Cert != "" || rule.Key != "" || rule.CertDir != "" {
+			v.errorf(path+".acme", "takes no cert, key or certDir")
+		}
+		if isWildcardHost(rule.Host) || strings.HasPrefix(rule.Host, "*") || net.ParseIP(rule.Host) != nil {
+			v.errorf(path+".acme", "needs a dns host name, wildcards and ips are not supported")
+		}
+		if !v.acme {
+			v.errorf(path+".acme", "needs an acme section")
+		}
+		return
+	}
+	if rule.Cert != "" && rule.Key == "" {
+		v.errorf(path+".key", "needs a key for cert")
+		return
+	}
+	if rule.Cert == "" && rule.Key != "" {
+		v.errorf(path+".key", "needs a cert")
+	}
+
+	pairs, err := rule.CertPairs()
+	if err != nil {
+		v.errorf(path+".certDir", "%v", err)
+		return
+	}
+	for _, p := range pairs {
+		if _, err := tls.LoadX509KeyPair(p.Cert, p.Key); err != nil {
+			v.errorf(path+".cert", "%s: %v", p.Cert, err)
+		}
+	}
+}
+
+func (v *validator) upstreamTLS(path, network string, u *UpstreamTLS, target string, targets []Target) {
+	if !u.Enabled() {
+		return
+	}
+	if network == "udp" {
+		v.errorf(path, "not supported on udp rules")
+		return
+	}
+
+	if u.CA != "" {
+		pem, err := os.ReadFile(u.CA)
+		if err != nil {
+			v.errorf(path+".ca", "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			v.errorf(path+".ca", "no certificates in %s", u.CA)
+		}
+	}
+	switch {
+	case u.Cert != "" && u.Key == "":
+		v.errorf(path+".key", "needs a key for cert")
+	case u.Cert == "" && u.Key != "":
+		v.errorf(path+".key", "needs a cert")
+	case u.Cert != "":
+		if _, err := tls.LoadX509KeyPair(u.Cert, u.Key); err != nil {
+			v.errorf(path+".cert", "%v", err)
+		}
+	}
+	if _, err := TLSVersion(u.MinVersion); err != nil {
+		v.errorf(path+".minVersion", "%v", err)
+	}
+
+	// a unix socket has no host to verify the certificate against
+	if u.ServerName == "" && !u.InsecureSkipVerify {
+		addrs := []string{target}
+		for _, t := range targets {
+			addrs = append(addrs, t.Addr)
+		}
+		for _, addr := range addrs {
+			if _, ok := UnixPath(addr); ok {
+				v.errorf(path+".serverName", "needed to verify unix socket targets")
+				break
+			}
+		}
+	}
+}
+
+func (v *validator) acmeClient(path string, a ACME) {
+	if a.DirectoryURL != "" {
+		if u, err := url.Parse(a.DirectoryURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			v.errorf(path+".directoryURL", "%q is not an http(s) url", a.DirectoryURL)
+		}
+	}
+	if a.CACert != "" {
+		pem, err := os.ReadFile(a.CACert)
+		if err != nil {
+			v.errorf(path+".caCert", "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			v.errorf(path+".caCert", "no certificates in %s", a.CACert)
+		}
+	}
+	if a.RenewBefore < 0 {
+		v.errorf(path+".renewBefore", "must not be negative")
+	}
+	for i, c := range a.Challenges {
+		if c != ChallengeTLSALPN01 && c != ChallengeHTTP01 {
+			v.errorf(fmt.Sprintf("%s.challenges[%d]", path, i), "unknown challenge %q, want %s or %s", c, ChallengeTLSALPN01, ChallengeHTTP01)
+		}
+	}
+}
+
+// bindAddr checks addr and records it in binds, so that two listeners of the
+// same network that would fight over one port are reported. It returns the
+// number of ports addr binds, zero if it is invalid.
+func (v *validator) bindAddr(path, addr string, binds *bindings) int {
+	if sock, ok := UnixPath(addr); ok {
+		if sock == "" || sock == "@" {
+			v.errorf(path, "unix socket path must not be empty")
+			return 0
+		}
+		for _, b := range *binds {
+			if b.addr == addr {
+				v.errorf(path, "%q is already bound by %s", addr, b.path)
+				return 0
+			}
+		}
+		*binds = append(*binds, binding{addr: addr, path: path})
+		return 1
+	}
+
+	// a host name is resolved by the listener, so only its spelling can
+	// conflict
+	host, first, last, err := SplitPortRange(addr)
+	if err != nil {
+		v.errorf(path, "%v", err)
+		return 0
+	}
+
+	for _, b := range *binds {
+		if _, ok := UnixPath(b.addr); ok {
+			continue
+		}
+		otherHost, otherFirst, otherLast, _ := SplitPortRange(b.addr)
+		overlap := first <= otherLast && otherFirst <= last
+		if overlap && (otherHost == host || isWildcardHost(host) || isWildcardHost(otherHost)) {
+			v.errorf(path, "%q is already bound by %s", addr, b.path)
+			return 0
+		}
+	}
+	*binds = append(*binds, binding{addr: addr, path: path})
+	return last - first + 1
+}
+
+func (v *validator) noUnix(path, addr string) {
+	if _, ok := UnixPath(addr); ok {
+		v.errorf(path, "unix sockets are not supported on udp rules")
+	}
+}
+
+func (v *validator) singlePort(path string, ports int) {
+	if ports > 1 {
+		v.errorf(path, "port ranges only work on tcp and udp rules")
+	}
+}
+
+// upstreams checks the target shorthand and the targets list of a rule
+// binding ports ports.
+func (v *validator) upstreams(path, target string, targets []Target, ports int) {
+	if target == "" && len(targets) == 0 {
+		v.errorf(path+".target", "must not be empty")
+		return
+	}
+
+	if target != "" {
+		v.target(path+".target", target, ports)
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range targets {
+		targetPath := fmt.Sprintf("%s.targets[%d]", path, i)
+		v.target(targetPath+".addr", t.Addr, ports)
+		if t.Weight < 0 {
+			v.errorf(targetPath+".weight", "must not be negative")
+		}
+		if seen[t.Addr] || t.Addr == target {
+			v.errorf(targetPath+".addr", "duplicate target %q", t.Addr)
+		}
+		seen[t.Addr] = true
+	}
+}
+
+func (v *validator) strategy(path, strategy string) {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyWeighted, StrategyLeastConn, StrategyRandom, StrategyIPHash, StrategyHostHash:
+	default:
+		v.errorf(path, "unknown strategy %q", strategy)
+	}
+}
+
+func (v *validator) proxyProtocol(path, network, version string) {
+	switch version {
+	case "", ProxyProtocolV2:
+	case ProxyProtocolV1:
+		if network == "udp" {
+			v.errorf(path, "udp rules need v2")
+		}
+	default:
+		v.errorf(path, "unknown version %q, want v1 or v2", version)
+	}
+}
+
+func (v *validator) acceptProxyProtocol(path, network string, accept bool, trusted []string) {
+	if network == "udp" && accept {
+		v.errorf(path+".acceptProxyProtocol", "not supported on udp rules")
+	} else if accept && len(trusted) == 0 {
+		// anyone could announce any address and slip past acls and limits
+		v.errorf(path+".trustedProxies", "needs the sources allowed to send a PROXY header")
+	}
+	if !accept && len(trusted) > 0 {
+		v.errorf(path+".trustedProxies", "needs acceptProxyProtocol")
+	}
+	v.prefixes(path+".trustedProxies", trusted)
+}
+
+func (v *validator) connLimits(path, network string, max, maxPerIP int, queue time.Duration) {
+	if max < 0 {
+		v.errorf(path+".maxConns", "must not be negative")
+	}
+	if maxPerIP < 0 {
+		v.errorf(path+".maxConnsPerIP", "must not be negative")
+	}
+	if queue < 0 {
+		v.errorf(path+".queueTimeout", "must not be negative")
+	}
+	if network == "udp" && queue != 0 {
+		v.errorf(path+".queueTimeout", "udp rules do not queue")
+	}
+}
+
+func (v *validator) bandwidth(path string, bw *Bandwidth) {
+	if bw == nil {
+		return
+	}
+
+	rates := []struct {
+		name string
+		rate Rate
+	}{{"rule", bw.Rule}, {"conn", bw.Conn}, {"client", bw.Client}}
+	for _, r := range rates {
+		if r.rate.Up < 0 || r.rate.Down < 0 || r.rate.Burst < 0 {
+			v.errorf(path+"."+r.name, "rates must not be negative")
+		}
+	}
+}
+
+func (v *validator) timeouts(path, network string, idle, lifetime time.Duration) {
+	if idle < 0 {
+		v.errorf(path+".idleTimeout", "must not be negative")
+	}
+	if lifetime < 0 {
+		v.errorf(path+".maxLifetime", "must not be negative")
+	}
+	if network == "udp" && lifetime != 0 {
+		v.errorf(path+".maxLifetime", "not supported on udp rules")
+	}
+}
+
+func (v *validator) socket(path, network string, s *SocketOptions) {
+	if s == nil {
+		return
+	}
+
+	if s.SendBuffer < 0 {
+		v.errorf(path+".sendBuffer", "must not be negative")
+	}
+	if s.RecvBuffer < 0 {
+		v.errorf(path+".recvBuffer", "must not be negative")
+	}
+	if s.TOS < 0 || s.TOS > 255 {
+		v.errorf(path+".tos", "%d is not a byte", s.TOS)
+	}
+	if s.SourceAddr != "" && net.ParseIP(s.SourceAddr) == nil {
+		v.errorf(path+".sourceAddr", "%q is not an ip address", s.SourceAddr)
+	}
+	if s.Mode != "" {
+		if _, err := strconv.ParseUint(s.Mode, 8, 32); err != nil {
+			v.errorf(path+".mode", "%q is not an octal file mode", s.Mode)
+		}
+	}
+	if network == "udp" {
+		if s.KeepAlive != 0 {
+			v.errorf(path+".keepAlive", "not supported on udp rules")
+		}
+		if s.NoDelay != nil {
+			v.errorf(path+".noDelay", "not supported on udp rules")
+		}
+		if s.FastOpen {
+			v.errorf(path+".fastOpen", "not supported on udp rules")
+		}
+	}
+}
+
+func (v *validator) prefixes(path string, list []string) {
+	for i, s := range list {
+		if _, err := ParsePrefix(s); err != nil {
+			v.errorf(fmt.Sprintf("%s[%d]", path, i), "invalid ip or cidr %q", s)
+		}
+	}
+}
+
+func (v *validator) healthCheck(path, network string, hc *HealthCheck) {
+	if hc == nil {
+		return
+	}
+
+	typ := hc.WithDefaults(network).Type
+	switch typ {
+	case HealthCheckUDP:
+		if network != "udp" {
+			v.errorf(path+".type", "%q checks only work on udp rules", hc.Type)
+		}
+	case HealthCheckTCP, HealthCheckHTTP, HealthCheckTLS:
+		if network != "tcp" {
+			v.errorf(path+".type", "%q checks do not work on %s rules", hc.Type, network)
+		}
+	default:
+		v.errorf(path+".type", "unknown health check type %q", hc.Type)
+	}
+
+	if hc.Interval < 0 {
+		v.errorf(path+".interval", "must not be negative")
+	}
+	if hc.Timeout < 0 {
+		v.errorf(path+".timeout", "must not be negative")
+	}
+	if hc.Rise < 0 {
+		v.errorf(path+".rise", "must not be negative")
+	}
+	if hc.Fall < 0 {
+		v.errorf(path+".fall", "must not be negative")
+	}
+	if hc.ExpectStatus != 0 && (hc.ExpectStatus < 100 || hc.ExpectStatus > 599) {
+		v.errorf(path+".expectStatus", "invalid http status %d", hc.ExpectStatus)
+	}
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		v.errorf(path+".path", "must start with /")
+	}
+	if typ == HealthCheckUDP && hc.Send == "" {
+		v.errorf(path+".send", "udp checks need a payload to send")
+	}
+}
+
+func (v *validator) outlier(path string, o *Outlier) {
+	if o == nil {
+		return
+	}
+
+	if o.ConsecutiveFailures < 0 {
+		v.errorf(path+".consecutiveFailures", "must not be negative")
+	}
+	if o.BaseEjectionTime < 0 {
+		v.errorf(path+".baseEjectionTime", "must not be negative")
+	}
+	if o.MaxEjectionTime < 0 {
+		v.errorf(path+".maxEjectionTime", "must not be negative")
+	}
+}
+
+func (v *validator) retries(path, network string, timeout time.Duration, retries int, backoff time.Duration) {
+	if timeout < 0 {
+		v.errorf(path+".connectTimeout", "must not be negative")
+	}
+	if retries < 0 {
+		v.errorf(path+".retries", "must not be negative")
+	}
+	if backoff < 0 {
+		v.errorf(path+".retryBackoff", "must not be negative")
+	}
+	if network == "udp" && (timeout != 0 || retries != 0 || backoff != 0) {
+		v.errorf(path, "connectTimeout, retries and retryBackoff do not apply to udp rules")
+	}
+}
+
+// target checks addr, the target of a rule binding ports ports. A port range
+// must be as long as the bound one.
+func (v *validator) target(path, addr string, ports int) {
+	if sock, ok := UnixPath(addr); ok {
+		if sock == "" || sock == "@" {
+			v.errorf(path, "unix socket path must not be empty")
+		}
+		return
+	}
+
+	host, first, last, err := SplitPortRange(addr)
+	if err != nil {
+		v.errorf(path, "%v", err)
+		return
+	}
+	if size := last - first + 1; size > 1 && size != ports {
+		if ports > 1 {
+			v.errorf(path, "port range of %q does not match the %d ports bound", addr, ports)
+		} else {
+			v.errorf(path, "port range %q needs a bindAddr with as many ports", addr)
+		}
+		return
+	}
+	if host == "" {
+		v.errorf(path, "%q has no host", addr)
+	}
+}
+
+func (v *validator) host(path, host string) {
+	if host == "" {
+		v.errorf(path, "must not be empty")
+		return
+	}
+
+	// a leading * matches any prefix, so *.example.com matches the
+	// subdomains and *example.com example.com itself as well
+	if strings.Contains(host, "*") {
+		if host[0] != '*' || len(host) < 2 || strings.Contains(host[1:], "*") {
+			v.errorf(path, "invalid wildcard %q, expect a leading * like *.example.com", host)
+		}
+	}
+}
+
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
@@ -0,0 +1,414 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     YARPConfig
+		wantErr []string
+	}{
+		{
+			name: "valid config",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{
+					{BindAddr: "[::]:4396", Target: "192.168.1.7:9527"},
+					{BindAddr: "localhost:4397", Target: "192.168.1.7:9528"},
+				},
+				UDP: &[]IPRule{{BindAddr: "[::]:4396", Target: "192.168.1.7:6666"}},
+				Http: &[]Http{{BindAddr: "0.0.0.0:80", Rules: []HostRule{
+					{Host: "example.com", Target: "127.0.0.1:81"},
+					{Host: "*.foo.bar", Target: "127.0.0.1:80"},
+					{Host: "*foo.com", Target: "127.0.0.1:80"},
+				}}},
+			},
+		},
+		{
+			name: "bad addresses",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{
+					{BindAddr: "4396", Target: ""},
+					{BindAddr: "example.com:80", Target: ":80"},
+					{BindAddr: "example.com:80-81", Target: "127.0.0.1:80"},
+				},
+			},
+			wantErr: []string{
+				"tcp[0].bindAddr: address 4396: missing port in address",
+				"tcp[0].target: must not be empty",
+				`tcp[1].target: ":80" has no host`,
+				`tcp[2].bindAddr: "example.com:80-81" is already bound by tcp[1].bindAddr`,
+			},
+		},
+		{
+			name: "duplicate bindAddr across protocols",
+			cfg: YARPConfig{
+				TCP:   &[]IPRule{{BindAddr: "127.0.0.1:443", Target: "127.0.0.1:8443"}},
+				Https: &[]Http{{BindAddr: "[::]:443", Rules: []HostRule{{Host: "a.com", Target: "127.0.0.1:1"}}}},
+			},
+			wantErr: []string{`https[0].bindAddr: "[::]:443" is already bound by tcp[0].bindAddr`},
+		},
+		{
+			name: "guard",
+			cfg: YARPConfig{
+				TCP:   &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1"}},
+				Guard: &Guard{ConnRate: -1, BanTime: -time.Second, Exempt: []string{"x"}},
+			},
+			wantErr: []string{
+				"guard.connRate: must not be negative",
+				"guard.banTime: must not be negative",
+				`guard.exempt[0]: invalid ip or cidr "x"`,
+			},
+		},
+		{
+			name: "health checks",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", HealthCheck: &HealthCheck{Type: "udp"}}},
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", HealthCheck: &HealthCheck{}}},
+				Http: &[]Http{{BindAddr: ":2", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", HealthCheck: &HealthCheck{Type: "http", Path: "healthz", ExpectStatus: 1000}},
+				}}},
+			},
+			wantErr: []string{
+				`tcp[0].healthCheck.type: "udp" checks only work on udp rules`,
+				"tcp[0].healthCheck.send: udp checks need a payload to send",
+				"udp[0].healthCheck.send: udp checks need a payload to send",
+				"http[0].rules[0].healthCheck.expectStatus: invalid http status 1000",
+				"http[0].rules[0].healthCheck.path: must start with /",
+			},
+		},
+		{
+			name: "retries",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", ConnectTimeout: -time.Second, Retries: -1}},
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", Retries: 1}},
+				Https: &[]Http{{BindAddr: ":2", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", Retries: 2, RetryBackoff: -time.Second},
+				}}},
+			},
+			wantErr: []string{
+				"tcp[0].connectTimeout: must not be negative",
+				"tcp[0].retries: must not be negative",
+				"udp[0]: connectTimeout, retries and retryBackoff do not apply to udp rules",
+				"https[0].rules[0].retryBackoff: must not be negative",
+			},
+		},
+		{
+			name: "proxy protocol",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", ProxyProtocol: "v3"}},
+				UDP: &[]IPRule{
+					{BindAddr: ":1", Target: "127.0.0.1:1", ProxyProtocol: "v1"},
+					{BindAddr: ":2", Target: "127.0.0.1:1", ProxyProtocol: "v2", AcceptProxyProtocol: true},
+				},
+				Http: &[]Http{{BindAddr: ":3", TrustedProxies: []string{"10.0.0.1", "10.0.0.0/33"}, Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1"},
+				}}},
+				Https: &[]Http{{BindAddr: ":4", AcceptProxyProtocol: true, Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1"},
+				}}},
+			},
+			wantErr: []string{
+				`tcp[0].proxyProtocol: unknown version "v3", want v1 or v2`,
+				"udp[0].proxyProtocol: udp rules need v2",
+				"udp[1].acceptProxyProtocol: not supported on udp rules",
+				"http[0].trustedProxies: needs acceptProxyProtocol",
+				`http[0].trustedProxies[1]: invalid ip or cidr "10.0.0.0/33"`,
+				"https[0].trustedProxies: needs the sources allowed to send a PROXY header",
+			},
+		},
+		{
+			name: "allow and deny lists",
+			cfg: YARPConfig{
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"foo"}}},
+				Http: &[]Http{{BindAddr: ":2", Allow: []string{"10.0.0.300"}, Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", Deny: []string{"2001:db8::/129"}},
+				}}},
+			},
+			wantErr: []string{
+				`udp[0].deny[0]: invalid ip or cidr "foo"`,
+				`http[0].allow[0]: invalid ip or cidr "10.0.0.300"`,
+				`http[0].rules[0].deny[0]: invalid ip or cidr "2001:db8::/129"`,
+			},
+		},
+		{
+			name: "connection and bandwidth limits",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", MaxConns: -1, QueueTimeout: time.Second,
+					Bandwidth: &Bandwidth{Client: Rate{Up: -1}}}},
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:1", MaxConnsPerIP: 1, QueueTimeout: time.Second}},
+				Https: &[]Http{{BindAddr: ":2", MaxConnsPerIP: -1, Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1"},
+				}}},
+			},
+			wantErr: []string{
+				"tcp[0].maxConns: must not be negative",
+				"tcp[0].bandwidth.client: rates must not be negative",
+				"udp[0].queueTimeout: udp rules do not queue",
+				"https[0].maxConnsPerIP: must not be negative",
+			},
+		},
+		{
+			name: "idle timeout and max lifetime",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:2", IdleTimeout: time.Minute, MaxLifetime: -time.Second}},
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:2", IdleTimeout: time.Minute, MaxLifetime: time.Hour}},
+				Http: &[]Http{{BindAddr: ":80", Rules: []HostRule{
+					{Host: "example.com", Target: "127.0.0.1:81", IdleTimeout: -time.Second},
+				}}},
+			},
+			wantErr: []string{
+				"tcp[0].maxLifetime: must not be negative",
+				"udp[0].maxLifetime: not supported on udp rules",
+				"http[0].rules[0].idleTimeout: must not be negative",
+			},
+		},
+		{
+			name: "socket options",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:2", Socket: &SocketOptions{
+					KeepAlive: -1, SendBuffer: 1 << 20, ReusePort: true, FastOpen: true, TOS: 0xb8, SourceAddr: "10.0.0.1",
+				}}},
+				UDP: &[]IPRule{{BindAddr: ":1", Target: "127.0.0.1:2", Socket: &SocketOptions{
+					RecvBuffer: -1, FastOpen: true, TOS: 256, SourceAddr: "example.com",
+				}}},
+			},
+			wantErr: []string{
+				"udp[0].socket.recvBuffer: must not be negative",
+				"udp[0].socket.tos: 256 is not a byte",
+				`udp[0].socket.sourceAddr: "example.com" is not an ip address`,
+				"udp[0].socket.fastOpen: not supported on udp rules",
+			},
+		},
+		{
+			name: "port ranges",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{
+					{BindAddr: "0.0.0.0:30000-30100", Target: "10.0.0.5:30000-30100", PerPortStats: true},
+					{BindAddr: "0.0.0.0:30100-30200", Target: "10.0.0.5:22"},
+					{BindAddr: "0.0.0.0:4000-4002", Targets: []Target{{Addr: "10.0.0.5:1-2"}}},
+					{BindAddr: "0.0.0.0:4010", Target: "10.0.0.5:1-2", PerPortStats: true},
+					{BindAddr: "0.0.0.0:4020-4010", Target: "10.0.0.5:1"},
+				},
+				UDP: &[]IPRule{{BindAddr: "0.0.0.0:30000-30100", Target: "10.0.0.5:40000-40100"}},
+				Http: &[]Http{{BindAddr: "0.0.0.0:80-81", Rules: []HostRule{
+					{Host: "example.com", Target: "127.0.0.1:81-82"},
+				}}},
+			},
+			wantErr: []string{
+				`tcp[1].bindAddr: "0.0.0.0:30100-30200" is already bound by tcp[0].bindAddr`,
+				`tcp[2].targets[0].addr: port range of "10.0.0.5:1-2" does not match the 3 ports bound`,
+				`tcp[3].target: port range "10.0.0.5:1-2" needs a bindAddr with as many ports`,
+				"tcp[3].perPortStats: needs a port range in bindAddr",
+				`tcp[4].bindAddr: invalid port range "4020-4010"`,
+				"http[0].bindAddr: port ranges only work on tcp and udp rules",
+				`http[0].rules[0].target: port range "127.0.0.1:81-82" needs a bindAddr with as many ports`,
+			},
+		},
+		{
+			name: "unix sockets",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{
+					{BindAddr: "unix:/run/a.sock", Target: "unix:@backend", Socket: &SocketOptions{Mode: "0660"}},
+					{BindAddr: "unix:/run/a.sock", Target: "127.0.0.1:1"},
+					{BindAddr: "unix:", Target: "unix:", Socket: &SocketOptions{Mode: "rw"}},
+				},
+				UDP: &[]IPRule{{BindAddr: "unix:/run/b.sock", Target: "unix:/run/c.sock"}},
+				Http: &[]Http{{BindAddr: "unix:/run/http.sock", Rules: []HostRule{
+					{Host: "example.com", Target: "unix:/run/app.sock"},
+				}}},
+			},
+			wantErr: []string{
+				`tcp[1].bindAddr: "unix:/run/a.sock" is already bound by tcp[0].bindAddr`,
+				"tcp[2].bindAddr: unix socket path must not be empty",
+				"tcp[2].target: unix socket path must not be empty",
+				`tcp[2].socket.mode: "rw" is not an octal file mode`,
+				"udp[0].bindAddr: unix sockets are not supported on udp rules",
+				"udp[0].target: unix sockets are not supported on udp rules",
+			},
+		},
+		{
+			name: "mux",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{{BindAddr: "0.0.0.0:443", Target: "127.0.0.1:1"}},
+				Mux: &[]Mux{
+					{
+						BindAddr:     "0.0.0.0:443",
+						SniffTimeout: -1,
+						TLS:          []HostRule{{Host: "example.com", Target: "127.0.0.1:8443"}},
+						HTTP:         []HostRule{{Host: "example.com", Target: "127.0.0.1:8080"}, {Host: "example.com", Target: "127.0.0.1:8081"}},
+						SSH:          &MuxRoute{Prefix: "SSH-", IPRule: IPRule{Target: "127.0.0.1:22"}},
+						Matchers: []MuxRoute{
+							{Prefix: "*1", IPRule: IPRule{Target: "127.0.0.1:6379"}},
+							{PrefixHex: "zz", IPRule: IPRule{Target: "127.0.0.1:1"}},
+							{IPRule: IPRule{BindAddr: "0.0.0.0:1", Target: "127.0.0.1:1", AcceptProxyProtocol: true}},
+						},
+						Fallback: &MuxRoute{IPRule: IPRule{Target: "127.0.0.1:1-2"}},
+					},
+					{BindAddr: "0.0.0.0:4443"},
+				},
+			},
+			wantErr: []string{
+				`mux[0].bindAddr: "0.0.0.0:443" is already bound by tcp[0].bindAddr`,
+				"mux[0].sniffTimeout: must not be negative",
+				`mux[0].http[1].host: "example.com" conflicts with mux[0].http[0]`,
+				"mux[0].ssh.prefix: only matchers have a prefix",
+				"mux[0].matchers[1].prefixHex: invalid hex",
+				"mux[0].matchers[2].bindAddr: routes listen on the bindAddr of the mux",
+				"mux[0].matchers[2].acceptProxyProtocol: set it on the mux",
+				"mux[0].matchers[2].prefix: no prefix configured",
+				`mux[0].fallback.target: port range "127.0.0.1:1-2" needs a bindAddr with as many ports`,
+				"mux[1]: no routes configured",
+			},
+		},
+		{
+			name: "tls termination",
+			cfg: YARPConfig{
+				Http: &[]Http{{BindAddr: ":80", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", Cert: "a.crt", Key: "a.key"},
+					{Host: "b.com", Target: "127.0.0.1:1", Forward: ForwardHTTP},
+				}}},
+				Https: &[]Http{{BindAddr: ":443", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", Cert: "/nonexistent/a.crt", Key: "/nonexistent/a.key", Forward: "udp"},
+					{Host: "b.com", Target: "127.0.0.1:1", Cert: "b.crt"},
+					{Host: "c.com", Target: "127.0.0.1:1", CertDir: "/nonexistent"},
+					{Host: "d.com", Target: "127.0.0.1:1", Key: "d.key"},
+				}}},
+			},
+			wantErr: []string{
+				"http[0].rules[0].cert: only rules of tls listeners terminate tls",
+				"http[0].rules[1].forward: needs a cert to terminate tls",
+				`https[0].rules[0].forward: unknown forward "udp", want tcp or http`,
+				"https[0].rules[0].cert: /nonexistent/a.crt: open /nonexistent/a.crt",
+				"https[0].rules[1].key: needs a key for cert",
+				"https[0].rules[2].certDir: open /nonexistent",
+				"https[0].rules[3].key: needs a cert",
+			},
+		},
+		{
+			name: "acme",
+			cfg: YARPConfig{
+				Https: &[]Http{{BindAddr: ":443", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", ACME: true},
+					{Host: "*.b.com", Target: "127.0.0.1:1", ACME: true},
+					{Host: "c.com", Target: "127.0.0.1:1", ACME: true, Cert: "c.crt", Key: "c.key"},
+					{Host: "127.0.0.1", Target: "127.0.0.1:1", ACME: true},
+				}}},
+				ACME: &ACME{
+					DirectoryURL: "localhost:14000/dir",
+					CACert:       "/nonexistent/ca.pem",
+					RenewBefore:  -time.Hour,
+					Challenges:   []string{"http-01", "dns-01"},
+				},
+			},
+			wantErr: []string{
+				"https[0].rules[1].acme: needs a dns host name",
+				"https[0].rules[2].acme: takes no cert, key or certDir",
+				"https[0].rules[3].acme: needs a dns host name",
+				`acme.directoryURL: "localhost:14000/dir" is not an http(s) url`,
+				"acme.caCert: open /nonexistent/ca.pem",
+				"acme.renewBefore: must not be negative",
+				`acme.challenges[1]: unknown challenge "dns-01"`,
+			},
+		},
+		{
+			name: "client auth",
+			cfg: YARPConfig{
+				Http: &[]Http{{BindAddr: ":80", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", ClientCA: "ca.pem"},
+				}}},
+				Https: &[]Http{{BindAddr: ":443", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", ClientAuth: ClientAuthRequire},
+					{Host: "b.com", Target: "127.0.0.1:1", ACME: true, ClientAuth: ClientAuthRequire},
+					{Host: "c.com", Target: "127.0.0.1:1", ACME: true, ClientCA: "/nonexistent/ca.pem", ClientAuth: "optional"},
+				}}},
+				ACME: &ACME{},
+			},
+			wantErr: []string{
+				"http[0].rules[0].clientCA: needs a cert to terminate tls",
+				"https[0].rules[0].clientCA: needs a cert to terminate tls",
+				"https[0].rules[1].clientAuth: needs a clientCA",
+				`https[0].rules[2].clientAuth: unknown clientAuth "optional", want require or verify-if-given`,
+				"https[0].rules[2].clientCA: open /nonexistent/ca.pem",
+			},
+		},
+		{
+			name: "upstream tls",
+			cfg: YARPConfig{
+				TCP: &[]IPRule{
+					{BindAddr: ":1000", Target: "unix:/run/db.sock", UpstreamTLS: &UpstreamTLS{Enable: true, CA: "/nonexistent/ca.pem", MinVersion: "1.4"}},
+					{BindAddr: ":1001", Target: "unix:/run/db.sock", UpstreamTLS: &UpstreamTLS{Enable: true, InsecureSkipVerify: true, Cert: "client.crt"}},
+					{BindAddr: ":1002", Target: "unix:/run/db.sock", UpstreamTLS: &UpstreamTLS{CA: "/nonexistent/ca.pem"}},
+				},
+				UDP: &[]IPRule{
+					{BindAddr: ":1003", Target: "127.0.0.1:1", UpstreamTLS: &UpstreamTLS{Enable: true}},
+				},
+				Https: &[]Http{{BindAddr: ":443", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", UpstreamTLS: &UpstreamTLS{Enable: true}},
+				}}},
+			},
+			wantErr: []string{
+				"tcp[0].upstreamTLS.ca: open /nonexistent/ca.pem",
+				`tcp[0].upstreamTLS.minVersion: unknown tls version "1.4"`,
+				"tcp[0].upstreamTLS.serverName: needed to verify unix socket targets",
+				"tcp[1].upstreamTLS.key: needs a key for cert",
+				"udp[0].upstreamTLS: not supported on udp rules",
+				"https[0].rules[0].upstreamTLS: passthrough rules forward the tls of the client",
+			},
+		},
+		{
+			name: "acme without client",
+			cfg: YARPConfig{
+				Https: &[]Http{{BindAddr: ":443", Rules: []HostRule{
+					{Host: "a.com", Target: "127.0.0.1:1", ACME: true},
+				}}},
+			},
+			wantErr: []string{"https[0].rules[0].acme: needs an acme section"},
+		},
+		{
+			name: "wildcard and conflicting hosts",
+			cfg: YARPConfig{
+				Http: &[]Http{{BindAddr: ":80", Rules: []HostRule{
+					{Host: "*", Target: "127.0.0.1:1"},
+					{Host: "*foo*.com", Target: "127.0.0.1:1"},
+					{Host: "Example.com", Target: "127.0.0.1:1"},
+					{Host: "example.com", Target: "127.0.0.1:2"},
+				}}},
+			},
+			wantErr: []string{
+				`http[0].rules[0].host: invalid wildcard "*"`,
+				`http[0].rules[1].host: invalid wildcard "*foo*.com"`,
+				`http[0].rules[3].host: "example.com" conflicts with http[0].rules[2]`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Expected errors %q, got none", tt.wantErr)
+			}
+
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.wantErr) {
+				t.Errorf("Expected %d errors, got %d: %v", len(tt.wantErr), len(lines), err)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error containing %q, got %v", want, err)
+				}
+			}
+		})
+	}
+}
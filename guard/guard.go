@@ -0,0 +1,256 @@
+// Package guard rate limits new connections per client ip and temporarily
+// bans clients that keep failing, fail2ban style.
+package guard
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+var (
+	ErrBanned      = errors.New("client is banned")
+	ErrRateLimited = errors.New("client opens connections too fast")
+)
+
+// Global is the guard of all listeners.
+var Global = New()
+
+// Ban is an entry of the ban list.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+type client struct {
+	tokens   float64
+	last     time.Time
+	failures []time.Time
+}
+
+type Guard struct {
+	mu     sync.Mutex
+	cfg    config.Guard
+	exempt []netip.Prefix
+
+	bans      map[netip.Addr]Ban
+	clients   map[netip.Addr]*client
+	lastPrune time.Time
+}
+
+// idle clients are forgotten after this long
+const clientTTL = 10 * time.Minute
+
+func New() *Guard {
+	return &Guard{
+		bans:    make(map[netip.Addr]Ban),
+		clients: make(map[netip.Addr]*client),
+	}
+}
+
+// Configure applies cfg, nil turns rate limiting and automatic bans off.
+// The ban list is kept, the failures and rates of the clients as well
+// unless cfg changed.
+func (g *Guard) Configure(cfg *config.Guard) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var next config.Guard
+	if cfg != nil {
+		next = cfg.WithDefaults()
+	}
+	if reflect.DeepEqual(g.cfg, next) {
+		return
+	}
+
+	g.cfg, g.exempt = next, nil
+	if cfg != nil {
+		for _, s := range cfg.Exempt {
+			// invalid entries are reported by config validation
+			if p, err := config.ParsePrefix(s); err == nil {
+				g.exempt = append(g.exempt, p)
+			}
+		}
+	}
+	g.clients = make(map[netip.Addr]*client)
+}
+
+// Check is called for every new connection, or udp session, from addr. It
+// returns ErrBanned or ErrRateLimited if the connection must be dropped.
+func (g *Guard) Check(addr net.Addr) error {
+	ip, ok := addrOf(addr)
+	if !ok {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+
+	if ban, ok := g.bans[ip]; ok {
+		if now.Before(ban.Until) {
+			return ErrBanned
+		}
+		delete(g.bans, ip)
+	}
+
+	if g.cfg.ConnRate <= 0 || g.isExempt(ip) {
+		return nil
+	}
+
+	c := g.client(ip, now)
+	c.tokens += now.Sub(c.last).Seconds() * g.cfg.ConnRate
+	if burst := float64(g.cfg.ConnBurst); c.tokens > burst {
+		c.tokens = burst
+	}
+	c.last = now
+	if c.tokens < 1 {
+		return ErrRateLimited
+	}
+	c.tokens--
+	return nil
+}
+
+// Failure records a failed handshake, unmatched host or denied connection of
+// addr, banning it once it failed MaxFailures times within FailureWindow.
+func (g *Guard) Failure(addr net.Addr, reason string) {
+	ip, ok := addrOf(addr)
+	if !ok {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cfg.MaxFailures <= 0 || g.isExempt(ip) {
+		return
+	}
+
+	now := time.Now()
+	c := g.client(ip, now)
+	recent := c.failures[:0]
+	for _, t := range c.failures {
+		if now.Sub(t) < g.cfg.FailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	c.failures = append(recent, now)
+
+	if len(c.failures) >= g.cfg.MaxFailures {
+		c.failures = nil
+		g.ban(ip, g.cfg.BanTime, reason)
+	}
+}
+
+// Ban bans ip for d. A zero d uses the configured ban time.
+func (g *Guard) Ban(ip netip.Addr, d time.Duration, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if d <= 0 {
+		d = g.cfg.WithDefaults().BanTime
+	}
+	g.ban(ip.Unmap(), d, reason)
+}
+
+func (g *Guard) ban(ip netip.Addr, d time.Duration, reason string) {
+	klog.Warningf("[guard] ban %s for %s: %s", ip, d, reason)
+	g.bans[ip] = Ban{IP: ip.String(), Until: time.Now().Add(d), Reason: reason}
+}
+
+// Unban lifts the ban of ip and reports whether there was one.
+func (g *Guard) Unban(ip netip.Addr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ip = ip.Unmap()
+	_, ok := g.bans[ip]
+	if ok {
+		klog.Infof("[guard] unban %s", ip)
+		delete(g.bans, ip)
+	}
+	return ok
+}
+
+// Bans returns the current ban list ordered by ip.
+func (g *Guard) Bans() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+func (g *Guard) client(ip netip.Addr, now time.Time) *client {
+	c, ok := g.clients[ip]
+	if !ok {
+		c = &client{tokens: float64(g.cfg.ConnBurst), last: now}
+		g.clients[ip] = c
+	}
+	return c
+}
+
+func (g *Guard) isExempt(ip netip.Addr) bool {
+	for _, p := range g.exempt {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops expired bans and idle clients once a minute.
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+
+	for ip, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, ip)
+		}
+	}
+	for ip, c := range g.clients {
+		idle := now.Sub(c.last) > clientTTL
+		if n := len(c.failures); n > 0 && now.Sub(c.failures[n-1]) <= clientTTL {
+			idle = false
+		}
+		if idle {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+func addrOf(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+
+	ipAddr, ok := netip.AddrFromSlice(ip)
+	return ipAddr.Unmap(), ok
+}
@@ -0,0 +1,118 @@
+package guard
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestGuard_ConnRate(t *testing.T) {
+	g := New()
+	g.Configure(&config.Guard{ConnRate: 1, ConnBurst: 3, Exempt: []string{"10.0.0.0/8"}})
+
+	for i := 0; i < 3; i++ {
+		if err := g.Check(addr("192.0.2.1")); err != nil {
+			t.Fatalf("Connection %d within burst: %v", i, err)
+		}
+	}
+	if err := g.Check(addr("192.0.2.1")); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited over burst, got %v", err)
+	}
+	if err := g.Check(addr("192.0.2.2")); err != nil {
+		t.Errorf("Expected another client to be unaffected, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := g.Check(addr("10.1.1.1")); err != nil {
+			t.Fatalf("Expected exempt client to pass, got %v", err)
+		}
+	}
+}
+
+func TestGuard_BanAfterFailures(t *testing.T) {
+	g := New()
+	g.Configure(&config.Guard{MaxFailures: 3, FailureWindow: time.Minute, BanTime: time.Hour})
+
+	client := addr("::ffff:192.0.2.1")
+	for i := 0; i < 2; i++ {
+		g.Failure(client, "not TLS handshake")
+	}
+	if err := g.Check(client); err != nil {
+		t.Fatalf("Expected client below maxFailures to pass, got %v", err)
+	}
+
+	g.Failure(client, "not TLS handshake")
+	if err := g.Check(client); !errors.Is(err, ErrBanned) {
+		t.Fatalf("Expected client to be banned, got %v", err)
+	}
+
+	bans := g.Bans()
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" || bans[0].Reason != "not TLS handshake" {
+		t.Errorf("Unexpected ban list %+v", bans)
+	}
+	if until := time.Until(bans[0].Until); until < 59*time.Minute {
+		t.Errorf("Expected a ban of about an hour, got %s", until)
+	}
+
+	if !g.Unban(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("Expected Unban to find the ban")
+	}
+	if err := g.Check(client); err != nil {
+		t.Errorf("Expected unbanned client to pass, got %v", err)
+	}
+}
+
+func TestGuard_ReconfigureKeepsFailures(t *testing.T) {
+	g := New()
+	cfg := config.Guard{MaxFailures: 2, FailureWindow: time.Minute, BanTime: time.Hour}
+	g.Configure(&cfg)
+
+	client := addr("192.0.2.1")
+	g.Failure(client, "not TLS handshake")
+	// a reload with the same settings keeps counting
+	same := cfg
+	g.Configure(&same)
+	g.Failure(client, "not TLS handshake")
+	if err := g.Check(client); !errors.Is(err, ErrBanned) {
+		t.Fatalf("Expected the failures before the reload to count, got %v", err)
+	}
+
+	other := addr("192.0.2.2")
+	g.Failure(other, "not TLS handshake")
+	g.Configure(&config.Guard{MaxFailures: 3, FailureWindow: time.Minute, BanTime: time.Hour})
+	g.Failure(other, "not TLS handshake")
+	g.Failure(other, "not TLS handshake")
+	if err := g.Check(other); err != nil {
+		t.Errorf("Expected changed settings to start counting anew, got %v", err)
+	}
+}
+
+func TestGuard_ManualBan(t *testing.T) {
+	g := New()
+	g.Ban(netip.MustParseAddr("2001:db8::1"), 50*time.Millisecond, "manual")
+
+	if err := g.Check(addr("2001:db8::1")); !errors.Is(err, ErrBanned) {
+		t.Fatalf("Expected manually banned client to be dropped, got %v", err)
+	}
+
+	// reloading keeps the ban list
+	g.Configure(nil)
+	if len(g.Bans()) != 1 {
+		t.Error("Expected the ban list to survive a reload")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := g.Check(addr("2001:db8::1")); err != nil {
+		t.Errorf("Expected the ban to expire, got %v", err)
+	}
+	if g.Unban(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("Expected no ban left to lift")
+	}
+}
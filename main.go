@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
-	"golang.org/x/sync/errgroup"
 	"k8s.io/klog/v2"
 
 	"github.com/knwgo/yarp/config"
@@ -13,8 +20,12 @@ import (
 )
 
 func main() {
-	var cfgFile string
+	var (
+		cfgFile string
+		check   bool
+	)
 	flag.StringVar(&cfgFile, "c", "./yarp.toml", "config file")
+	flag.BoolVar(&check, "check", false, "validate the config file and exit")
 	klog.InitFlags(nil)
 	_ = flag.Set("log_dir", "./")
 	_ = flag.Set("logtostderr", "false")
@@ -22,39 +33,106 @@ func main() {
 
 	defer klog.Flush()
 
-	viper.SetConfigFile(cfgFile)
-	if err := viper.ReadInConfig(); err != nil {
+	if check {
+		os.Exit(checkConfig(cfgFile))
+	}
+
+	YARPConfig, err := loadConfig(cfgFile)
+	if err != nil {
 		klog.Fatalf("couldn't load config: %s", err)
 	}
 
-	var YARPConfig config.YARPConfig
-	if err := viper.Unmarshal(&YARPConfig); err != nil {
+	var drainTimeout atomic.Int64
+	drainTimeout.Store(int64(drainTimeoutOf(YARPConfig)))
+
+	srv := protocol.NewServer()
+	if err := srv.Apply(YARPConfig); err != nil {
 		klog.Fatal(err)
 	}
 
-	eg := errgroup.Group{}
+	stat.StartDashboard(YARPConfig.Dashboard)
+
+	reload := func(reason string) {
+		cfg, err := loadConfig(cfgFile)
+		if err != nil {
+			klog.Errorf("[reload] %s: couldn't load config, keep running with the old one: %s", reason, err)
+			return
+		}
 
-	if YARPConfig.TCP != nil {
-		klog.Info("starting tcp proxy")
-		eg.Go(protocol.NewTcpProxy(*YARPConfig.TCP).Start)
+		klog.Infof("[reload] %s: applying %s", reason, cfgFile)
+		drainTimeout.Store(int64(drainTimeoutOf(cfg)))
+		if err := srv.Apply(cfg); err != nil {
+			klog.Errorf("[reload] %s: %v", reason, err)
+		}
 	}
 
-	if YARPConfig.UDP != nil {
-		klog.Info("starting udp proxy")
-		eg.Go(protocol.NewUdpProxy(*YARPConfig.UDP).Start)
+	viper.SetConfigFile(cfgFile)
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		reload("config file changed")
+	})
+	viper.WatchConfig()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigCh {
+		if sig == syscall.SIGHUP {
+			reload("SIGHUP received")
+			continue
+		}
+
+		klog.Infof("[shutdown] %s received, draining connections for up to %s", sig, time.Duration(drainTimeout.Load()))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout.Load()))
+		go func() {
+			// a second signal skips the rest of the drain
+			<-sigCh
+			cancel()
+		}()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			klog.Warningf("[shutdown] %v", err)
+		}
+		cancel()
+		klog.Info("[shutdown] done")
+		return
 	}
+}
 
-	if YARPConfig.Http != nil {
-		klog.Info("starting http proxy")
-		eg.Go(protocol.HTTPProxy{Cfg: *YARPConfig.Http}.Start)
+// loadConfig reads cfgFile with a fresh viper instance, so that reloads
+// triggered by the file watcher and by SIGHUP never share parser state.
+func loadConfig(cfgFile string) (config.YARPConfig, error) {
+	var cfg config.YARPConfig
+
+	v := viper.New()
+	v.SetConfigFile(cfgFile)
+	if err := v.ReadInConfig(); err != nil {
+		return cfg, err
 	}
 
-	if YARPConfig.Https != nil {
-		klog.Info("starting https proxy")
-		eg.Go(protocol.HTTPSProxy{Cfg: *YARPConfig.Https}.Start)
+	if err := v.Unmarshal(&cfg); err != nil {
+		return cfg, err
 	}
 
-	stat.StartDashboard(YARPConfig.Dashboard)
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	return cfg, nil
+}
 
-	klog.Error(eg.Wait())
+// checkConfig validates cfgFile for -check and returns the exit code.
+func checkConfig(cfgFile string) int {
+	if _, err := loadConfig(cfgFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cfgFile, err)
+		return 1
+	}
+
+	fmt.Printf("%s: config ok\n", cfgFile)
+	return 0
+}
+
+func drainTimeoutOf(cfg config.YARPConfig) time.Duration {
+	if cfg.DrainTimeout > 0 {
+		return cfg.DrainTimeout
+	}
+	return config.DefaultDrainTimeout
 }
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"net"
+	"net/netip"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/guard"
+	"github.com/knwgo/yarp/stat"
+)
+
+// acl is the allow/deny list of a rule or listener. Deny wins, and a non
+// empty allow list denies every client it does not match. A nil acl permits
+// everyone.
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newACL(allow, deny []string) *acl {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &acl{allow: parsePrefixes(allow), deny: parsePrefixes(deny)}
+}
+
+func (a *acl) permits(client net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	if containsAddr(a.deny, client) {
+		return false
+	}
+	return len(a.allow) == 0 || containsAddr(a.allow, client)
+}
+
+// deny counts and logs a connection from client refused by the acl of
+// ruleKey.
+func deny(ruleKey string, client net.Addr) {
+	stat.GlobalStats.AddDenied(ruleKey)
+	klog.Warningf("[acl] %s denied %s", ruleKey, client)
+	guard.Global.Failure(client, "denied by "+ruleKey)
+}
+
+// admit asks the guard whether a new connection from client may go on.
+func admit(proto string, client net.Addr) bool {
+	if err := guard.Global.Check(client); err != nil {
+		klog.V(2).Infof("[%s] drop %s: %v", proto, client, err)
+		return false
+	}
+	return true
+}
+
+// parsePrefixes parses a list of ips and cidrs, invalid entries are reported
+// by config validation.
+func parsePrefixes(list []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if p, err := config.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// containsAddr reports whether the ip of addr is in one of prefixes.
+func containsAddr(prefixes []netip.Prefix, addr net.Addr) bool {
+	ip, _, ok := addrIPPort(addr)
+	if !ok {
+		return false
+	}
+	ipAddr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	ipAddr = ipAddr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+func TestACL_Permits(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{name: "no lists", ip: "1.2.3.4", want: true},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, ip: "10.1.1.1", want: true},
+		{name: "not allowed", allow: []string{"10.0.0.0/8"}, ip: "11.1.1.1", want: false},
+		{name: "denied", deny: []string{"10.0.0.0/8"}, ip: "10.1.1.1", want: false},
+		{name: "not denied", deny: []string{"10.0.0.0/8"}, ip: "11.1.1.1", want: true},
+		{name: "deny wins", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.1.1"}, ip: "10.1.1.1", want: false},
+		{name: "mapped v4", allow: []string{"10.0.0.0/8"}, ip: "::ffff:10.1.1.1", want: true},
+		{name: "v6", allow: []string{"2001:db8::/32"}, ip: "2001:db8::1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newACL(tt.allow, tt.deny)
+			if got := a.permits(&net.TCPAddr{IP: net.ParseIP(tt.ip)}); got != tt.want {
+				t.Errorf("permits(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTargetUrl_Denied(t *testing.T) {
+	routes := newHostRoutes("test", []config.HostRule{
+		{Host: "a.com", Target: "127.0.0.1:1", Allow: []string{"10.0.0.0/8"}},
+	}, nil, nil)
+
+	info, err := getTargetUrl("a.com", routes, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("getTargetUrl() error = %v", err)
+	}
+	if !info.denied || info.upstream != nil {
+		t.Errorf("Expected a denied target without upstream, got %+v", info)
+	}
+
+	info, err = getTargetUrl("a.com", routes, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")})
+	if err != nil {
+		t.Fatalf("getTargetUrl() error = %v", err)
+	}
+	if info.denied || info.upstream == nil {
+		t.Errorf("Expected an allowed target with upstream, got %+v", info)
+	}
+	info.upstream.release()
+}
+
+func TestTcpProxy_Deny(t *testing.T) {
+	targetAddr := startTaggedServer(t, "")
+	proxyAddr := freeTCPAddr(t)
+
+	rule := config.IPRule{
+		BindAddr: proxyAddr,
+		Target:   targetAddr,
+		Deny:     []string{"127.0.0.0/8"},
+	}
+	proxy := NewTcpProxy([]config.IPRule{rule})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	ruleKey := "tcp:" + proxyAddr + "->" + targetAddr
+	before := stat.GlobalStats.Snapshot().RuleStats[ruleKey].Denied
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected denied connection to be closed, read %d bytes", n)
+	}
+
+	if got := stat.GlobalStats.Snapshot().RuleStats[ruleKey].Denied - before; got != 1 {
+		t.Errorf("Expected 1 denied connection in stats, got %d", got)
+	}
+}
+
+func TestUdpProxy_DenyCountsClients(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	defer target.Close()
+
+	rule := config.IPRule{BindAddr: "127.0.0.1:0", Target: target.LocalAddr().String(), Deny: []string{"127.0.0.0/8"}}
+	proxy := NewUdpProxy([]config.IPRule{rule})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	ruleKey := "udp:" + rule.BindAddr + "->" + rule.Target
+	before := stat.GlobalStats.Snapshot().RuleStats[ruleKey].Denied
+
+	client, err := net.Dial("udp", proxy.listeners[rule.BindAddr].pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	for i := 0; i < 5; i++ {
+		client.Write([]byte("hello"))
+	}
+
+	target.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := target.ReadFrom(make([]byte, 16)); err == nil {
+		t.Errorf("Expected no datagram of a denied client to be forwarded, got %d bytes", n)
+	}
+	if got := stat.GlobalStats.Snapshot().RuleStats[ruleKey].Denied - before; got != 1 {
+		t.Errorf("Expected the denied client to be counted once, got %d", got)
+	}
+}
@@ -0,0 +1,347 @@
+package protocol
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// upstream is one target of a rule. It outlives config reloads as long as the
+// rule keeps the same target address, so its counters stay meaningful.
+type upstream struct {
+	addr string
+
+	// active counts the connections currently piped to this upstream.
+	active atomic.Int64
+	// down is set by the health checker, zero means healthy.
+	down    atomic.Bool
+	breaker breaker
+}
+
+// available reports whether u may be picked for a new connection.
+func (u *upstream) available() bool {
+	return !u.down.Load() && u.breaker.allow()
+}
+
+// acquire takes u for a new connection. It fails if u lost its half-open
+// trial to another connection since it was found available.
+func (u *upstream) acquire() (*lease, bool) {
+	trial, ok := u.breaker.acquire()
+	if !ok {
+		return nil, false
+	}
+	u.active.Add(1)
+	return &lease{upstream: u, trial: trial}, true
+}
+
+// lease is an upstream acquired for one connection.
+type lease struct {
+	*upstream
+	// trial is the token of the half-open trial the connection is, zero if
+	// it is not one
+	trial uint64
+}
+
+func (l *lease) release() {
+	l.active.Add(-1)
+	l.breaker.released(l.trial)
+}
+
+// reportFailure tells the outlier detection that the connection of l failed
+// to dial or got reset before the upstream answered.
+func (l *lease) reportFailure(err error) {
+	l.breaker.failure(l.addr, l.trial, err)
+}
+
+// reportSuccess tells the outlier detection that the upstream answered the
+// connection of l.
+func (l *lease) reportSuccess() {
+	l.breaker.success(l.addr, l.trial)
+}
+
+// balancer picks the upstream of a new connection according to the strategy
+// of its rule.
+type balancer struct {
+	// key names the rule in the target stats
+	key       string
+	strategy  string
+	upstreams []*upstream
+	weights   []int
+
+	rr atomic.Uint64
+
+	// smooth weighted round-robin state, see nginx's ngx_http_upstream_get_peer
+	mu      sync.Mutex
+	current []int
+
+	ring hashRing
+
+	stopHealthCheck chan struct{}
+}
+
+// newBalancer builds the balancer of the rule named key. Upstreams of prev
+// with the same address are reused, so reloading a rule keeps their state.
+func newBalancer(key, strategy string, targets []config.Target, prev *balancer) *balancer {
+	if strategy == "" {
+		strategy = config.StrategyRoundRobin
+	}
+
+	known := make(map[string]*upstream)
+	if prev != nil {
+		for _, u := range prev.upstreams {
+			known[u.addr] = u
+		}
+	}
+
+	b := &balancer{key: key, strategy: strategy}
+	for _, t := range targets {
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		u, ok := known[t.Addr]
+		if !ok {
+			u = &upstream{addr: t.Addr}
+		}
+		b.upstreams = append(b.upstreams, u)
+		b.weights = append(b.weights, weight)
+	}
+
+	b.current = make([]int, len(b.upstreams))
+	if strategy == config.StrategyIPHash || strategy == config.StrategyHostHash {
+		b.ring = newHashRing(b.upstreams, b.weights)
+	}
+
+	return b
+}
+
+// start activates the health checks and the outlier detection of b. Probes
+// are dialed with sock like the connections of the rule.
+func (b *balancer) start(hc *config.HealthCheck, outlier *config.Outlier, network string, sock *sockOptions) {
+	for _, u := range b.upstreams {
+		u.breaker.setConfig(b.key, u.addr, outlier)
+	}
+	b.startHealthChecks(hc, network, sock)
+}
+
+// targetKey names an upstream of a rule in the target stats.
+type targetKey struct {
+	rule, addr string
+}
+
+// stop deactivates b after it got replaced on reload. Upstreams that are not
+// in keep are forgotten by the stats.
+func (b *balancer) stop(keep map[targetKey]bool) {
+	b.stopHealthChecks()
+	for _, u := range b.upstreams {
+		if !keep[targetKey{b.key, u.addr}] {
+			stat.GlobalStats.RemoveTarget(b.key, u.addr)
+		}
+	}
+}
+
+func (b *balancer) targets() map[targetKey]bool {
+	targets := make(map[targetKey]bool, len(b.upstreams))
+	for _, u := range b.upstreams {
+		targets[targetKey{b.key, u.addr}] = true
+	}
+	return targets
+}
+
+// pick returns the upstream for a new connection from client to host,
+// acquired. The caller must release it once the connection is done.
+// It returns nil if no upstream is available.
+func (b *balancer) pick(client net.Addr, host string) *lease {
+	return b.pickExcept(client, host, nil)
+}
+
+// pickExcept is pick without the upstreams in skip, used to retry a
+// connection on another target.
+func (b *balancer) pickExcept(client net.Addr, host string, skip map[*upstream]bool) *lease {
+	for {
+		u := b.choose(client, host, skip)
+		if u == nil {
+			return nil
+		}
+		if l, ok := u.acquire(); ok {
+			return l
+		}
+
+		// another connection took the trial of u, choose again without it
+		lost := make(map[*upstream]bool, len(skip)+1)
+		for s := range skip {
+			lost[s] = true
+		}
+		lost[u] = true
+		skip = lost
+	}
+}
+
+// choose returns the available upstream for a connection from client to host
+// according to the strategy of b, skipping those in skip.
+func (b *balancer) choose(client net.Addr, host string, skip map[*upstream]bool) *upstream {
+	var u *upstream
+	switch b.strategy {
+	case config.StrategyWeighted:
+		u = b.pickWeighted(skip)
+	case config.StrategyLeastConn:
+		u = b.pickLeastConn(skip)
+	case config.StrategyRandom:
+		u = b.pickRandom(skip)
+	case config.StrategyIPHash:
+		u = b.ring.get(clientIP(client), skip)
+	case config.StrategyHostHash:
+		u = b.ring.get(host, skip)
+	default:
+		u = b.pickRoundRobin(skip)
+	}
+	return u
+}
+
+func (b *balancer) pickRoundRobin(skip map[*upstream]bool) *upstream {
+	n := uint64(len(b.upstreams))
+	start := b.rr.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		if u := b.upstreams[(start+i)%n]; u.available() && !skip[u] {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *balancer) pickWeighted(skip map[*upstream]bool) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total, best := 0, -1
+	for i, weight := range b.weights {
+		if !b.upstreams[i].available() || skip[b.upstreams[i]] {
+			continue
+		}
+		b.current[i] += weight
+		total += weight
+		if best == -1 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	b.current[best] -= total
+
+	return b.upstreams[best]
+}
+
+func (b *balancer) pickRandom(skip map[*upstream]bool) *upstream {
+	total := 0
+	for i, weight := range b.weights {
+		if b.upstreams[i].available() && !skip[b.upstreams[i]] {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.IntN(total)
+	for i, weight := range b.weights {
+		if !b.upstreams[i].available() || skip[b.upstreams[i]] {
+			continue
+		}
+		if n < weight {
+			return b.upstreams[i]
+		}
+		n -= weight
+	}
+	return nil
+}
+
+func (b *balancer) pickLeastConn(skip map[*upstream]bool) *upstream {
+	best := -1
+	var bestActive int64
+	for i, u := range b.upstreams {
+		if !u.available() || skip[u] {
+			continue
+		}
+		active := u.active.Load()
+		// compare active/weight without dividing
+		if best == -1 || active*int64(b.weights[best]) < bestActive*int64(b.weights[i]) {
+			best, bestActive = i, active
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	return b.upstreams[best]
+}
+
+// hashRing is a consistent hash ring, so that adding or removing a target
+// only remaps the keys that belonged to it.
+type hashRing struct {
+	hashes    []uint32
+	upstreams map[uint32]*upstream
+}
+
+// virtual nodes per unit of weight
+const hashRingReplicas = 64
+
+func newHashRing(upstreams []*upstream, weights []int) hashRing {
+	r := hashRing{upstreams: make(map[uint32]*upstream)}
+	for n, u := range upstreams {
+		for i := 0; i < hashRingReplicas*weights[n]; i++ {
+			h := hashKey(u.addr + "#" + strconv.Itoa(i))
+			if _, ok := r.upstreams[h]; ok {
+				continue
+			}
+			r.upstreams[h] = u
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns the first available upstream clockwise from key that is not in
+// skip.
+func (r hashRing) get(key string, skip map[*upstream]bool) *upstream {
+	h := hashKey(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; i < len(r.hashes); i++ {
+		if u := r.upstreams[r.hashes[(start+i)%len(r.hashes)]]; u.available() && !skip[u] {
+			return u
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// clientIP returns the ip part of addr, or its string form if it has none.
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
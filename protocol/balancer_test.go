@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+func testTargets(weights ...int) []config.Target {
+	targets := make([]config.Target, 0, len(weights))
+	for i, w := range weights {
+		targets = append(targets, config.Target{Addr: fmt.Sprintf("10.0.0.%d:80", i+1), Weight: w})
+	}
+	return targets
+}
+
+// pickCounts picks n times, releasing every pick, and counts the picks per addr
+func pickCounts(b *balancer, n int, client func(i int) net.Addr) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		u := b.pick(client(i), "")
+		counts[u.addr]++
+		u.release()
+	}
+	return counts
+}
+
+func sameClient(int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := newBalancer("test", "", testTargets(5, 1, 1), nil)
+	counts := pickCounts(b, 30, sameClient)
+	for addr, n := range counts {
+		if n != 10 {
+			t.Errorf("Expected 10 picks for %s, got %d", addr, n)
+		}
+	}
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	b := newBalancer("test", config.StrategyWeighted, testTargets(5, 1, 0), nil)
+
+	counts := pickCounts(b, 70, sameClient)
+	want := map[string]int{"10.0.0.1:80": 50, "10.0.0.2:80": 10, "10.0.0.3:80": 10}
+	for addr, n := range want {
+		if counts[addr] != n {
+			t.Errorf("Expected %d picks for %s, got %d", n, addr, counts[addr])
+		}
+	}
+
+	// smooth weighted round-robin interleaves the light targets instead of
+	// picking the heavy one 5 times in a row
+	seq := ""
+	for i := 0; i < 7; i++ {
+		u := b.pick(nil, "")
+		seq += u.addr[7:8]
+		u.release()
+	}
+	if seq != "1121311" {
+		t.Errorf("Expected weighted sequence 1121311, got %s", seq)
+	}
+}
+
+func TestBalancer_LeastConn(t *testing.T) {
+	b := newBalancer("test", config.StrategyLeastConn, testTargets(1, 1, 1), nil)
+
+	first := b.pick(nil, "")
+	second := b.pick(nil, "")
+	third := b.pick(nil, "")
+	if first.upstream == second.upstream || second.upstream == third.upstream || first.upstream == third.upstream {
+		t.Fatalf("Expected three distinct upstreams, got %s %s %s", first.addr, second.addr, third.addr)
+	}
+
+	second.release()
+	if u := b.pick(nil, ""); u.upstream != second.upstream {
+		t.Errorf("Expected the released upstream %s, got %s", second.addr, u.addr)
+	}
+}
+
+func TestBalancer_IPHash(t *testing.T) {
+	b := newBalancer("test", config.StrategyIPHash, testTargets(1, 1, 1), nil)
+
+	clients := func(i int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i%50)), Port: 1000 + i}
+	}
+
+	picked := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		c := clients(i)
+		u := b.pick(c, "")
+		ip := clientIP(c)
+		if prev, ok := picked[ip]; ok && prev != u.addr {
+			t.Fatalf("Client %s moved from %s to %s", ip, prev, u.addr)
+		}
+		picked[ip] = u.addr
+		u.release()
+	}
+
+	// removing one target only remaps the clients that were on it
+	removed := "10.0.0.3:80"
+	smaller := newBalancer("test", config.StrategyIPHash, testTargets(1, 1), b)
+	for ip, addr := range picked {
+		u := smaller.pick(&net.TCPAddr{IP: net.ParseIP(ip)}, "")
+		if addr != removed && u.addr != addr {
+			t.Errorf("Client %s should stay on %s, got %s", ip, addr, u.addr)
+		}
+		u.release()
+	}
+}
+
+func TestBalancer_HostHash(t *testing.T) {
+	b := newBalancer("test", config.StrategyHostHash, testTargets(1, 1, 1), nil)
+	u1 := b.pick(sameClient(0), "a.example.com")
+	u2 := b.pick(&net.TCPAddr{IP: net.ParseIP("198.51.100.7")}, "a.example.com")
+	if u1.upstream != u2.upstream {
+		t.Errorf("Expected the same upstream for the same host, got %s and %s", u1.addr, u2.addr)
+	}
+}
+
+func TestBalancer_ReusesUpstreams(t *testing.T) {
+	prev := newBalancer("test", config.StrategyLeastConn, testTargets(1, 1), nil)
+	u := prev.pick(nil, "")
+
+	next := newBalancer("test", config.StrategyLeastConn, testTargets(1, 1, 1), prev)
+	for _, nu := range next.upstreams {
+		if nu.addr == u.addr && nu != u.upstream {
+			t.Fatalf("Expected upstream %s to be reused across reloads", u.addr)
+		}
+	}
+	if got := next.pick(nil, ""); got.upstream == u.upstream {
+		t.Errorf("least-conn should avoid the upstream that is still busy")
+	}
+}
+
+func TestBalancer_TargetStatsPerRule(t *testing.T) {
+	outlier := &config.Outlier{ConsecutiveFailures: 1}
+	a := newBalancer("test:a", "", testTargets(1), nil)
+	b := newBalancer("test:b", "", testTargets(1), nil)
+	a.start(nil, outlier, "tcp", nil)
+	b.start(nil, nil, "tcp", nil)
+	defer a.stop(nil)
+
+	addr := a.upstreams[0].addr
+	for _, bal := range []*balancer{b, a} {
+		l, _ := bal.upstreams[0].acquire()
+		l.reportFailure(errors.New("connection refused"))
+		l.release()
+	}
+	b.stop(nil)
+
+	targets := stat.GlobalStats.Snapshot().Targets
+	if state := targets["test:a"][addr]; state.Circuit != stat.CircuitOpen {
+		t.Errorf("Expected the circuit of rule a to be open, got %+v", state)
+	}
+	if state, ok := targets["test:b"][addr]; ok {
+		t.Errorf("Expected rule b to be forgotten, got %+v", state)
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// breaker is the circuit breaker of an upstream, fed by the outcome of real
+// connections. It is closed while ejectedUntil is zero, open until
+// ejectedUntil and half-open afterwards, when a single trial connection is
+// let through to decide whether to close it again.
+type breaker struct {
+	mu  sync.Mutex
+	cfg *config.Outlier
+	// rule is the key of the rule the circuit is reported under
+	rule string
+
+	failures     int
+	ejections    uint64
+	backoff      int
+	ejectedUntil time.Time
+	// trial is the token of the trial connection in flight, zero if none,
+	// and trials the last token handed out
+	trial  uint64
+	trials uint64
+}
+
+// setConfig switches outlier detection of the upstream at addr of rule on or
+// off, keeping the current ejection if it stays on.
+func (b *breaker) setConfig(rule, addr string, o *config.Outlier) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rule = rule
+	if o == nil {
+		b.cfg = nil
+		b.failures, b.backoff, b.ejectedUntil, b.trial = 0, 0, time.Time{}, 0
+		stat.GlobalStats.SetTargetCircuit(b.rule, addr, "", b.ejections, time.Time{})
+		return
+	}
+
+	cfg := o.WithDefaults()
+	b.cfg = &cfg
+	if b.ejectedUntil.IsZero() {
+		stat.GlobalStats.SetTargetCircuit(b.rule, addr, stat.CircuitClosed, b.ejections, time.Time{})
+	} else {
+		stat.GlobalStats.SetTargetCircuit(b.rule, addr, stat.CircuitOpen, b.ejections, b.ejectedUntil)
+	}
+}
+
+// allow reports whether a new connection may use the upstream.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ejectedUntil.IsZero() {
+		return true
+	}
+	return !time.Now().Before(b.ejectedUntil) && b.trial == 0
+}
+
+// acquire lets a new connection use the upstream if allow does. If the
+// circuit is half-open the connection becomes its trial, identified by the
+// returned token.
+func (b *breaker) acquire() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ejectedUntil.IsZero() {
+		return 0, true
+	}
+	if time.Now().Before(b.ejectedUntil) || b.trial != 0 {
+		return 0, false
+	}
+	b.trials++
+	b.trial = b.trials
+	return b.trial, true
+}
+
+// released lets another trial through if the trial connection with token
+// ended without a verdict.
+func (b *breaker) released(token uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if token != 0 && b.trial == token {
+		b.trial = 0
+	}
+}
+
+// verdict reports whether the connection with token decides the circuit.
+// While the upstream is ejected only its trial does, once the ejection is
+// over, so that connections opened before the ejection neither eject it
+// again nor close the circuit early.
+func (b *breaker) verdict(token uint64) bool {
+	if b.ejectedUntil.IsZero() {
+		return true
+	}
+	return token != 0 && token == b.trial && !time.Now().Before(b.ejectedUntil)
+}
+
+// failure records a failed connection with token, the trial token of its
+// lease.
+func (b *breaker) failure(addr string, token uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cfg == nil || !b.verdict(token) {
+		return
+	}
+
+	halfOpen := !b.ejectedUntil.IsZero()
+	b.failures++
+	if !halfOpen && b.failures < b.cfg.ConsecutiveFailures {
+		return
+	}
+
+	ejection := b.cfg.BaseEjectionTime << b.backoff
+	if ejection > b.cfg.MaxEjectionTime || ejection <= 0 {
+		ejection = b.cfg.MaxEjectionTime
+	} else {
+		b.backoff++
+	}
+
+	b.failures = 0
+	b.trial = 0
+	b.ejections++
+	b.ejectedUntil = time.Now().Add(ejection)
+	klog.Warningf("[outlier] eject %s for %s: %v", addr, ejection, err)
+	stat.GlobalStats.SetTargetCircuit(b.rule, addr, stat.CircuitOpen, b.ejections, b.ejectedUntil)
+}
+
+// success records a connection with token that the upstream answered.
+func (b *breaker) success(addr string, token uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.verdict(token) {
+		return
+	}
+	b.failures = 0
+	if b.cfg == nil || b.ejectedUntil.IsZero() {
+		return
+	}
+
+	b.backoff = 0
+	b.trial = 0
+	b.ejectedUntil = time.Time{}
+	klog.Infof("[outlier] %s is back", addr)
+	stat.GlobalStats.SetTargetCircuit(b.rule, addr, stat.CircuitClosed, b.ejections, time.Time{})
+}
+
+// isReset reports whether err means the peer reset the connection.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
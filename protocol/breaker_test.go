@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+func TestBreaker_EjectAndRecover(t *testing.T) {
+	u := &upstream{addr: "192.0.2.10:80"}
+	u.breaker.setConfig("test", u.addr, &config.Outlier{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+	})
+	defer stat.GlobalStats.RemoveTarget("test", u.addr)
+
+	errDial := errors.New("connection refused")
+	fail := func() {
+		l, _ := u.acquire()
+		l.reportFailure(errDial)
+		l.release()
+	}
+	fail()
+	if !u.available() {
+		t.Fatal("One failure should not eject the upstream")
+	}
+	fail()
+	if u.available() {
+		t.Fatal("Expected upstream to be ejected after two failures")
+	}
+
+	state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]
+	if state.Circuit != stat.CircuitOpen || state.Ejections != 1 {
+		t.Errorf("Expected open circuit with 1 ejection, got %+v", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !u.available() {
+		t.Fatal("Expected a trial to be allowed once the ejection is over")
+	}
+	if state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]; state.Circuit != stat.CircuitHalfOpen {
+		t.Errorf("Expected half-open circuit, got %q", state.Circuit)
+	}
+
+	trial, ok := u.acquire()
+	if !ok {
+		t.Fatal("Expected to acquire the trial")
+	}
+	if _, ok := u.acquire(); ok || u.available() {
+		t.Error("Only one trial connection should be let through")
+	}
+
+	// the failed trial ejects again for twice as long
+	trial.reportFailure(errDial)
+	trial.release()
+	time.Sleep(60 * time.Millisecond)
+	if u.available() {
+		t.Error("Expected the second ejection to last 100ms")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !u.available() {
+		t.Fatal("Expected a trial after the second ejection")
+	}
+
+	trial, _ = u.acquire()
+	trial.reportSuccess()
+	trial.release()
+	if state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]; state.Circuit != stat.CircuitClosed || state.Ejections != 2 {
+		t.Errorf("Expected closed circuit with 2 ejections, got %+v", state)
+	}
+
+	// back to needing two failures in a row
+	fail()
+	if !u.available() {
+		t.Error("Expected the failure count to restart after recovering")
+	}
+}
+
+// TestTcpProxy_OutlierFailFast tests that a dead target gets ejected so new
+// connections only go to the live one
+func TestTcpProxy_OutlierFailFast(t *testing.T) {
+	liveAddr := startTaggedServer(t, "live:")
+	deadAddr := freeTCPAddr(t)
+	proxyAddr := freeTCPAddr(t)
+
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr: proxyAddr,
+		Targets:  []config.Target{{Addr: deadAddr}, {Addr: liveAddr}},
+		Outlier:  &config.Outlier{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	// round-robin hits the dead target once, which ejects it
+	failed := 0
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 16)
+		if _, err := conn.Read(buf); err != nil {
+			failed++
+		}
+		conn.Close()
+	}
+
+	if failed != 1 {
+		t.Errorf("Expected exactly one connection to hit the dead target, got %d", failed)
+	}
+}
+
+func TestBreaker_StaleReleaseKeepsTrial(t *testing.T) {
+	u := &upstream{addr: "192.0.2.11:80"}
+	u.breaker.setConfig("test", u.addr, &config.Outlier{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    20 * time.Millisecond,
+		MaxEjectionTime:     20 * time.Millisecond,
+	})
+	defer stat.GlobalStats.RemoveTarget("test", u.addr)
+
+	// a connection from before the ejection ends after the trial started
+	old, _ := u.acquire()
+	old.reportFailure(errors.New("connection refused"))
+	time.Sleep(30 * time.Millisecond)
+
+	var trials atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := u.acquire(); ok {
+				trials.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := trials.Load(); n != 1 {
+		t.Fatalf("Expected exactly one trial connection, got %d", n)
+	}
+
+	old.release()
+	if u.available() {
+		t.Error("Releasing a connection that is not the trial should not let another trial through")
+	}
+}
+
+func TestBreaker_ConcurrentFailuresEjectOnce(t *testing.T) {
+	u := &upstream{addr: "192.0.2.12:80"}
+	u.breaker.setConfig("test", u.addr, &config.Outlier{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+	})
+	defer stat.GlobalStats.RemoveTarget("test", u.addr)
+
+	// connections opened while the circuit was closed all fail at once
+	leases := make([]*lease, 8)
+	for i := range leases {
+		leases[i], _ = u.acquire()
+	}
+	var wg sync.WaitGroup
+	for _, l := range leases {
+		wg.Add(1)
+		go func(l *lease) {
+			defer wg.Done()
+			l.reportFailure(errors.New("connection reset by peer"))
+			l.release()
+		}(l)
+	}
+	wg.Wait()
+
+	if state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]; state.Ejections != 1 {
+		t.Errorf("Expected 1 ejection, got %+v", state)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !u.available() {
+		t.Error("Expected the ejection to last the base ejection time only")
+	}
+}
+
+func TestBreaker_StaleSuccessKeepsCircuitOpen(t *testing.T) {
+	u := &upstream{addr: "192.0.2.13:80"}
+	u.breaker.setConfig("test", u.addr, &config.Outlier{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+	})
+	defer stat.GlobalStats.RemoveTarget("test", u.addr)
+
+	old, _ := u.acquire()
+	failed, _ := u.acquire()
+	failed.reportFailure(errors.New("connection refused"))
+	failed.release()
+
+	// a connection from before the ejection answers while it lasts
+	old.reportSuccess()
+	old.release()
+	if u.available() {
+		t.Error("A stale success should not end the ejection")
+	}
+	if state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]; state.Circuit != stat.CircuitOpen {
+		t.Errorf("Expected open circuit, got %q", state.Circuit)
+	}
+
+	// nor close the circuit before the trial answers
+	time.Sleep(60 * time.Millisecond)
+	trial, ok := u.acquire()
+	if !ok {
+		t.Fatal("Expected to acquire the trial")
+	}
+	defer trial.release()
+	if state := stat.GlobalStats.Snapshot().Targets["test"][u.addr]; state.Circuit != stat.CircuitHalfOpen {
+		t.Errorf("Expected half-open circuit, got %q", state.Circuit)
+	}
+}
@@ -2,20 +2,36 @@ package protocol
 
 import (
 	"bufio"
-	"bytes"
-	"io"
 	"net"
 )
 
 type bufConn struct {
 	net.Conn
-	r *bufio.Reader
+	r   *bufio.Reader
+	src *unreadSource
+}
+
+// unreadSource feeds the reader of a bufConn, unread bytes first.
+type unreadSource struct {
+	pending []byte
+	conn    net.Conn
+}
+
+func (s *unreadSource) Read(p []byte) (int, error) {
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	return s.conn.Read(p)
 }
 
 func newBufConn(c net.Conn, size int) *bufConn {
+	src := &unreadSource{conn: c}
 	return &bufConn{
 		Conn: c,
-		r:    bufio.NewReaderSize(c, size),
+		r:    bufio.NewReaderSize(src, size),
+		src:  src,
 	}
 }
 
@@ -23,6 +39,11 @@ func (b *bufConn) Read(p []byte) (int, error) {
 	return b.r.Read(p)
 }
 
+// CloseWrite half closes the underlying connection, see closeWrite.
+func (b *bufConn) CloseWrite() error {
+	return closeWrite(b.Conn)
+}
+
 func (b *bufConn) Reader() *bufio.Reader {
 	return b.r
 }
@@ -32,10 +53,19 @@ func (b *bufConn) Unread(p []byte) {
 		return
 	}
 
-	if remaining := b.r.Buffered(); remaining > 0 {
-		buf, _ := b.r.Peek(remaining)
-		b.r.Reset(io.MultiReader(bytes.NewReader(p), bytes.NewReader(buf), b.Conn))
-	} else {
-		b.r.Reset(io.MultiReader(bytes.NewReader(p), b.Conn))
-	}
+	buf, _ := b.r.Peek(b.r.Buffered())
+	pending := make([]byte, 0, len(p)+len(buf)+len(b.src.pending))
+	pending = append(append(append(pending, p...), buf...), b.src.pending...)
+	b.src.pending = pending
+	b.r.Reset(b.src)
+}
+
+// drain returns the bytes read off the connection but not consumed yet,
+// after which the underlying connection may be read directly.
+func (b *bufConn) drain() []byte {
+	buf, _ := b.r.Peek(b.r.Buffered())
+	pending := append(append([]byte(nil), buf...), b.src.pending...)
+	_, _ = b.r.Discard(len(buf))
+	b.src.pending = nil
+	return pending
 }
@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/acme"
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// tlsHandshakeTimeout bounds the handshake of a terminated tls connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// certReloadDelay lets a burst of file events, like a certificate and its
+// key being replaced one after the other, settle before reloading.
+const certReloadDelay = 200 * time.Millisecond
+
+// certificates are the key pairs an https rule terminates tls with. Once
+// started they follow changes of their files.
+type certificates struct {
+	// key names the rule in the certificate stats
+	key   string
+	rule  config.HostRule
+	certs atomic.Pointer[[]*loadedCert]
+	// clientCAs verify client certificates if the rule has a clientCA, no
+	// client gets in if they failed to load
+	clientCAs *x509.CertPool
+
+	mu sync.Mutex
+	// dirs are the directories watched for changes, nil unless started
+	dirs  []string
+	timer *time.Timer
+}
+
+// loadedCert is the certificate of one pair of files. err is why the files
+// failed to load last time, cert then being the one loaded before, if any.
+type loadedCert struct {
+	pair config.CertPair
+	cert *tls.Certificate
+	err  error
+}
+
+// loadCertificates loads the certificates of rule, named key in the stats,
+// nil if it passes tls through. A rule whose certificates fail to load still
+// terminates, with no certificate to offer, rather than passing its
+// connections through.
+func loadCertificates(key string, rule config.HostRule) (*certificates, error) {
+	if !rule.Terminates() {
+		return nil, nil
+	}
+
+	c := &certificates{key: key, rule: rule}
+	c.certs.Store(&[]*loadedCert{})
+
+	var errs []error
+	if rule.ClientCA != "" {
+		pool, err := loadCertPool(rule.ClientCA)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("clientCA: %w", err))
+		}
+		c.clientCAs = pool
+	}
+	// certificates of acme rules are obtained by acme.Global, which
+	// publishes them as well
+	if !rule.ACME {
+		errs = append(errs, c.reload())
+	}
+	return c, errors.Join(errs...)
+}
+
+// reload loads the files of c again. A pair that fails to load keeps its
+// previous certificate, the others are swapped in at once.
+func (c *certificates) reload() error {
+	files, err := c.rule.CertPairs()
+	if err != nil {
+		return err
+	}
+
+	prev := make(map[config.CertPair]*loadedCert)
+	for _, lc := range *c.certs.Load() {
+		prev[lc.pair] = lc
+	}
+
+	var errs []error
+	next := make([]*loadedCert, 0, len(files))
+	for _, f := range files {
+		cert, err := loadKeyPair(f)
+		old := prev[f]
+		if err != nil {
+			errs = append(errs, err)
+			lc := &loadedCert{pair: f, err: err}
+			if old != nil {
+				lc.cert = old.cert
+			}
+			next = append(next, lc)
+			continue
+		}
+
+		if old != nil && old.cert != nil && !bytes.Equal(old.cert.Certificate[0], cert.Certificate[0]) {
+			klog.Infof("[https] reloaded certificate %s", f.Cert)
+		}
+		next = append(next, &loadedCert{pair: f, cert: cert})
+	}
+	c.certs.Store(&next)
+
+	for f := range prev {
+		if !containsPair(files, f) {
+			stat.GlobalStats.RemoveCert(c.key, f.Cert)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func containsPair(pairs []config.CertPair, p config.CertPair) bool {
+	for _, q := range pairs {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+func loadKeyPair(f config.CertPair) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Cert, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Cert, err)
+		}
+	}
+	return &cert, nil
+}
+
+// get is the GetCertificate of a terminating rule, picking the certificate
+// valid for the SNI of hello or else the first one.
+func (c *certificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.rule.ACME {
+		return acme.Global.Certificate(c.rule.Host)
+	}
+
+	var first *tls.Certificate
+	for _, lc := range *c.certs.Load() {
+		if lc.cert == nil {
+			continue
+		}
+		if hello.SupportsCertificate(lc.cert) == nil {
+			return lc.cert, nil
+		}
+		if first == nil {
+			first = lc.cert
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return first, nil
+}
+
+// start publishes the certificates of c in the stats and watches their
+// files until stop is called.
+func (c *certificates) start() {
+	if c == nil || c.rule.ACME {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.publish()
+
+	// watching the directories catches files replaced by a rename too
+	var dirs []string
+	if c.rule.Cert != "" {
+		dirs = append(dirs, filepath.Dir(c.rule.Cert), filepath.Dir(c.rule.Key))
+	}
+	if c.rule.CertDir != "" {
+		dirs = append(dirs, filepath.Clean(c.rule.CertDir))
+	}
+	c.dirs = []string{}
+	for _, dir := range dirs {
+		if slices.Contains(c.dirs, dir) {
+			continue
+		}
+		if err := certWatcher.add(dir, c); err != nil {
+			klog.Errorf("[https] couldn't watch the certificates of %s in %s: %v", c.rule.Host, dir, err)
+			continue
+		}
+		c.dirs = append(c.dirs, dir)
+	}
+}
+
+// changed schedules a reload of c after a file in one of its directories
+// changed.
+func (c *certificates) changed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dirs == nil {
+		return
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(certReloadDelay, c.reloadFiles)
+}
+
+// reloadFiles reloads c after its files changed.
+func (c *certificates) reloadFiles() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dirs == nil {
+		return
+	}
+
+	if err := c.reload(); err != nil {
+		klog.Errorf("[https] reloading the certificates of %s, keep serving the old ones: %v", c.rule.Host, err)
+	}
+	c.publish()
+}
+
+// publish records the certificates of c in the stats.
+func (c *certificates) publish() {
+	for _, lc := range *c.certs.Load() {
+		var cs stat.CertState
+		if lc.cert != nil {
+			cs = stat.NewCertState(lc.cert.Leaf)
+		}
+		if lc.err != nil {
+			cs.LastError = lc.err.Error()
+		}
+		stat.GlobalStats.SetCert(c.key, lc.pair.Cert, cs)
+	}
+}
+
+// stop stops watching the files of c after its rule got replaced or
+// removed and forgets its certificates in the stats. A rule replacing it
+// publishes them again once started.
+func (c *certificates) stop() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, dir := range c.dirs {
+		certWatcher.remove(dir, c)
+	}
+	c.dirs = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	for _, lc := range *c.certs.Load() {
+		stat.GlobalStats.RemoveCert(c.key, lc.pair.Cert)
+	}
+}
@@ -0,0 +1,375 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/acme"
+	"github.com/knwgo/yarp/acme/acmetest"
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// writeTestCert writes a self signed certificate for hosts and its key to
+// dir as name.crt and name.key and returns the certificate.
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time, hosts ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestCertificates_Get(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "a", time.Now().Add(time.Hour), "a.example.com")
+	writeTestCert(t, dir, "b", time.Now().Add(time.Hour), "*.b.example.com")
+
+	certs, err := loadCertificates("test", config.HostRule{CertDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	for sni, want := range map[string]string{
+		"a.example.com":   "a.example.com",
+		"x.b.example.com": "*.b.example.com",
+		"other.com":       "a.example.com",
+	} {
+		cert, err := certs.get(&tls.ClientHelloInfo{
+			ServerName:        sni,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", sni, err)
+		}
+		if got := cert.Leaf.DNSNames[0]; got != want {
+			t.Errorf("%s: expected the certificate of %s, got %s", sni, want, got)
+		}
+	}
+
+	empty, err := loadCertificates("test", config.HostRule{CertDir: t.TempDir()})
+	if err == nil {
+		t.Error("Expected an error loading an empty certDir")
+	}
+	if _, err := empty.get(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("Expected an error without certificates")
+	}
+}
+
+func TestHTTPSProxy_Terminate(t *testing.T) {
+	dir := t.TempDir()
+	tcpCert := writeTestCert(t, dir, "tcp", time.Now().Add(time.Hour), "tcp.example.com")
+	webDir := filepath.Join(dir, "web")
+	os.Mkdir(webDir, 0o700)
+	webCert := writeTestCert(t, webDir, "web", time.Now().Add(time.Hour), "web.example.com", "api.example.com")
+
+	passTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("passthrough"))
+	}))
+	defer passTarget.Close()
+	webTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web:" + r.Host))
+	}))
+	defer webTarget.Close()
+	webAddr := strings.TrimPrefix(webTarget.URL, "http://")
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := &HTTPSProxy{}
+	err := proxy.Reload([]config.Http{{BindAddr: proxyAddr, Rules: []config.HostRule{
+		{
+			Host:   "tcp.example.com",
+			Target: startTaggedServer(t, "tcp:"),
+			Cert:   filepath.Join(dir, "tcp.crt"),
+			Key:    filepath.Join(dir, "tcp.key"),
+		},
+		{Host: "web.example.com", Target: webAddr, CertDir: webDir, Forward: config.ForwardHTTP},
+		{Host: "api.example.com", Target: webAddr, CertDir: webDir, Forward: config.ForwardHTTP},
+		{Host: "pass.example.com", Target: strings.TrimPrefix(passTarget.URL, "https://")},
+	}}})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	dial := func(sni string, root *x509.Certificate) *tls.Conn {
+		t.Helper()
+		pool := x509.NewCertPool()
+		pool.AddCert(root)
+		conn, err := tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: sni, RootCAs: pool})
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", sni, err)
+		}
+		return conn
+	}
+
+	conn := dial("tcp.example.com", tcpCert)
+	if got := roundTrip(t, conn, "hello"); got != "tcp:hello" {
+		t.Errorf("Expected the decrypted stream to reach the target, got %q", got)
+	}
+	conn.Close()
+
+	// the request goes by its host, not the sni
+	conn = dial("web.example.com", webCert)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: api.example.com\r\nConnection: close\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "web:api.example.com" {
+		t.Errorf("Expected the request to be routed by host, got %q", body)
+	}
+	conn.Close()
+
+	passConn, err := tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: "pass.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Passthrough handshake failed: %v", err)
+	}
+	defer passConn.Close()
+	if got := passConn.ConnectionState().PeerCertificates[0]; got.Equal(tcpCert) || got.Equal(webCert) {
+		t.Error("Expected the passthrough rule to serve the certificate of its target")
+	}
+}
+
+func TestCertificates_HotReload(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestCert(t, dir, "app", time.Now().Add(365*24*time.Hour), "app.example.com")
+	certFile := filepath.Join(dir, "app.crt")
+
+	certs, err := loadCertificates("test", config.HostRule{Host: "app.example.com", Cert: certFile, Key: filepath.Join(dir, "app.key")})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	certs.start()
+	defer certs.stop()
+
+	hello := &tls.ClientHelloInfo{ServerName: "app.example.com"}
+	served := func() *x509.Certificate {
+		cert, err := certs.get(hello)
+		if err != nil {
+			t.Fatalf("Failed to get certificate: %v", err)
+		}
+		return cert.Leaf
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); !cond(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+		}
+	}
+
+	if !served().Equal(first) {
+		t.Fatal("Expected the initial certificate")
+	}
+	if cs := stat.GlobalStats.Snapshot().Certs["test"][certFile]; cs.Subject != "CN=app.example.com" || cs.ExpiresSoon {
+		t.Errorf("Unexpected certificate state %+v", cs)
+	}
+
+	// rotated by external tooling, soon to expire
+	second := writeTestCert(t, dir, "app", time.Now().Add(24*time.Hour), "app.example.com", "www.example.com")
+	waitFor("the rotated certificate", func() bool { return served().Equal(second) })
+	waitFor("the stats of the rotated certificate", func() bool {
+		cs := stat.GlobalStats.Snapshot().Certs["test"][certFile]
+		return len(cs.SANs) == 2 && cs.ExpiresSoon
+	})
+
+	// a broken file keeps the old certificate in service
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	waitFor("the reload error", func() bool { return stat.GlobalStats.Snapshot().Certs["test"][certFile].LastError != "" })
+	if !served().Equal(second) {
+		t.Error("Expected the last good certificate to be served after a broken reload")
+	}
+
+	certs.stop()
+	if _, ok := stat.GlobalStats.Snapshot().Certs["test"][certFile]; ok {
+		t.Error("Expected the certificate to be forgotten once stopped")
+	}
+}
+
+func TestHTTPSProxy_ACME(t *testing.T) {
+	httpAddr, httpsAddr := freeTCPAddr(t), freeTCPAddr(t)
+	srv := acmetest.NewServer(httpAddr, httpsAddr)
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, srv.CACertPEM(), 0o600)
+
+	target := startTaggedServer(t, "acme:")
+	httpProxy := &HTTPProxy{}
+	if err := httpProxy.Reload([]config.Http{{BindAddr: httpAddr, Rules: []config.HostRule{{Host: "web.example.com", Target: target}}}}); err != nil {
+		t.Fatalf("Failed to start http proxy: %v", err)
+	}
+	defer httpProxy.Reload(nil)
+	httpsProxy := &HTTPSProxy{}
+	if err := httpsProxy.Reload([]config.Http{{BindAddr: httpsAddr, Rules: []config.HostRule{
+		{Host: "alpn.example.com", Target: target, ACME: true},
+		{Host: "http.example.com", Target: target, ACME: true},
+	}}}); err != nil {
+		t.Fatalf("Failed to start https proxy: %v", err)
+	}
+	defer httpsProxy.Reload(nil)
+	defer acme.Global.Configure(nil, nil)
+
+	storage := t.TempDir()
+	for host, challenge := range map[string]string{
+		"alpn.example.com": config.ChallengeTLSALPN01,
+		"http.example.com": config.ChallengeHTTP01,
+	} {
+		cfg := &config.ACME{DirectoryURL: srv.DirectoryURL(), CACert: caFile, StorageDir: storage, Challenges: []string{challenge}}
+		if err := acme.Global.Configure(cfg, []string{host}); err != nil {
+			t.Fatalf("Failed to configure acme: %v", err)
+		}
+
+		var conn *tls.Conn
+		for deadline := time.Now().Add(10 * time.Second); conn == nil; time.Sleep(50 * time.Millisecond) {
+			conn, _ = tls.Dial("tcp", httpsAddr, &tls.Config{ServerName: host, RootCAs: srv.Roots()})
+			if conn == nil && time.Now().After(deadline) {
+				t.Fatalf("%s: timed out waiting for the acme certificate", host)
+			}
+		}
+		if got := roundTrip(t, conn, "hello"); got != "acme:hello" {
+			t.Errorf("%s: expected the decrypted stream to reach the target, got %q", host, got)
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPSProxy_ALPNPassthrough(t *testing.T) {
+	// a backend answering its own tls-alpn-01 challenges
+	dir := t.TempDir()
+	writeTestCert(t, dir, "backend", time.Now().Add(time.Hour), "own.example.com")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "backend.crt"), filepath.Join(dir, "backend.key"))
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{acme.ALPNProto}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := &HTTPSProxy{}
+	if err := proxy.Reload([]config.Http{{BindAddr: proxyAddr, Rules: []config.HostRule{
+		{Host: "own.example.com", Target: ln.Addr().String()},
+	}}}); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: "own.example.com", NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected the challenge to reach the backend: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().NegotiatedProtocol; got != acme.ALPNProto {
+		t.Errorf("Expected %s negotiated by the backend, got %q", acme.ALPNProto, got)
+	}
+}
+
+func TestCertificates_SharedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "app", time.Now().Add(365*24*time.Hour), "app.example.com")
+	rule := config.HostRule{Host: "app.example.com", Cert: filepath.Join(dir, "app.crt"), Key: filepath.Join(dir, "app.key")}
+
+	a, err := loadCertificates("test:a", rule)
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	b, err := loadCertificates("test:b", rule)
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	a.start()
+	b.start()
+	defer b.stop()
+
+	certWatcher.mu.Lock()
+	watching := len(certWatcher.dirs[dir])
+	certWatcher.mu.Unlock()
+	if watching != 2 {
+		t.Errorf("Expected both rules to share the watch of %s, got %d", dir, watching)
+	}
+
+	a.stop()
+	certs := stat.GlobalStats.Snapshot().Certs
+	if _, ok := certs["test:a"]; ok {
+		t.Error("Expected the certificate of the stopped rule to be forgotten")
+	}
+	if cs, ok := certs["test:b"][rule.Cert]; !ok || cs.Subject != "CN=app.example.com" {
+		t.Errorf("Expected the other rule to keep its certificate, got %+v", cs)
+	}
+
+	// the remaining rule still follows its files
+	second := writeTestCert(t, dir, "app", time.Now().Add(24*time.Hour), "app.example.com", "www.example.com")
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if cert, err := b.get(&tls.ClientHelloInfo{ServerName: "app.example.com"}); err == nil && cert.Leaf.Equal(second) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the rotated certificate")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// certWatcher watches the certificate directories of every terminating
+// rule, each directory once however many rules keep their files there.
+var certWatcher = &dirWatcher{}
+
+// dirWatcher tells the certificates watching a directory about changes of
+// the files in it. It runs a single fsnotify watcher while any directory is
+// watched.
+type dirWatcher struct {
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	dirs    map[string]map[*certificates]bool
+}
+
+// add makes c hear about changes in dir until remove is called.
+func (w *dirWatcher) add(dir string, c *certificates) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		w.watcher = watcher
+		w.dirs = make(map[string]map[*certificates]bool)
+		go w.run(watcher)
+	}
+
+	if _, ok := w.dirs[dir]; !ok {
+		if err := w.watcher.Add(dir); err != nil {
+			w.closeIfIdle()
+			return err
+		}
+		w.dirs[dir] = make(map[*certificates]bool)
+	}
+	w.dirs[dir][c] = true
+	return nil
+}
+
+// remove stops telling c about changes in dir, and stops watching dir once
+// nothing else is interested in it.
+func (w *dirWatcher) remove(dir string, c *certificates) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watching, ok := w.dirs[dir]
+	if !ok {
+		return
+	}
+	delete(watching, c)
+	if len(watching) == 0 {
+		delete(w.dirs, dir)
+		_ = w.watcher.Remove(dir)
+		w.closeIfIdle()
+	}
+}
+
+func (w *dirWatcher) closeIfIdle() {
+	if len(w.dirs) == 0 {
+		_ = w.watcher.Close()
+		w.watcher = nil
+	}
+}
+
+func (w *dirWatcher) run(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.mu.Lock()
+			var watching []*certificates
+			if w.watcher == watcher {
+				for c := range w.dirs[filepath.Dir(event.Name)] {
+					watching = append(watching, c)
+				}
+			}
+			w.mu.Unlock()
+
+			for _, c := range watching {
+				c.changed()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Errorf("[https] watching the certificates: %v", err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// Headers carrying the verified client certificate to the targets of rules
+// with a clientCA forwarding http. Every rule terminating tls to forward
+// http drops whatever a client sends in them, with a clientCA or not.
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertSANsHeader        = "X-Client-Cert-SANs"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// PROXY protocol v2 TLV types describing a terminated tls connection. The
+// standard PP2_TYPE_SSL carries the version, cipher and common name, the
+// custom ones the full client certificate subject, its SANs and fingerprint.
+const (
+	pp2TypeSSL               = 0x20
+	pp2SubtypeSSLVersion     = 0x21
+	pp2SubtypeSSLCN          = 0x22
+	pp2SubtypeSSLCipher      = 0x23
+	pp2TypeClientSubject     = 0xe0
+	pp2TypeClientSANs        = 0xe1
+	pp2TypeClientFingerprint = 0xe2
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+)
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// verifiesClients reports whether the rule of c asks clients for a
+// certificate.
+func (c *certificates) verifiesClients() bool {
+	return c.rule.ClientCA != ""
+}
+
+// verifyClient is the VerifyConnection of a rule with a clientCA, turning
+// away clients without a certificate issued by one of its CAs. Clients
+// without any are let in with verify-if-given.
+func (c *certificates) verifyClient(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		if c.rule.ClientAuth == config.ClientAuthVerifyIfGiven {
+			return nil
+		}
+		return errors.New("no client certificate")
+	}
+	if c.clientCAs == nil {
+		return fmt.Errorf("client CAs of %s not loaded", c.rule.Host)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         c.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate %s: %w", cs.PeerCertificates[0].Subject, err)
+	}
+	return nil
+}
+
+// sameClientAuth reports whether a and b authenticate clients alike, so a
+// connection verified for one may carry requests for the other.
+func sameClientAuth(a, b config.HostRule) bool {
+	return a.ClientCA == b.ClientCA && (a.ClientCA == "" || a.ClientAuth == b.ClientAuth)
+}
+
+// clientCert describes the verified certificate of a client.
+type clientCert struct {
+	subject     string
+	sans        string
+	fingerprint string
+}
+
+// verifiedClientCert returns the certificate the client of cs presented,
+// nil without one. Handshakes of rules with a clientCA only complete once
+// it verified.
+func verifiedClientCert(cs tls.ConnectionState) *clientCert {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+
+	sans := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, u := range leaf.URIs {
+		sans = append(sans, u.String())
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	return &clientCert{
+		subject:     leaf.Subject.String(),
+		sans:        strings.Join(sans, ", "),
+		fingerprint: hex.EncodeToString(sum[:]),
+	}
+}
+
+// tlsTLVs describes the terminated connection of cs for a PROXY protocol v2
+// header.
+func tlsTLVs(cs tls.ConnectionState) []proxyTLV {
+	var ssl bytes.Buffer
+	client, verify := byte(pp2ClientSSL), uint32(1)
+	cert := verifiedClientCert(cs)
+	if cert != nil {
+		client |= pp2ClientCertConn
+		verify = 0
+	}
+	ssl.WriteByte(client)
+	_ = binary.Write(&ssl, binary.BigEndian, verify)
+	writeSubTLV := func(typ byte, value string) {
+		ssl.WriteByte(typ)
+		_ = binary.Write(&ssl, binary.BigEndian, uint16(len(value)))
+		ssl.WriteString(value)
+	}
+	writeSubTLV(pp2SubtypeSSLVersion, strings.ReplaceAll(tls.VersionName(cs.Version), " ", "v"))
+	writeSubTLV(pp2SubtypeSSLCipher, tls.CipherSuiteName(cs.CipherSuite))
+	if cert != nil {
+		writeSubTLV(pp2SubtypeSSLCN, cs.PeerCertificates[0].Subject.CommonName)
+	}
+
+	tlvs := []proxyTLV{{pp2TypeSSL, ssl.Bytes()}}
+	if cert != nil {
+		tlvs = append(tlvs,
+			proxyTLV{pp2TypeClientSubject, []byte(cert.subject)},
+			proxyTLV{pp2TypeClientSANs, []byte(cert.sans)},
+			proxyTLV{pp2TypeClientFingerprint, []byte(cert.fingerprint)},
+		)
+	}
+	return tlvs
+}
+
+// clientCertConn reads the requests of conn with the client certificate
+// headers set to cert, or removed if it is nil.
+type clientCertConn struct {
+	net.Conn
+	r *io.PipeReader
+}
+
+func newClientCertConn(conn net.Conn, cert *clientCert) net.Conn {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rewriteRequests(pw, bufio.NewReader(conn), cert))
+	}()
+	return &clientCertConn{Conn: conn, r: pr}
+}
+
+func (c *clientCertConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *clientCertConn) Close() error {
+	_ = c.r.Close()
+	return c.Conn.Close()
+}
+
+// CloseWrite half closes the underlying connection, see closeWrite.
+func (c *clientCertConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// rewriteRequests copies the requests of r to w with the headers of cert
+// until r ends or a request switches protocols, the rest being copied as is.
+func rewriteRequests(w io.Writer, r *bufio.Reader, cert *clientCert) error {
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		req.Header.Del(clientCertSubjectHeader)
+		req.Header.Del(clientCertSANsHeader)
+		req.Header.Del(clientCertFingerprintHeader)
+		if cert != nil {
+			req.Header.Set(clientCertSubjectHeader, cert.subject)
+			req.Header.Set(clientCertSANsHeader, cert.sans)
+			req.Header.Set(clientCertFingerprintHeader, cert.fingerprint)
+		}
+		// keep Write from adding a default user agent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = nil
+		}
+		if err := req.Write(w); err != nil {
+			return err
+		}
+
+		if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// issueClientCert returns a client certificate for cn signed by ca, or self
+// signed if ca is nil, and the ca it used.
+func issueClientCert(t *testing.T, cn string, ca *tls.Certificate) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"yarp"}},
+		DNSNames:              []string{cn + ".example.com"},
+		EmailAddresses:        []string{cn + "@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+	}
+	parent, signer := tmpl, any(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestHTTPSProxy_ClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := writeTestCert(t, dir, "server", time.Now().Add(time.Hour),
+		"admin.example.com", "opt.example.com", "public.example.com", "tcp.example.com")
+	ca, _ := issueClientCert(t, "ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600)
+	alice, aliceLeaf := issueClientCert(t, "alice", &ca)
+	mallory, _ := issueClientCert(t, "mallory", nil)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + "|" + strings.Join([]string{
+			r.Header.Get(clientCertSubjectHeader),
+			r.Header.Get(clientCertSANsHeader),
+			r.Header.Get(clientCertFingerprintHeader),
+		}, "|")))
+	}))
+	defer web.Close()
+	webAddr := strings.TrimPrefix(web.URL, "http://")
+
+	// reports the tlvs of the PROXY v2 header it receives
+	tlvs := make(chan map[byte][]byte, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 16)
+		io.ReadFull(conn, header)
+		body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+		io.ReadFull(conn, body)
+		found := make(map[byte][]byte)
+		for rest := body[12:]; len(rest) >= 3; {
+			n := int(binary.BigEndian.Uint16(rest[1:3]))
+			found[rest[0]] = rest[3 : 3+n]
+			rest = rest[3+n:]
+		}
+		tlvs <- found
+	}()
+
+	cert := filepath.Join(dir, "server.crt")
+	key := filepath.Join(dir, "server.key")
+	proxyAddr := freeTCPAddr(t)
+	proxy := &HTTPSProxy{}
+	err = proxy.Reload([]config.Http{{BindAddr: proxyAddr, Rules: []config.HostRule{
+		{Host: "admin.example.com", Target: webAddr, Cert: cert, Key: key, Forward: config.ForwardHTTP, ClientCA: caFile},
+		{Host: "opt.example.com", Target: webAddr, Cert: cert, Key: key, Forward: config.ForwardHTTP, ClientCA: caFile, ClientAuth: config.ClientAuthVerifyIfGiven},
+		{Host: "public.example.com", Target: webAddr, Cert: cert, Key: key, Forward: config.ForwardHTTP},
+		{Host: "tcp.example.com", Target: ln.Addr().String(), Cert: cert, Key: key, ClientCA: caFile, ProxyProtocol: config.ProxyProtocolV2},
+	}}})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	get := func(sni, host string, client *tls.Certificate) (string, error) {
+		t.Helper()
+		cfg := &tls.Config{ServerName: sni, RootCAs: roots}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{*client}
+		}
+		conn, err := tls.Dial("tcp", proxyAddr, cfg)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\nX-Client-Cert-Subject: CN=admin\r\nConnection: close\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	rejected := func() (n uint64) {
+		for key, rs := range stat.GlobalStats.Snapshot().RuleStats {
+			if strings.HasPrefix(key, "https:admin.example.com->") {
+				n += rs.CertRejected
+			}
+		}
+		return n
+	}
+	before := rejected()
+
+	sum := sha256.Sum256(aliceLeaf.Raw)
+	want := "admin.example.com|" + aliceLeaf.Subject.String() + "|alice.example.com, alice@example.com|" + hex.EncodeToString(sum[:])
+	if got, err := get("admin.example.com", "admin.example.com", &alice); err != nil || got != want {
+		t.Errorf("Expected the verified certificate in the headers, got %q, %v", got, err)
+	}
+	if got, err := get("opt.example.com", "opt.example.com", nil); err != nil || got != "opt.example.com|||" {
+		t.Errorf("Expected an anonymous client with the spoofed header removed, got %q, %v", got, err)
+	}
+	if got, err := get("public.example.com", "public.example.com", nil); err != nil || got != "public.example.com|||" {
+		t.Errorf("Expected the spoofed header removed without a clientCA, got %q, %v", got, err)
+	}
+
+	for name, client := range map[string]*tls.Certificate{"no": nil, "an untrusted": &mallory} {
+		if got, err := get("admin.example.com", "admin.example.com", client); err == nil {
+			t.Errorf("Expected a client with %s certificate to be rejected, got %q", name, got)
+		}
+	}
+	// the sni of a rule without client auth gets no requests to one with
+	if got, err := get("public.example.com", "admin.example.com", nil); err == nil {
+		t.Errorf("Expected no route to the admin host, got %q", got)
+	}
+
+	// the client may see the alert before the proxy counts it
+	for deadline := time.Now().Add(2 * time.Second); rejected()-before < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := rejected() - before; n != 2 {
+		t.Errorf("Expected 2 rejected handshakes, got %d", n)
+	}
+
+	conn, err := tls.Dial("tcp", proxyAddr, &tls.Config{ServerName: "tcp.example.com", RootCAs: roots, Certificates: []tls.Certificate{alice}})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	select {
+	case found := <-tlvs:
+		ssl := found[pp2TypeSSL]
+		if len(ssl) < 5 || ssl[0] != pp2ClientSSL|pp2ClientCertConn || binary.BigEndian.Uint32(ssl[1:5]) != 0 {
+			t.Errorf("Expected a verified client in the ssl tlv, got %x", ssl)
+		}
+		if got := string(found[pp2TypeClientFingerprint]); got != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected the fingerprint tlv, got %q", got)
+		}
+		if got := string(found[pp2TypeClientSubject]); got != aliceLeaf.Subject.String() {
+			t.Errorf("Expected the subject tlv, got %q", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the proxy header")
+	}
+}
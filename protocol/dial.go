@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// dialPolicy is how the connections of a rule reach its targets.
+type dialPolicy struct {
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	sock    *sockOptions
+	// tls is set if the connections are encrypted, see secure
+	tls *upstreamTLS
+}
+
+func newDialPolicy(timeout time.Duration, retries int, backoff time.Duration, sock *sockOptions, tls *upstreamTLS) dialPolicy {
+	if timeout <= 0 {
+		timeout = config.DefaultConnectTimeout
+	}
+	return dialPolicy{timeout: timeout, retries: retries, backoff: backoff, sock: sock, tls: tls}
+}
+
+// dial connects to up, the upstream picked for a connection from client to
+// host. If that fails it retries up to p.retries times, preferring upstreams
+// of lb that were not tried yet. Nothing has been sent to any upstream at that
+// point, so the retry is invisible to the client.
+//
+// dial takes over up: it returns the acquired upstream that accepted the
+// connection, which the caller must release, and releases all others.
+func (p dialPolicy) dial(lb *balancer, up *lease, client net.Addr, host string) (net.Conn, *lease, error) {
+	tried := make(map[*upstream]bool)
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		network, addr := streamNetwork(up.addr)
+		conn, err := p.sock.dialer(network, p.timeout).Dial(network, addr)
+		if err == nil {
+			p.sock.apply(conn)
+			return conn, up, nil
+		}
+
+		up.reportFailure(err)
+		up.release()
+		if attempt >= p.retries {
+			return nil, nil, err
+		}
+
+		klog.Warningf("[dial] %s for %s failed, retrying: %v", up.addr, client, err)
+		tried[up.upstream] = true
+		if backoff > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		up = lb.pickExcept(client, host, tried)
+		if up == nil {
+			// every available upstream failed once, go round again
+			up = lb.pick(client, host)
+		}
+		if up == nil {
+			return nil, nil, fmt.Errorf("%w, no upstream left to retry", err)
+		}
+	}
+}
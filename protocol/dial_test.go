@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestTcpProxy_RetryNextTarget(t *testing.T) {
+	liveAddr := startTaggedServer(t, "live:")
+	deadAddr := freeTCPAddr(t)
+	proxyAddr := freeTCPAddr(t)
+
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr:       proxyAddr,
+		Targets:        []config.Target{{Addr: deadAddr}, {Addr: liveAddr}},
+		ConnectTimeout: time.Second,
+		Retries:        1,
+		RetryBackoff:   10 * time.Millisecond,
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	// without outlier detection round-robin keeps picking the dead target,
+	// every such connection must be retried on the live one
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		if got := roundTrip(t, conn, "x"); got != "live:x" {
+			t.Errorf("Connection %d: expected %q, got %q", i, "live:x", got)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialPolicy_GiveUp(t *testing.T) {
+	route := testIPRoute(config.IPRule{
+		BindAddr: "127.0.0.1:0",
+		Targets:  []config.Target{{Addr: freeTCPAddr(t)}, {Addr: freeTCPAddr(t)}},
+		Retries:  3,
+	})
+	route.start()
+	defer route.close(nil)
+
+	up := route.lb.pick(nil, "")
+	conn, got, err := route.dial.dial(route.lb, up, nil, "")
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected dialing dead targets to fail")
+	}
+	if got != nil {
+		t.Errorf("Expected no upstream on failure, got %s", got.addr)
+	}
+	if !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Expected the last dial error, got %v", err)
+	}
+
+	for _, u := range route.lb.upstreams {
+		if n := u.active.Load(); n != 0 {
+			t.Errorf("Expected %s to be released, %d connections still active", u.addr, n)
+		}
+	}
+}
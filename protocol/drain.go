@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connTracker tracks every accepted client connection of a Server until its
+// handler returns, so that a shutdown can wait for them to drain. A nil
+// connTracker tracks nothing, for proxies that run on their own.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// closed is set once the shutdown started waiting, after which no
+	// connection is tracked anymore
+	closed bool
+	// drained is closed by the last connection to finish while wait blocks
+	drained chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// track registers c and returns the func that must be called once c is done.
+// It fails once the shutdown started, in which case c must be closed instead
+// of handled.
+func (ct *connTracker) track(c net.Conn) (func(), bool) {
+	if ct == nil {
+		return func() {}, true
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.closed {
+		return nil, false
+	}
+	ct.conns[c] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			delete(ct.conns, c)
+			if len(ct.conns) == 0 && ct.drained != nil {
+				close(ct.drained)
+				ct.drained = nil
+			}
+		})
+	}, true
+}
+
+func (ct *connTracker) count() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.conns)
+}
+
+// wait stops tracking new connections and blocks until every tracked one is
+// done or ctx expires.
+func (ct *connTracker) wait(ctx context.Context) error {
+	ct.mu.Lock()
+	ct.closed = true
+	if len(ct.conns) == 0 {
+		ct.mu.Unlock()
+		return nil
+	}
+	if ct.drained == nil {
+		ct.drained = make(chan struct{})
+	}
+	drained := ct.drained
+	ct.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll closes every tracked connection, which makes their pipes return.
+func (ct *connTracker) closeAll() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for c := range ct.conns {
+		_ = c.Close()
+	}
+}
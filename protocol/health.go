@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// startHealthChecks probes every upstream of b according to hc until
+// stopHealthChecks is called. Without hc all upstreams are marked healthy,
+// so a target does not stay down after its check was removed on reload.
+func (b *balancer) startHealthChecks(hc *config.HealthCheck, network string, sock *sockOptions) {
+	if hc == nil {
+		for _, u := range b.upstreams {
+			u.down.Store(false)
+			stat.GlobalStats.SetTargetHealth(b.key, u.addr, "", nil)
+		}
+		return
+	}
+
+	checks := hc.WithDefaults(network)
+	b.stopHealthCheck = make(chan struct{})
+	for _, u := range b.upstreams {
+		go runHealthCheck(b.key, u, checks, sock, b.stopHealthCheck)
+	}
+}
+
+func (b *balancer) stopHealthChecks() {
+	if b.stopHealthCheck == nil {
+		return
+	}
+
+	close(b.stopHealthCheck)
+	b.stopHealthCheck = nil
+}
+
+func runHealthCheck(rule string, u *upstream, hc config.HealthCheck, sock *sockOptions, stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	var rise, fall int
+	for {
+		err := probe(u.addr, hc, sock)
+		if err == nil {
+			rise, fall = rise+1, 0
+		} else {
+			rise, fall = 0, fall+1
+		}
+
+		if u.down.Load() && rise >= hc.Rise {
+			klog.Infof("[health] %s is up", u.addr)
+			u.down.Store(false)
+		} else if !u.down.Load() && fall >= hc.Fall {
+			klog.Warningf("[health] %s is down: %v", u.addr, err)
+			u.down.Store(true)
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		health := stat.HealthUp
+		if u.down.Load() {
+			health = stat.HealthDown
+		}
+		stat.GlobalStats.SetTargetHealth(rule, u.addr, health, err)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks the upstream at addr once, dialing it with sock so that the
+// probe leaves from the same source address as the proxied connections.
+func probe(addr string, hc config.HealthCheck, sock *sockOptions) error {
+	switch hc.Type {
+	case config.HealthCheckHTTP:
+		return probeHTTP(addr, hc, sock)
+	case config.HealthCheckTLS:
+		return probeTLS(addr, hc, sock)
+	case config.HealthCheckUDP:
+		return probeUDP(addr, hc, sock)
+	default:
+		network, address := streamNetwork(addr)
+		conn, err := sock.dialer(network, hc.Timeout).Dial(network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func probeHTTP(addr string, hc config.HealthCheck, sock *sockOptions) error {
+	network, address := streamNetwork(addr)
+	urlHost := addr
+	if network == "unix" {
+		urlHost = "localhost"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+urlHost+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+
+	client := &http.Client{
+		Timeout: hc.Timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return sock.dialer(network, 0).DialContext(ctx, network, address)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != hc.ExpectStatus {
+		return fmt.Errorf("unexpected status %d, want %d", resp.StatusCode, hc.ExpectStatus)
+	}
+	return nil
+}
+
+// probeTLS only checks that the handshake completes, the certificate itself
+// is the client's business.
+func probeTLS(addr string, hc config.HealthCheck, sock *sockOptions) error {
+	network, address := streamNetwork(addr)
+	conn, err := tls.DialWithDialer(sock.dialer(network, hc.Timeout), network, address, &tls.Config{
+		ServerName:         hc.ServerName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeUDP(addr string, hc config.HealthCheck, sock *sockOptions) error {
+	conn, err := sock.dialer("udp", hc.Timeout).Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if _, err := conn.Write([]byte(hc.Send)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(buf[:n], []byte(hc.Expect)) {
+		return fmt.Errorf("unexpected answer %q", buf[:n])
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestHealthCheck_TCP(t *testing.T) {
+	liveAddr := startTaggedServer(t, "")
+	deadAddr := freeTCPAddr(t)
+
+	b := newBalancer("test", "", []config.Target{{Addr: liveAddr}, {Addr: deadAddr}}, nil)
+	b.startHealthChecks(&config.HealthCheck{
+		Interval: 20 * time.Millisecond,
+		Timeout:  100 * time.Millisecond,
+		Rise:     1,
+		Fall:     1,
+	}, "tcp", nil)
+	defer b.stopHealthChecks()
+
+	dead := b.upstreams[1]
+	if !waitFor(t, 2*time.Second, func() bool { return !dead.available() }) {
+		t.Fatalf("Expected %s to be marked down", deadAddr)
+	}
+
+	for i := 0; i < 10; i++ {
+		u := b.pick(nil, "")
+		if u.addr != liveAddr {
+			t.Fatalf("Expected only %s to be picked, got %s", liveAddr, u.addr)
+		}
+		u.release()
+	}
+
+	if state, ok := stat.GlobalStats.Snapshot().Targets["test"][deadAddr]; !ok || state.Health != stat.HealthDown || state.LastError == "" {
+		t.Errorf("Expected %s to be reported unhealthy, got %+v", deadAddr, state)
+	}
+
+	ln, err := net.Listen("tcp", deadAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", deadAddr, err)
+	}
+	defer ln.Close()
+
+	if !waitFor(t, 2*time.Second, dead.available) {
+		t.Errorf("Expected %s to be marked up again", deadAddr)
+	}
+}
+
+func TestHealthCheck_HTTP(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "app.example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	b := newBalancer("test", "", []config.Target{{Addr: addr}}, nil)
+	b.startHealthChecks(&config.HealthCheck{
+		Type:     config.HealthCheckHTTP,
+		Interval: 20 * time.Millisecond,
+		Rise:     2,
+		Fall:     2,
+		Path:     "/healthz",
+		Host:     "app.example.com",
+	}, "tcp", nil)
+	defer b.stopHealthChecks()
+
+	u := b.upstreams[0]
+	if !waitFor(t, 2*time.Second, func() bool { return !u.available() }) {
+		t.Fatal("Expected upstream answering 503 to be marked down")
+	}
+	if got := b.pick(nil, ""); got != nil {
+		t.Errorf("Expected no upstream while all are down, got %s", got.addr)
+	}
+
+	status.Store(http.StatusOK)
+	if !waitFor(t, 2*time.Second, u.available) {
+		t.Error("Expected upstream answering 200 to be marked up")
+	}
+}
+
+func TestHealthCheck_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				pc.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+
+	hc := config.HealthCheck{Send: "ping", Expect: "pong"}.WithDefaults("udp")
+	hc.Timeout = 500 * time.Millisecond
+	if err := probe(pc.LocalAddr().String(), hc, nil); err != nil {
+		t.Errorf("Expected udp probe to succeed, got %v", err)
+	}
+
+	hc.Send = "hello"
+	if err := probe(pc.LocalAddr().String(), hc, nil); err == nil {
+		t.Errorf("Expected udp probe without answer to fail")
+	}
+}
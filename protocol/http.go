@@ -2,90 +2,116 @@ package protocol
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"k8s.io/klog/v2"
 
+	"github.com/knwgo/yarp/acme"
 	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/guard"
 )
 
 type HTTPProxy struct {
 	Cfg []config.Http
-}
-
-func (hp HTTPProxy) Start() error {
-	hf := func(ba string, rules []config.HostRule) error {
-		ln, err := net.Listen("tcp", ba)
-		if err != nil {
-			return err
-		}
-
-		for {
-			clientConn, err := ln.Accept()
-			if err != nil {
-				klog.Errorf("failed to accept client connection: %v", err)
-				continue
-			}
-
-			go hp.handleConn(clientConn, rules)
-		}
-	}
 
-	eg := errgroup.Group{}
+	listeners hostListeners
+}
 
-	for _, ch := range hp.Cfg {
-		ch := ch
-		eg.Go(func() error {
-			return hf(ch.BindAddr, ch.Rules)
-		})
-	}
+func (hp *HTTPProxy) Start() error {
+	return hp.Reload(hp.Cfg)
+}
 
-	return eg.Wait()
+// Reload makes the running listeners match cfg. Rule changes only apply to
+// connections accepted afterwards.
+func (hp *HTTPProxy) Reload(cfg []config.Http) error {
+	hp.Cfg = cfg
+	return hp.listeners.reload("http", cfg, hp.handleConn)
 }
 
-func (hp HTTPProxy) handleConn(clientConn net.Conn, rules []config.HostRule) {
+func (hp *HTTPProxy) handleConn(clientConn net.Conn, routes []*hostRoute) {
 	bc := newBufConn(clientConn, 8192)
 
 	data, err := getHTTPHeaders(bc)
 	if err != nil {
 		klog.Errorf("get http host error: %v", err)
+		guard.Global.Failure(clientConn.RemoteAddr(), "http: "+err.Error())
 		_ = clientConn.Close()
 		return
 	}
 
+	if answerHTTPChallenge(clientConn, data) {
+		return
+	}
+
 	host := parseHTTPHost(data)
 	if host == "" {
 		klog.Errorf("[http] no host header found")
+		guard.Global.Failure(clientConn.RemoteAddr(), "http: no host header")
 		_ = clientConn.Close()
 		return
 	}
 
-	targetInfo, err := getTargetUrl(host, rules)
+	targetInfo, err := getTargetUrl(host, routes, clientConn.RemoteAddr())
 	if err != nil {
 		klog.Errorf("[http] %s form %s get target url error: %v", host, clientConn.RemoteAddr(), err)
+		if errors.Is(err, errNoHost) {
+			guard.Global.Failure(clientConn.RemoteAddr(), "http: unmatched host "+host)
+		}
+		_ = clientConn.Close()
+		return
+	}
+	ruleKey := fmt.Sprintf("http:%s->%s", host, targetInfo.route.targets)
+	if targetInfo.denied {
+		deny(ruleKey, clientConn.RemoteAddr())
 		_ = clientConn.Close()
 		return
 	}
 
 	targetHost := targetInfo.url.Host
 	wsEnabled := targetInfo.wsEnabled
-	ruleKey := fmt.Sprintf("http:%s->%s", host, targetHost)
+
+	bc.Unread(data)
+	var src net.Conn = bc
+	// terminated requests carry the client certificate, if any was verified
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		src = newClientCertConn(bc, verifiedClientCert(tlsConn.ConnectionState()))
+	}
 
 	// Check if WebSocket upgrade is requested
 	if wsEnabled && isWebSocketRequest(data) {
 		klog.Infof("[ws] new conn from: %s, %s -> %s", clientConn.RemoteAddr(), host, targetHost)
-		bc.Unread(data)
-		go handleWsConnection(bc, targetHost, ruleKey)
+		handleWsConnection(src, targetInfo, ruleKey)
 		return
 	}
 
 	klog.Infof("[http] new conn from: %s, %s -> %s", clientConn.RemoteAddr(), host, targetHost)
-	bc.Unread(data)
-	go pipeHostWithStats(bc, targetHost, ruleKey)
+	pipeHostWithStats(src, targetInfo, ruleKey)
+}
+
+// answerHTTPChallenge answers the request in headers if it asks for a
+// pending acme http-01 challenge, whatever its host.
+func answerHTTPChallenge(conn net.Conn, headers []byte) bool {
+	line, _, _ := bytes.Cut(headers, []byte("\r\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || fields[0] != http.MethodGet || !strings.HasPrefix(fields[1], acme.HTTPChallengePath) {
+		return false
+	}
+	keyAuth, ok := acme.Global.HTTPChallenge(fields[1])
+	if !ok {
+		return false
+	}
+
+	klog.Infof("[http] answered the acme challenge %s from %s", fields[1], conn.RemoteAddr())
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(keyAuth), keyAuth)
+	_ = conn.Close()
+	return true
 }
 
 func getHTTPHost(conn *bufConn) (string, error) {
@@ -52,7 +52,7 @@ func TestHTTPProxy(t *testing.T) {
 
 	// Start proxy handler manually
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -147,7 +147,7 @@ func TestHTTPProxy_MultipleRules(t *testing.T) {
 	proxy := HTTPProxy{Cfg: cfg}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -224,7 +224,7 @@ func TestHTTPProxy_WildcardDomain(t *testing.T) {
 	proxy := HTTPProxy{Cfg: cfg}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -441,7 +441,7 @@ func TestGetTargetUrl(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := getTargetUrl(tt.hostPort, tt.rules)
+			result, err := getTargetUrl(tt.hostPort, newHostRoutes("test", tt.rules, nil, nil), nil)
 
 			if tt.wantErr {
 				if err == nil {
@@ -527,7 +527,7 @@ func TestHTTPProxy_ConnectMethod(t *testing.T) {
 	proxy := HTTPProxy{Cfg: cfg}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -617,7 +617,7 @@ func TestHTTPProxy_PostWithBody(t *testing.T) {
 	proxy := HTTPProxy{Cfg: cfg}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
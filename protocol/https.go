@@ -4,87 +4,185 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"k8s.io/klog/v2"
 
+	"github.com/knwgo/yarp/acme"
 	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/guard"
+	"github.com/knwgo/yarp/stat"
 )
 
 type HTTPSProxy struct {
 	Cfg []config.Http
+
+	listeners hostListeners
+
+	// handles the requests of terminating rules forwarding http
+	http HTTPProxy
+}
+
+func (hp *HTTPSProxy) Start() error {
+	return hp.Reload(hp.Cfg)
 }
 
-func (hp HTTPSProxy) Start() error {
-	hf := func(ba string, rules []config.HostRule) error {
-		ln, err := net.Listen("tcp", ba)
-		if err != nil {
-			return err
+// Reload makes the running listeners match cfg. Rule changes only apply to
+// connections accepted afterwards.
+func (hp *HTTPSProxy) Reload(cfg []config.Http) error {
+	hp.Cfg = cfg
+	return hp.listeners.reload("https", cfg, hp.handleConn)
+}
+
+func (hp *HTTPSProxy) handleConn(clientConn net.Conn, routes []*hostRoute) {
+	copyConn, hello, err := getClientHello(clientConn)
+	if err != nil {
+		klog.Errorf("get https hostname error: %v", err)
+		guard.Global.Failure(clientConn.RemoteAddr(), "https: "+err.Error())
+		_ = clientConn.Close()
+		return
+	}
+	sni := hello.ServerName
+
+	// challenges of backends obtaining their own certificates through
+	// passthrough rules are theirs to answer
+	alpnChallenge := slices.Contains(hello.SupportedProtos, acme.ALPNProto)
+	if alpnChallenge {
+		if cert, ok := acme.Global.ALPNCertificate(sni); ok {
+			answerALPNChallenge(copyConn, sni, cert)
+			return
 		}
+	}
 
-		for {
-			clientConn, err := ln.Accept()
-			if err != nil {
-				klog.Errorf("failed to accept client connection: %v", err)
-				continue
-			}
+	targetInfo, err := getTargetUrl(sni, routes, clientConn.RemoteAddr())
+	if err != nil {
+		klog.Errorf("[https] %s from %s get target url error: %v", sni, clientConn.RemoteAddr(), err)
+		if errors.Is(err, errNoHost) {
+			guard.Global.Failure(clientConn.RemoteAddr(), "https: unmatched host "+sni)
+		}
+		_ = clientConn.Close()
+		return
+	}
+	ruleKey := fmt.Sprintf("https:%s->%s", sni, targetInfo.route.targets)
+	if targetInfo.denied {
+		deny(ruleKey, clientConn.RemoteAddr())
+		_ = clientConn.Close()
+		return
+	}
 
-			copyConn, sni, err := getHTTPSHostname(clientConn)
-			if err != nil {
-				klog.Errorf("get https hostname error: %v", err)
-				_ = clientConn.Close()
-				continue
-			}
+	if alpnChallenge && targetInfo.route.rule.ACME {
+		klog.Warningf("[https] %s from %s: no acme challenge pending", sni, clientConn.RemoteAddr())
+		targetInfo.upstream.release()
+		_ = clientConn.Close()
+		return
+	}
 
-			targetInfo, err := getTargetUrl(sni, rules)
-			if err != nil {
-				klog.Errorf("[https] %s from %s get target url error: %v", sni, clientConn.RemoteAddr(), err)
-				_ = clientConn.Close()
-				continue
-			}
+	if targetInfo.route.certs != nil {
+		hp.terminate(copyConn, targetInfo, routes, ruleKey)
+		return
+	}
 
-			klog.Infof("[https] new conn from: %s, %s -> %s", clientConn.RemoteAddr(), sni, targetInfo.url.Host)
+	klog.Infof("[https] new conn from: %s, %s -> %s", clientConn.RemoteAddr(), sni, targetInfo.url.Host)
 
-			ruleKey := fmt.Sprintf("https:%s->%s", sni, targetInfo.url.Host)
-			go pipeHostWithStats(copyConn, targetInfo.url.Host, ruleKey)
+	pipeHostWithStats(copyConn, targetInfo, ruleKey)
+}
+
+// terminate completes the tls handshake of clientConn with the certificate
+// of its rule and forwards the decrypted connection. It takes over
+// target.upstream.
+func (hp *HTTPSProxy) terminate(clientConn net.Conn, target *targetInfo, routes []*hostRoute, ruleKey string) {
+	certs := target.route.certs
+	cfg := &tls.Config{GetCertificate: certs.get}
+	var certErr error
+	if certs.verifiesClients() {
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			certErr = certs.verifyClient(cs)
+			return certErr
 		}
 	}
 
-	eg := errgroup.Group{}
-
-	for _, ch := range hp.Cfg {
-		ch := ch
-		eg.Go(func() error {
-			return hf(ch.BindAddr, ch.Rules)
-		})
+	tlsConn := tls.Server(clientConn, cfg)
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		klog.Errorf("[https] %s from %s handshake error: %v", target.host, clientConn.RemoteAddr(), err)
+		if certErr != nil {
+			stat.GlobalStats.AddCertRejected(ruleKey)
+		}
+		guard.Global.Failure(clientConn.RemoteAddr(), "https: "+err.Error())
+		target.upstream.release()
+		_ = clientConn.Close()
+		return
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	if target.route.rule.Forward == config.ForwardHTTP {
+		target.upstream.release()
+		var httpRoutes []*hostRoute
+		for _, r := range routes {
+			if r.certs != nil && r.rule.Forward == config.ForwardHTTP && sameClientAuth(r.rule, target.route.rule) {
+				httpRoutes = append(httpRoutes, r)
+			}
+		}
+		hp.http.handleConn(tlsConn, httpRoutes)
+		return
 	}
 
-	return eg.Wait()
+	klog.Infof("[https] new terminated conn from: %s, %s -> %s", clientConn.RemoteAddr(), target.host, target.url.Host)
+	pipeHostWithStats(tlsConn, target, ruleKey)
+}
+
+// answerALPNChallenge completes the handshake of a tls-alpn-01 challenge
+// for host with cert, the one the acme client set up for it.
+func answerALPNChallenge(conn net.Conn, host string, cert *tls.Certificate) {
+	defer conn.Close()
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{acme.ALPNProto},
+	})
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		klog.Errorf("[https] %s from %s acme challenge handshake error: %v", host, conn.RemoteAddr(), err)
+		return
+	}
+	klog.Infof("[https] answered the acme challenge of %s from %s", host, conn.RemoteAddr())
 }
 
 func getHTTPSHostname(conn net.Conn) (*bufConn, string, error) {
+	bc, hello, err := getClientHello(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	return bc, hello.ServerName, nil
+}
+
+// getClientHello reads the client hello from conn, which the returned
+// bufConn replays.
+func getClientHello(conn net.Conn) (*bufConn, *tls.ClientHelloInfo, error) {
 	bc := newBufConn(conn, 8192)
 
 	header := make([]byte, 5)
 	if _, err := io.ReadFull(bc, header); err != nil {
-		return nil, "", fmt.Errorf("read TLS header failed: %w", err)
+		return nil, nil, fmt.Errorf("read TLS header failed: %w", err)
 	}
 	if header[0] != 0x16 { // Handshake
-		return nil, "", fmt.Errorf("not TLS handshake record, got 0x%x", header[0])
+		return nil, nil, fmt.Errorf("not TLS handshake record, got 0x%x", header[0])
 	}
 
 	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
 	if recordLen <= 0 || recordLen > 128*1024 {
-		return nil, "", fmt.Errorf("invalid TLS record length: %d", recordLen)
+		return nil, nil, fmt.Errorf("invalid TLS record length: %d", recordLen)
 	}
 
 	body := make([]byte, recordLen)
 	if _, err := io.ReadFull(bc, body); err != nil {
-		return nil, "", fmt.Errorf("read TLS body failed: %w", err)
+		return nil, nil, fmt.Errorf("read TLS body failed: %w", err)
 	}
 
 	clientHelloData := append(header, body...)
@@ -103,12 +201,12 @@ func getHTTPSHostname(conn net.Conn) (*bufConn, string, error) {
 	}).Handshake()
 
 	if hello == nil || hello.ServerName == "" {
-		return nil, "", fmt.Errorf("failed to get SNI")
+		return nil, nil, fmt.Errorf("failed to get SNI")
 	}
 
 	bc.Unread(clientHelloData)
 
-	return bc, hello.ServerName, nil
+	return bc, hello, nil
 }
 
 type readOnlyConn struct {
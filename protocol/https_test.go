@@ -51,7 +51,7 @@ func TestHTTPSProxy(t *testing.T) {
 
 	// Start proxy handler manually
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -63,14 +63,14 @@ func TestHTTPSProxy(t *testing.T) {
 				continue
 			}
 
-			targetInfo, err := getTargetUrl(sni, rules)
+			targetInfo, err := getTargetUrl(sni, rules, clientConn.RemoteAddr())
 			if err != nil {
 				clientConn.Close()
 				continue
 			}
 
 			ruleKey := fmt.Sprintf("https:%s->%s", sni, targetInfo.url.Host)
-			go pipeHostWithStats(copyConn, targetInfo.url.Host, ruleKey)
+			go pipeHostWithStats(copyConn, targetInfo, ruleKey)
 		}
 	}()
 
@@ -160,7 +160,7 @@ func TestHTTPSProxy_MultipleRules(t *testing.T) {
 	}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -172,14 +172,14 @@ func TestHTTPSProxy_MultipleRules(t *testing.T) {
 				continue
 			}
 
-			targetInfo, err := getTargetUrl(sni, rules)
+			targetInfo, err := getTargetUrl(sni, rules, clientConn.RemoteAddr())
 			if err != nil {
 				clientConn.Close()
 				continue
 			}
 
 			ruleKey := fmt.Sprintf("https:%s->%s", sni, targetInfo.url.Host)
-			go pipeHostWithStats(copyConn, targetInfo.url.Host, ruleKey)
+			go pipeHostWithStats(copyConn, targetInfo, ruleKey)
 		}
 	}()
 
@@ -321,7 +321,7 @@ func TestHTTPSProxy_WildcardDomain(t *testing.T) {
 	}
 
 	go func() {
-		rules := cfg[0].Rules
+		rules := newHostRoutes("test", cfg[0].Rules, nil, nil)
 		for {
 			clientConn, err := proxyListener.Accept()
 			if err != nil {
@@ -333,14 +333,14 @@ func TestHTTPSProxy_WildcardDomain(t *testing.T) {
 				continue
 			}
 
-			targetInfo, err := getTargetUrl(sni, rules)
+			targetInfo, err := getTargetUrl(sni, rules, clientConn.RemoteAddr())
 			if err != nil {
 				clientConn.Close()
 				continue
 			}
 
 			ruleKey := fmt.Sprintf("https:%s->%s", sni, targetInfo.url.Host)
-			go pipeHostWithStats(copyConn, targetInfo.url.Host, ruleKey)
+			go pipeHostWithStats(copyConn, targetInfo, ruleKey)
 		}
 	}()
 
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/knwgo/yarp/stat"
+)
+
+// connLimiter caps the concurrent connections of a rule, in total and per
+// client ip. It outlives config reloads of its rule so that connections
+// accepted before a reload keep counting.
+type connLimiter struct {
+	mu       sync.Mutex
+	key      string
+	max      int
+	maxPerIP int
+	queue    time.Duration
+
+	total int
+	perIP map[string]int
+	// freed is closed and replaced whenever a slot frees up
+	freed chan struct{}
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		perIP: make(map[string]int),
+		freed: make(chan struct{}),
+	}
+}
+
+// configure sets the limits, zero meaning unlimited, and how long a
+// connection over them waits for a slot before it is rejected. key is the
+// rule the limiter reports its usage under.
+func (l *connLimiter) configure(key string, max, maxPerIP int, queue time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wasLimited := l.limited()
+	l.key, l.max, l.maxPerIP, l.queue = key, max, maxPerIP, queue
+	if wasLimited || l.limited() {
+		stat.GlobalStats.SetConnLimit(key, int32(max), int32(l.total))
+	}
+
+	// changed limits may let queued connections in
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// acquire takes a slot for a connection from client, waiting for one if the
+// limiter queues. It returns false if the connection must be rejected,
+// otherwise the caller must call release once the connection is done.
+func (l *connLimiter) acquire(client net.Addr) (release func(), ok bool) {
+	ip := clientIP(client)
+
+	var deadline time.Time
+	for {
+		l.mu.Lock()
+		if (l.max <= 0 || l.total < l.max) && (l.maxPerIP <= 0 || l.perIP[ip] < l.maxPerIP) {
+			l.total++
+			l.perIP[ip]++
+			l.report()
+			l.mu.Unlock()
+
+			var once sync.Once
+			return func() { once.Do(func() { l.release(ip) }) }, true
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(l.queue)
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			stat.GlobalStats.AddRejected(l.key)
+			l.mu.Unlock()
+			return nil, false
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.report()
+
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+func (l *connLimiter) limited() bool {
+	return l.max > 0 || l.maxPerIP > 0
+}
+
+// report publishes the usage of a limited rule, the caller holds l.mu.
+func (l *connLimiter) report() {
+	if l.limited() {
+		stat.GlobalStats.SetConnUsage(l.key, int32(l.total))
+	}
+}
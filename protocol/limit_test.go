@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+func TestConnLimiter(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+	c := &net.TCPAddr{IP: net.ParseIP("10.0.0.3")}
+
+	l := newConnLimiter()
+	l.configure("test:limiter", 2, 1, 0)
+
+	releaseA, ok := l.acquire(a)
+	if !ok {
+		t.Fatal("Expected first connection to be accepted")
+	}
+	if _, ok := l.acquire(a); ok {
+		t.Error("Expected second connection of the same ip to be rejected")
+	}
+	if _, ok := l.acquire(b); !ok {
+		t.Error("Expected connection of another ip to be accepted")
+	}
+	if _, ok := l.acquire(c); ok {
+		t.Error("Expected connection over maxConns to be rejected")
+	}
+
+	releaseA()
+	releaseA()
+	if _, ok := l.acquire(c); !ok {
+		t.Error("Expected a released slot to be reusable")
+	}
+
+	rs := stat.GlobalStats.Snapshot().RuleStats["test:limiter"]
+	if rs.ConnLimit != 2 || rs.ConnUsage != 2 || rs.Rejected != 2 {
+		t.Errorf("Expected limit 2, usage 2 and 2 rejections, got %+v", rs)
+	}
+}
+
+func TestConnLimiter_Queue(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+
+	l := newConnLimiter()
+	l.configure("test:queue", 1, 0, 200*time.Millisecond)
+
+	release, _ := l.acquire(client)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+
+	start := time.Now()
+	release2, ok := l.acquire(client)
+	if !ok {
+		t.Fatal("Expected queued connection to get the released slot")
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Expected queued connection to wait, waited %s", waited)
+	}
+
+	if _, ok := l.acquire(client); ok {
+		t.Error("Expected queued connection to be rejected after queueTimeout")
+	}
+	release2()
+}
+
+func TestTcpProxy_MaxConns(t *testing.T) {
+	targetAddr := startTaggedServer(t, "")
+	proxyAddr := freeTCPAddr(t)
+
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr: proxyAddr,
+		Target:   targetAddr,
+		MaxConns: 1,
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	first, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer first.Close()
+	if got := roundTrip(t, first, "a"); got != "a" {
+		t.Fatalf("Expected echo %q, got %q", "a", got)
+	}
+
+	second, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer second.Close()
+	second.Write([]byte("b"))
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := second.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected connection over maxConns to be closed, read %d bytes", n)
+	}
+}
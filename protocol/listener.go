@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// hostListener is a running http/https listener whose host routes can be
+// swapped on reload.
+type hostListener struct {
+	ln net.Listener
+	// key names the listener in the stats of the connections its acl denies
+	key    string
+	routes atomic.Pointer[[]*hostRoute]
+	proxy  atomic.Pointer[proxyAcceptor]
+	acl    atomic.Pointer[acl]
+	sock   atomic.Pointer[sockOptions]
+
+	limiter *connLimiter
+	conns   *connTracker
+}
+
+// hostListeners tracks the listeners of a host based proxy keyed by bindAddr.
+type hostListeners struct {
+	mu sync.Mutex
+	m  map[string]*hostListener
+
+	// conns tracks the accepted connections for the shutdown of a Server
+	conns *connTracker
+}
+
+// reload makes the running listeners match cfg. handle is called for every
+// accepted connection with the routes that are current at accept time.
+func (hls *hostListeners) reload(proto string, cfg []config.Http, handle func(net.Conn, []*hostRoute)) error {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+
+	if hls.m == nil {
+		hls.m = make(map[string]*hostListener)
+	}
+
+	want := make(map[string]bool, len(cfg))
+	for _, ch := range cfg {
+		want[ch.BindAddr] = true
+	}
+
+	for bindAddr, hl := range hls.m {
+		if !want[bindAddr] {
+			klog.Infof("[%s] stop listening on %s", proto, bindAddr)
+			_ = hl.ln.Close()
+			closeHostRoutes(*hl.routes.Load(), nil)
+			delete(hls.m, bindAddr)
+		}
+	}
+
+	var errs []error
+	for _, ch := range cfg {
+		if hl, ok := hls.m[ch.BindAddr]; ok {
+			old := *hl.routes.Load()
+			sock := newSockOptions(ch.Socket)
+			routes := newHostRoutes(hl.key, ch.Rules, sock, old)
+			closeHostRoutes(old, routes)
+			startHostRoutes(routes)
+			hl.routes.Store(&routes)
+			hl.proxy.Store(newProxyAcceptor(ch.AcceptProxyProtocol, ch.TrustedProxies))
+			hl.acl.Store(newACL(ch.Allow, ch.Deny))
+			hl.sock.Store(sock)
+			hl.limiter.configure(hl.key, ch.MaxConns, ch.MaxConnsPerIP, ch.QueueTimeout)
+			continue
+		}
+
+		sock := newSockOptions(ch.Socket)
+		ln, err := sock.listenStream(ch.BindAddr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		hl := &hostListener{ln: ln, key: proto + ":" + ch.BindAddr, limiter: newConnLimiter(), conns: hls.conns}
+		hl.limiter.configure(hl.key, ch.MaxConns, ch.MaxConnsPerIP, ch.QueueTimeout)
+		routes := newHostRoutes(hl.key, ch.Rules, sock, nil)
+		startHostRoutes(routes)
+		hl.routes.Store(&routes)
+		hl.proxy.Store(newProxyAcceptor(ch.AcceptProxyProtocol, ch.TrustedProxies))
+		hl.acl.Store(newACL(ch.Allow, ch.Deny))
+		hl.sock.Store(sock)
+		hls.m[ch.BindAddr] = hl
+		go serveHostListener(hl, handle)
+	}
+
+	return errors.Join(errs...)
+}
+
+func serveHostListener(hl *hostListener, handle func(net.Conn, []*hostRoute)) {
+	for {
+		clientConn, err := hl.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			klog.Errorf("failed to accept client connection: %v", err)
+			continue
+		}
+
+		hl.sock.Load().apply(clientConn)
+		routes, proxy, access := *hl.routes.Load(), hl.proxy.Load(), hl.acl.Load()
+		go func() {
+			done, ok := hl.conns.track(clientConn)
+			if !ok {
+				_ = clientConn.Close()
+				return
+			}
+			defer done()
+
+			conn, err := proxy.accept(clientConn)
+			if err != nil {
+				klog.Errorf("%v", err)
+				_ = clientConn.Close()
+				return
+			}
+			if !admit(hl.key, conn.RemoteAddr()) {
+				_ = clientConn.Close()
+				return
+			}
+			if !access.permits(conn.RemoteAddr()) {
+				deny(hl.key, conn.RemoteAddr())
+				_ = clientConn.Close()
+				return
+			}
+
+			release, ok := hl.limiter.acquire(conn.RemoteAddr())
+			if !ok {
+				klog.Warningf("%s over connection limit, rejected %s", hl.key, conn.RemoteAddr())
+				_ = clientConn.Close()
+				return
+			}
+			defer release()
+			handle(conn, routes)
+		}()
+	}
+}
@@ -0,0 +1,420 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// MuxProxy serves several protocols on one listener, sniffing the first
+// bytes of every connection to pick its route.
+type MuxProxy struct {
+	cfg []config.Mux
+
+	mu        sync.Mutex
+	listeners map[string]*muxListener
+
+	// handlers of the connections sniffed as tls and http
+	https HTTPSProxy
+	http  HTTPProxy
+
+	// conns tracks the accepted connections for the shutdown of a Server
+	conns *connTracker
+}
+
+// muxListener is a running mux listener whose routes can be swapped on
+// reload.
+type muxListener struct {
+	ln      net.Listener
+	key     string
+	routes  atomic.Pointer[muxRoutes]
+	limiter *connLimiter
+}
+
+// muxRoutes is the runtime form of a Mux.
+type muxRoutes struct {
+	sniffTimeout time.Duration
+	proxy        *proxyAcceptor
+	acl          *acl
+	sock         *sockOptions
+
+	tls, http     []*hostRoute
+	ssh, fallback *ipRoute
+	matchers      []muxMatcher
+}
+
+type muxMatcher struct {
+	prefix []byte
+	route  *ipRoute
+}
+
+// muxProtocol is what the first bytes of a connection look like.
+type muxProtocol int
+
+const (
+	muxUnknown muxProtocol = iota
+	muxTLS
+	muxHTTP
+	muxSSH
+	muxProxyHeader
+	muxMatched
+)
+
+// muxSignatures are the first bytes of the protocols a mux knows: a tls
+// handshake record, an http request line and an ssh banner.
+var muxSignatures = []struct {
+	prefix   []byte
+	protocol muxProtocol
+}{
+	{[]byte{0x16, 0x03}, muxTLS},
+	{[]byte("GET "), muxHTTP},
+	{[]byte("HEAD "), muxHTTP},
+	{[]byte("POST "), muxHTTP},
+	{[]byte("PUT "), muxHTTP},
+	{[]byte("DELETE "), muxHTTP},
+	{[]byte("OPTIONS "), muxHTTP},
+	{[]byte("PATCH "), muxHTTP},
+	{[]byte("CONNECT "), muxHTTP},
+	{[]byte("TRACE "), muxHTTP},
+	{[]byte("SSH-"), muxSSH},
+}
+
+var proxyHeaderSignatures = [][]byte{[]byte("PROXY "), proxyV2Signature}
+
+func NewMuxProxy(cfg []config.Mux) *MuxProxy {
+	return &MuxProxy{
+		cfg:       cfg,
+		listeners: make(map[string]*muxListener),
+	}
+}
+
+func (m *MuxProxy) Start() error {
+	return m.Reload(m.cfg)
+}
+
+// Reload makes the running listeners match cfg. Route changes only apply to
+// connections accepted afterwards.
+func (m *MuxProxy) Reload(cfg []config.Mux) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	want := make(map[string]bool, len(cfg))
+	for _, mc := range cfg {
+		want[mc.BindAddr] = true
+	}
+
+	for bindAddr, l := range m.listeners {
+		if !want[bindAddr] {
+			klog.Infof("[mux] stop listening on %s", bindAddr)
+			_ = l.ln.Close()
+			l.routes.Load().close(nil)
+			delete(m.listeners, bindAddr)
+		}
+	}
+
+	var errs []error
+	for _, mc := range cfg {
+		if l, ok := m.listeners[mc.BindAddr]; ok {
+			old := l.routes.Load()
+			routes := newMuxRoutes(mc, old)
+			old.close(routes)
+			routes.start()
+			l.routes.Store(routes)
+			l.limiter.configure(l.key, mc.MaxConns, mc.MaxConnsPerIP, mc.QueueTimeout)
+			continue
+		}
+
+		ln, err := newSockOptions(mc.Socket).listenStream(mc.BindAddr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		l := &muxListener{ln: ln, key: "mux:" + mc.BindAddr, limiter: newConnLimiter()}
+		l.limiter.configure(l.key, mc.MaxConns, mc.MaxConnsPerIP, mc.QueueTimeout)
+		routes := newMuxRoutes(mc, nil)
+		routes.start()
+		l.routes.Store(routes)
+		m.listeners[mc.BindAddr] = l
+		go m.serve(l)
+	}
+
+	m.cfg = cfg
+	return errors.Join(errs...)
+}
+
+func (m *MuxProxy) serve(l *muxListener) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			klog.Errorf("failed to accept connection: %v", err)
+			continue
+		}
+
+		routes := l.routes.Load()
+		routes.sock.apply(conn)
+		go func() {
+			done, ok := m.conns.track(conn)
+			if !ok {
+				_ = conn.Close()
+				return
+			}
+			defer done()
+			m.handleConn(l, conn, routes)
+		}()
+	}
+}
+
+func (m *MuxProxy) handleConn(l *muxListener, conn net.Conn, routes *muxRoutes) {
+	bc := newBufConn(conn, 8192)
+	client := net.Conn(bc)
+
+	// a PROXY header comes first, the client it announces is the one to admit
+	var protocol muxProtocol
+	var matched *ipRoute
+	sniffed := false
+	if routes.proxy != nil && routes.proxy.trusts(conn.RemoteAddr()) {
+		protocol, matched = routes.sniff(bc, true)
+		sniffed = protocol != muxProxyHeader
+		if protocol == muxProxyHeader {
+			_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+			src, dst, err := readProxyHeader(bc.Reader())
+			_ = conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				klog.Errorf("[mux] proxy protocol header from %s: %v", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+			klog.V(2).Infof("[proxy] %s is %s", conn.RemoteAddr(), src)
+			client = &proxiedConn{Conn: bc, src: src, dst: dst}
+		}
+	}
+
+	if !admit(l.key, client.RemoteAddr()) {
+		_ = conn.Close()
+		return
+	}
+	if !routes.acl.permits(client.RemoteAddr()) {
+		deny(l.key, client.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	release, ok := l.limiter.acquire(client.RemoteAddr())
+	if !ok {
+		klog.Warningf("%s over connection limit, rejected %s", l.key, client.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	defer release()
+
+	if !sniffed {
+		protocol, matched = routes.sniff(bc, false)
+	}
+
+	switch {
+	case protocol == muxTLS && len(routes.tls) > 0:
+		m.https.handleConn(client, routes.tls)
+	case protocol == muxHTTP && len(routes.http) > 0:
+		m.http.handleConn(client, routes.http)
+	case protocol == muxSSH && routes.ssh != nil:
+		pipeIPRoute(client, routes.ssh)
+	case protocol == muxMatched:
+		pipeIPRoute(client, matched)
+	case routes.fallback != nil:
+		pipeIPRoute(client, routes.fallback)
+	default:
+		klog.Warningf("[mux] %s has no route for %s", l.key, client.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+// sniff reads from bc until its first bytes tell the protocol, leaving them
+// buffered for the route. A connection that stays silent or ambiguous for
+// the sniff timeout is unknown. PROXY protocol headers are only recognized
+// with proxy set.
+func (r *muxRoutes) sniff(bc *bufConn, proxy bool) (muxProtocol, *ipRoute) {
+	_ = bc.SetReadDeadline(time.Now().Add(r.sniffTimeout))
+	defer func() {
+		_ = bc.SetReadDeadline(time.Time{})
+	}()
+
+	br := bc.Reader()
+	for {
+		data, _ := br.Peek(br.Buffered())
+		protocol, route, more := r.classify(data, proxy, false)
+		if !more {
+			return protocol, route
+		}
+		if _, err := br.Peek(len(data) + 1); err != nil {
+			data, _ = br.Peek(br.Buffered())
+			protocol, route, _ = r.classify(data, proxy, true)
+			return protocol, route
+		}
+	}
+}
+
+// classify matches data against the matchers, then the PROXY header if
+// proxy is set, then the known protocols, the first match winning. more
+// reports that an earlier candidate needs more data to decide, unless final
+// is set and nothing more is coming.
+func (r *muxRoutes) classify(data []byte, proxy, final bool) (protocol muxProtocol, route *ipRoute, more bool) {
+	try := func(prefix []byte) bool {
+		n := min(len(data), len(prefix))
+		if !bytes.Equal(data[:n], prefix[:n]) {
+			return false
+		}
+		if n == len(prefix) {
+			return !more
+		}
+		more = !final
+		return false
+	}
+
+	for _, m := range r.matchers {
+		if try(m.prefix) {
+			return muxMatched, m.route, false
+		}
+	}
+	if proxy {
+		for _, sig := range proxyHeaderSignatures {
+			if try(sig) {
+				return muxProxyHeader, nil, false
+			}
+		}
+	}
+	for _, sig := range muxSignatures {
+		if try(sig.prefix) {
+			return sig.protocol, nil, false
+		}
+	}
+	return muxUnknown, nil, more
+}
+
+// newMuxRoutes compiles cfg, reusing the upstreams of the matching routes in
+// prev so that a reload keeps their state.
+func newMuxRoutes(cfg config.Mux, prev *muxRoutes) *muxRoutes {
+	if prev == nil {
+		prev = &muxRoutes{}
+	}
+
+	sniffTimeout := cfg.SniffTimeout
+	if sniffTimeout <= 0 {
+		sniffTimeout = config.DefaultSniffTimeout
+	}
+
+	sock := newSockOptions(cfg.Socket)
+	r := &muxRoutes{
+		sniffTimeout: sniffTimeout,
+		proxy:        newProxyAcceptor(cfg.AcceptProxyProtocol, cfg.TrustedProxies),
+		acl:          newACL(cfg.Allow, cfg.Deny),
+		sock:         sock,
+		tls:          newHostRoutes("mux:"+cfg.BindAddr+"/tls", cfg.TLS, sock, prev.tls),
+		http:         newHostRoutes("mux:"+cfg.BindAddr+"/http", cfg.HTTP, sock, prev.http),
+	}
+
+	route := func(name string, mr *config.MuxRoute, prev *ipRoute) *ipRoute {
+		if mr == nil {
+			return nil
+		}
+		rule := mr.IPRule
+		rule.BindAddr = cfg.BindAddr
+		if rule.Socket == nil {
+			rule.Socket = cfg.Socket
+		}
+		key := "mux:" + cfg.BindAddr + "/" + name + "->" + targetsKey(rule.Upstreams())
+		return newIPRoute("tcp", portRule{rule: rule, ruleKey: key, rangeKey: key}, prev, nil)
+	}
+
+	r.ssh = route("ssh", cfg.SSH, prev.ssh)
+	r.fallback = route("fallback", cfg.Fallback, prev.fallback)
+	for _, mr := range cfg.Matchers {
+		prefix := []byte(mr.Prefix)
+		if mr.PrefixHex != "" {
+			prefix, _ = hex.DecodeString(mr.PrefixHex)
+		}
+		// broken matchers are reported by config validation, never match everything
+		if len(prefix) == 0 {
+			continue
+		}
+
+		var prevRoute *ipRoute
+		for _, pm := range prev.matchers {
+			if bytes.Equal(pm.prefix, prefix) {
+				prevRoute = pm.route
+			}
+		}
+		name := mr.Prefix
+		if name == "" {
+			name = mr.PrefixHex
+		}
+		r.matchers = append(r.matchers, muxMatcher{prefix: prefix, route: route(name, &mr, prevRoute)})
+	}
+
+	return r
+}
+
+// ipRoutes returns the tcp routes of r.
+func (r *muxRoutes) ipRoutes() []*ipRoute {
+	routes := make([]*ipRoute, 0, len(r.matchers)+2)
+	for _, m := range r.matchers {
+		routes = append(routes, m.route)
+	}
+	for _, route := range []*ipRoute{r.ssh, r.fallback} {
+		if route != nil {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (r *muxRoutes) start() {
+	startHostRoutes(r.tls)
+	startHostRoutes(r.http)
+	for _, route := range r.ipRoutes() {
+		route.start()
+	}
+}
+
+// close stops r after it got replaced by next, which is nil if its listener
+// was removed.
+func (r *muxRoutes) close(next *muxRoutes) {
+	keep := make(map[targetKey]bool)
+	if next != nil {
+		for _, lb := range next.balancers() {
+			for target := range lb.targets() {
+				keep[target] = true
+			}
+		}
+	}
+
+	for _, lb := range r.balancers() {
+		lb.stop(keep)
+	}
+	for _, route := range r.tls {
+		route.certs.stop()
+	}
+}
+
+func (r *muxRoutes) balancers() []*balancer {
+	var lbs []*balancer
+	for _, routes := range [][]*hostRoute{r.tls, r.http} {
+		for _, route := range routes {
+			lbs = append(lbs, route.lb)
+		}
+	}
+	for _, route := range r.ipRoutes() {
+		lbs = append(lbs, route.lb)
+	}
+	return lbs
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestMuxRoutes_Classify(t *testing.T) {
+	routes := newMuxRoutes(config.Mux{
+		Matchers: []config.MuxRoute{
+			{Prefix: "*1\r\n", IPRule: config.IPRule{Target: "127.0.0.1:1"}},
+			{PrefixHex: "0000", IPRule: config.IPRule{Target: "127.0.0.1:2"}},
+		},
+	}, nil)
+
+	tests := []struct {
+		name    string
+		data    string
+		proxy   bool
+		final   bool
+		want    muxProtocol
+		matcher int
+		more    bool
+	}{
+		{name: "empty", data: "", more: true},
+		{name: "empty final", data: "", final: true, want: muxUnknown},
+		{name: "tls", data: "\x16\x03\x01\x02\x00", want: muxTLS},
+		{name: "http", data: "GET / HTTP/1.1\r\n", want: muxHTTP},
+		{name: "partial method", data: "OPTI", more: true},
+		{name: "partial method final", data: "OPTI", final: true, want: muxUnknown},
+		{name: "ssh", data: "SSH-2.0-OpenSSH_9.6\r\n", want: muxSSH},
+		{name: "matcher", data: "*1\r\n$4\r\nPING\r\n", want: muxMatched, matcher: 0},
+		{name: "hex matcher", data: "\x00\x00\x01", want: muxMatched, matcher: 1},
+		{name: "partial matcher", data: "*1", more: true},
+		{name: "proxy header ignored", data: "PROXY TCP4 ", want: muxUnknown},
+		{name: "proxy header", data: "PROXY TCP4 ", proxy: true, want: muxProxyHeader},
+		{name: "proxy v2 header", data: string(proxyV2Signature), proxy: true, want: muxProxyHeader},
+		{name: "unknown", data: "hello", want: muxUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, route, more := routes.classify([]byte(tt.data), tt.proxy, tt.final)
+			if got != tt.want || more != tt.more {
+				t.Fatalf("Expected %v (more %v), got %v (more %v)", tt.want, tt.more, got, more)
+			}
+			if got == muxMatched && route != routes.matchers[tt.matcher].route {
+				t.Errorf("Expected matcher %d", tt.matcher)
+			}
+		})
+	}
+}
+
+func TestMuxProxy(t *testing.T) {
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls"))
+	}))
+	defer tlsTarget.Close()
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http"))
+	}))
+	defer httpTarget.Close()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewMuxProxy([]config.Mux{{
+		BindAddr:     proxyAddr,
+		SniffTimeout: 200 * time.Millisecond,
+		TLS:          []config.HostRule{{Host: "secure.example.com", Target: strings.TrimPrefix(tlsTarget.URL, "https://")}},
+		HTTP:         []config.HostRule{{Host: "web.example.com", Target: strings.TrimPrefix(httpTarget.URL, "http://")}},
+		SSH:          &config.MuxRoute{IPRule: config.IPRule{Target: startTaggedServer(t, "ssh:")}},
+		Matchers: []config.MuxRoute{
+			{Prefix: "*1\r\n", IPRule: config.IPRule{Target: startTaggedServer(t, "redis:")}},
+		},
+		Fallback: &config.MuxRoute{IPRule: config.IPRule{Target: startTaggedServer(t, "fallback:")}},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return net.Dial("tcp", proxyAddr)
+			},
+		},
+	}
+	for url, want := range map[string]string{
+		"https://secure.example.com/": "tls",
+		"http://web.example.com/":     "http",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: expected %q, got %q", url, want, body)
+		}
+	}
+
+	for msg, want := range map[string]string{
+		"SSH-2.0-test\r\n": "ssh:SSH-2.0-test\r\n",
+		"*1\r\n":           "redis:*1\r\n",
+		"hello":            "fallback:hello",
+	} {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		if got := roundTrip(t, conn, msg); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+		conn.Close()
+	}
+}
+
+func TestMuxProxy_SilentClient(t *testing.T) {
+	// a server speaking first, like smtp
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready\r\n"))
+			conn.Close()
+		}
+	}()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewMuxProxy([]config.Mux{{
+		BindAddr:     proxyAddr,
+		SniffTimeout: 100 * time.Millisecond,
+		SSH:          &config.MuxRoute{IPRule: config.IPRule{Target: startTaggedServer(t, "ssh:")}},
+		Fallback:     &config.MuxRoute{IPRule: config.IPRule{Target: greeter.Addr().String()}},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if string(got) != "220 ready\r\n" {
+		t.Errorf("Expected the fallback greeting, got %q", got)
+	}
+}
+
+func TestMuxProxy_ProxyHeader(t *testing.T) {
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewMuxProxy([]config.Mux{{
+		BindAddr:            proxyAddr,
+		AcceptProxyProtocol: true,
+		TrustedProxies:      []string{"127.0.0.1"},
+		Deny:                []string{"192.0.2.1"},
+		SSH:                 &config.MuxRoute{IPRule: config.IPRule{Target: startTaggedServer(t, "ssh:")}},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "PROXY TCP4 192.0.2.2 192.0.2.9 1111 22\r\nSSH-2.0-test\r\n"); got != "ssh:SSH-2.0-test\r\n" {
+		t.Errorf("Expected the header to be consumed, got %q", got)
+	}
+
+	denied, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer denied.Close()
+	denied.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.9 1111 22\r\nSSH-2.0-test\r\n"))
+	denied.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := denied.Read(make([]byte, 64)); err == nil {
+		t.Errorf("Expected the announced client to be denied, read %d bytes", n)
+	}
+}
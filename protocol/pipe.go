@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"errors"
 	"io"
 	"net"
 	"sync/atomic"
@@ -8,30 +9,84 @@ import (
 
 	"k8s.io/klog/v2"
 
+	"github.com/knwgo/yarp/config"
 	"github.com/knwgo/yarp/stat"
 )
 
-func pipe(src net.Conn, dest net.Conn) error {
-	errChan := make(chan error, 1)
-	onClose := func(err error) {
-		_ = dest.Close()
-		_ = src.Close()
+// lingerTimeout is how long a pipe keeps the other direction running after
+// one side shut down its write side, in nanoseconds. Zero is the default.
+var lingerTimeout atomic.Int64
+
+// setLingerTimeout applies the lingerTimeout of the config to new pipes.
+func setLingerTimeout(d time.Duration) {
+	lingerTimeout.Store(int64(d))
+}
+
+func linger() time.Duration {
+	if d := time.Duration(lingerTimeout.Load()); d > 0 {
+		return d
 	}
-	go func() {
-		_, err := io.Copy(src, dest)
+	return config.DefaultLingerTimeout
+}
+
+// closeWrite shuts down the write side of c, sending a FIN to its peer.
+// It returns errors.ErrUnsupported if c cannot be half closed.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// pipeConns runs copyUp, copying src to dest, and copyDown, copying dest to
+// src. Once one of them reaches EOF the write side of its destination is shut
+// down and the other direction keeps running until it finishes too or the
+// linger timeout expires. Both connections are closed on return.
+func pipeConns(src, dest net.Conn, copyUp, copyDown func() error) error {
+	errChan := make(chan error, 2)
+	run := func(copy func() error, to net.Conn) {
+		err := copy()
+		if err == nil {
+			err = closeWrite(to)
+		}
 		errChan <- err
-		onClose(err)
-	}()
-	go func() {
+	}
+	go run(copyUp, dest)
+	go run(copyDown, src)
+
+	err := <-errChan
+	if err == nil {
+		timer := time.NewTimer(linger())
+		select {
+		case err = <-errChan:
+		case <-timer.C:
+			klog.V(2).Infof("[pipe] %s half closed for too long, closing", src.RemoteAddr())
+		}
+		timer.Stop()
+	}
+
+	_ = dest.Close()
+	_ = src.Close()
+	if errors.Is(err, errors.ErrUnsupported) {
+		// a connection that cannot be half closed ends with its first EOF
+		err = nil
+	}
+	return err
+}
+
+func pipe(src net.Conn, dest net.Conn) error {
+	return pipeConns(src, dest, func() error {
 		_, err := io.Copy(dest, src)
-		errChan <- err
-		onClose(err)
-	}()
-	return <-errChan
+		return err
+	}, func() error {
+		_, err := io.Copy(src, dest)
+		return err
+	})
 }
 
 func pipeHost(src net.Conn, targetHost string) {
-	targetConn, err := net.Dial("tcp", targetHost)
+	network, addr := streamNetwork(targetHost)
+	targetConn, err := net.Dial(network, addr)
 	if err != nil {
 		klog.Errorf("dial target host error: %v", err)
 		return
@@ -47,75 +102,158 @@ func pipeHost(src net.Conn, targetHost string) {
 
 type countingWriter struct {
 	io.Writer
-	count       *int64
-	buffered    int64
-	bufferLimit int64
-	onWrite     func(n int64)
+	count        *int64
+	buffered     int64
+	bufferLimit  int64
+	onWrite      func(n int64)
+	onFirstWrite func()
+	throttle     throttle
+	timeouts     *timeoutDir
 }
 
 func (cw *countingWriter) Write(p []byte) (int, error) {
-	n, err := cw.Writer.Write(p)
-	if n > 0 {
-		atomic.AddInt64(cw.count, int64(n))
-		cw.buffered += int64(n)
-		if cw.buffered >= cw.bufferLimit && cw.onWrite != nil {
-			cw.onWrite(cw.buffered)
-			cw.buffered = 0
+	if len(cw.throttle) == 0 {
+		return cw.write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		cw.throttle.wait(len(chunk))
+		n, err := cw.write(chunk)
+		written += n
+		if err != nil {
+			return written, err
 		}
+		p = p[n:]
 	}
+	return written, nil
+}
+
+// flush reports the bytes written since the last report.
+func (cw *countingWriter) flush() {
+	if cw.buffered > 0 && cw.onWrite != nil {
+		cw.onWrite(cw.buffered)
+		cw.buffered = 0
+	}
+}
+
+func (cw *countingWriter) write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.record(int64(n))
 	return n, err
 }
 
-func pipeWithStats(src net.Conn, dest net.Conn, ruleKey string) error {
+// record counts n bytes written to the destination.
+func (cw *countingWriter) record(n int64) {
+	if n <= 0 {
+		return
+	}
+	if cw.onFirstWrite != nil {
+		cw.onFirstWrite()
+		cw.onFirstWrite = nil
+	}
+	atomic.AddInt64(cw.count, n)
+	cw.timeouts.record()
+	cw.buffered += n
+	if cw.buffered >= cw.bufferLimit && cw.onWrite != nil {
+		cw.onWrite(cw.buffered)
+		cw.buffered = 0
+	}
+}
+
+// pipeWithStats pipes src to dest, the connection to up, throttled by bw and
+// ended by timeouts, and feeds the outlier detection of up with whether it
+// answered or reset the connection.
+func pipeWithStats(src net.Conn, dest net.Conn, ruleKey string, up *lease, bw *bandwidth, timeouts *pipeTimeouts) error {
+	target := up.addr
 	stat.GlobalStats.AddConn(ruleKey)
 	defer stat.GlobalStats.RemoveConn(ruleKey)
+	stat.GlobalStats.AddTargetConn(ruleKey, target)
+	defer stat.GlobalStats.RemoveTargetConn(ruleKey, target)
 
-	defer func() {
-		_ = dest.Close()
-		_ = src.Close()
-	}()
+	throttleUp, throttleDown, done := bw.open(src.RemoteAddr())
+	defer done()
 
 	var bytesSrcToDest, bytesDestToSrc int64
-	errChan := make(chan error, 2)
 
-	countingWriterWithStats := func(writer io.Writer, count *int64, isSrcToDest bool) io.Writer {
+	countingWriterWithStats := func(writer io.Writer, count *int64, isSrcToDest bool) *countingWriter {
+		t := throttleDown
+		if isSrcToDest {
+			t = throttleUp
+		}
 		return &countingWriter{
 			Writer:      writer,
 			count:       count,
+			throttle:    t,
+			timeouts:    timeouts.direction(),
 			bufferLimit: 2 * 1024,
 			onWrite: func(n int64) {
 				if isSrcToDest {
 					stat.GlobalStats.AddBytes(ruleKey, 0, n)
+					stat.GlobalStats.AddTargetBytes(ruleKey, target, 0, n)
 				} else {
 					stat.GlobalStats.AddBytes(ruleKey, n, 0)
+					stat.GlobalStats.AddTargetBytes(ruleKey, target, n, 0)
 				}
 			},
 		}
 	}
 
-	go func() {
-		_, err := io.Copy(countingWriterWithStats(dest, &bytesSrcToDest, true), src)
-		errChan <- err
-	}()
-	go func() {
-		_, err := io.Copy(countingWriterWithStats(src, &bytesDestToSrc, false), dest)
-		errChan <- err
-	}()
-
-	return <-errChan
+	// both directions exist before either can find the connection idle
+	upward := countingWriterWithStats(dest, &bytesSrcToDest, true)
+	downward := countingWriterWithStats(src, &bytesDestToSrc, false)
+	downward.onFirstWrite = up.reportSuccess
+	err := pipeConns(src, dest, func() error {
+		err := copyConn(upward, dest, src)
+		upward.flush()
+		return err
+	}, func() error {
+		err := copyConn(downward, src, dest)
+		downward.flush()
+		if atomic.LoadInt64(&bytesDestToSrc) == 0 && isReset(err) {
+			up.reportFailure(err)
+		}
+		return err
+	})
+	if errors.Is(err, errIdleTimeout) || errors.Is(err, errMaxLifetime) {
+		klog.Infof("[pipe] %s -> %s: %v, closing", src.RemoteAddr(), target, err)
+		return nil
+	}
+	return err
 }
 
-func pipeHostWithStats(src net.Conn, targetHost, ruleKey string) {
-	targetConn, err := net.Dial("tcp", targetHost)
+// pipeHostWithStats dials the upstream picked for target, retrying others
+// according to its rule, and pipes src to it. It takes over
+// target.upstream.
+func pipeHostWithStats(src net.Conn, target *targetInfo, ruleKey string) {
+	targetConn, up, err := target.route.dial.dial(target.route.lb, target.upstream, src.RemoteAddr(), target.host)
 	if err != nil {
 		klog.Errorf("dial target host error: %v", err)
+		_ = src.Close()
+		return
+	}
+	defer up.release()
+
+	if err := sendProxyHeader(targetConn, target.route.rule.ProxyProtocol, src, target.host); err != nil {
+		klog.Errorf("send proxy protocol header error: %v", err)
+		_ = targetConn.Close()
+		_ = src.Close()
+		return
+	}
+	if targetConn, err = target.route.dial.secure(targetConn, up.upstream); err != nil {
+		klog.Errorf("secure target host error: %v", err)
+		up.reportFailure(err)
+		_ = src.Close()
 		return
 	}
 
 	_ = targetConn.SetDeadline(time.Time{})
 	_ = src.SetDeadline(time.Time{})
 
-	if err := pipeWithStats(src, targetConn, ruleKey); err != nil {
+	rule := target.route.rule
+	timeouts := newPipeTimeouts(rule.IdleTimeout, rule.MaxLifetime)
+	if err := pipeWithStats(src, targetConn, ruleKey, up, target.route.bw, timeouts); err != nil {
 		klog.Errorf("pipe target host error: %v", err)
 	}
 }
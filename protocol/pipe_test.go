@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
+)
+
+// startTCPProxy runs a TcpProxy for rule on a free loopback port
+func startTCPProxy(t *testing.T, rule config.IPRule) string {
+	t.Helper()
+	rule.BindAddr = freeTCPAddr(t)
+	proxy := NewTcpProxy([]config.IPRule{rule})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { proxy.Reload(nil) })
+	return rule.BindAddr
+}
+
+func TestPipe_HalfClose(t *testing.T) {
+	// the target answers only once the client finished sending
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				data, _ := io.ReadAll(c)
+				fmt.Fprintf(c, "got %d bytes", len(data))
+			}(conn)
+		}
+	}()
+
+	proxyAddr := startTCPProxy(t, config.IPRule{Target: ln.Addr().String()})
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close write side: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(resp) != "got 100 bytes" {
+		t.Errorf("Expected %q after half close, got %q", "got 100 bytes", resp)
+	}
+
+	// bytes below the reporting threshold are flushed when the pipe ends
+	key := "tcp:" + proxyAddr + "->" + ln.Addr().String()
+	rs := stat.GlobalStats.Snapshot().RuleStats[key]
+	if rs.BytesOut != 100 || rs.BytesIn != uint64(len(resp)) {
+		t.Errorf("Expected 100 bytes out and %d in, got %d and %d", len(resp), rs.BytesOut, rs.BytesIn)
+	}
+}
+
+func TestPipe_LingerTimeout(t *testing.T) {
+	setLingerTimeout(100 * time.Millisecond)
+	defer setLingerTimeout(0)
+
+	// the target never answers nor closes
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer ln.Close()
+	held := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			held <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-held:
+			conn.Close()
+		default:
+		}
+	}()
+
+	conn, err := net.Dial("tcp", startTCPProxy(t, config.IPRule{Target: ln.Addr().String()}))
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close write side: %v", err)
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the proxy to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the connection to close after the linger timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,309 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types, see the spec at
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	pp2TypeAuthority = 0x02
+)
+
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+// proxyHeader builds the PROXY protocol header announcing a connection from
+// src to dst. network is "tcp" or "udp", the latter needs v2. tlvs are only
+// sent with v2.
+func proxyHeader(version, network string, src, dst net.Addr, tlvs []proxyTLV) ([]byte, error) {
+	srcIP, srcPort, srcOK := addrIPPort(src)
+	dstIP, dstPort, dstOK := addrIPPort(dst)
+	ok := srcOK && dstOK
+	v4 := ok && srcIP.To4() != nil && dstIP.To4() != nil
+
+	switch version {
+	case config.ProxyProtocolV1:
+		if network != "tcp" {
+			return nil, fmt.Errorf("proxy protocol v1 does not support %s", network)
+		}
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto, ip := "TCP6", func(ip net.IP) string { return netip.AddrFrom16([16]byte(ip.To16())).String() }
+		if v4 {
+			proto, ip = "TCP4", net.IP.String
+		}
+		return []byte("PROXY " + proto + " " + ip(srcIP) + " " + ip(dstIP) + " " +
+			strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n"), nil
+
+	case config.ProxyProtocolV2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		if !ok {
+			// LOCAL command, the receiver uses the real connection endpoints
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+
+		var body bytes.Buffer
+		fam := byte(0x20) // AF_INET6
+		if v4 {
+			fam = 0x10 // AF_INET
+			body.Write(srcIP.To4())
+			body.Write(dstIP.To4())
+		} else {
+			body.Write(srcIP.To16())
+			body.Write(dstIP.To16())
+		}
+		_ = binary.Write(&body, binary.BigEndian, uint16(srcPort))
+		_ = binary.Write(&body, binary.BigEndian, uint16(dstPort))
+		if network == "udp" {
+			fam |= 0x02 // DGRAM
+		} else {
+			fam |= 0x01 // STREAM
+		}
+
+		for _, tlv := range tlvs {
+			body.WriteByte(tlv.typ)
+			_ = binary.Write(&body, binary.BigEndian, uint16(len(tlv.value)))
+			body.Write(tlv.value)
+		}
+		if body.Len() > 0xffff {
+			return nil, fmt.Errorf("proxy protocol header too large")
+		}
+
+		buf.Write([]byte{0x21, fam})
+		_ = binary.Write(&buf, binary.BigEndian, uint16(body.Len()))
+		buf.Write(body.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unknown proxy protocol version %q", version)
+}
+
+// sendProxyHeader writes the PROXY protocol header for client to dest, the
+// connection to its upstream, if version is set. authority is the host name
+// the client asked for, sent as a TLV with v2 as is the tls session and
+// client certificate of a terminated client.
+func sendProxyHeader(dest net.Conn, version string, client net.Conn, authority string) error {
+	if version == "" {
+		return nil
+	}
+
+	var tlvs []proxyTLV
+	if authority != "" {
+		tlvs = append(tlvs, proxyTLV{pp2TypeAuthority, []byte(authority)})
+	}
+	if tlsConn, ok := client.(*tls.Conn); ok {
+		tlvs = append(tlvs, tlsTLVs(tlsConn.ConnectionState())...)
+	}
+	header, err := proxyHeader(version, "tcp", client.RemoteAddr(), client.LocalAddr(), tlvs)
+	if err != nil {
+		return err
+	}
+	_, err = dest.Write(header)
+	return err
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, a.IP != nil
+	}
+	return nil, 0, false
+}
+
+// proxyAcceptor reads the PROXY protocol header a downstream load balancer
+// puts in front of every connection. A nil proxyAcceptor accepts connections
+// as they are.
+type proxyAcceptor struct {
+	trusted []netip.Prefix
+}
+
+// proxyHeaderTimeout bounds reading the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+func newProxyAcceptor(accept bool, trusted []string) *proxyAcceptor {
+	if !accept {
+		return nil
+	}
+
+	return &proxyAcceptor{trusted: parsePrefixes(trusted)}
+}
+
+// trusts reports whether addr may announce the client, nobody without a
+// trusted list.
+func (a *proxyAcceptor) trusts(addr net.Addr) bool {
+	return containsAddr(a.trusted, addr)
+}
+
+// accept consumes the PROXY protocol header of conn if it comes from a
+// trusted source and returns a conn reporting the client announced by it.
+func (a *proxyAcceptor) accept(conn net.Conn) (net.Conn, error) {
+	if a == nil || !a.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	bc := newBufConn(conn, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	src, dst, err := readProxyHeader(bc.Reader())
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol header from %s: %w", conn.RemoteAddr(), err)
+	}
+
+	klog.V(2).Infof("[proxy] %s is %s", conn.RemoteAddr(), src)
+	return &proxiedConn{Conn: bc, src: src, dst: dst}, nil
+}
+
+// proxiedConn is a connection relayed by a load balancer, reporting the
+// endpoints announced in its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	src, dst net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.src == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.src
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.dst == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.dst
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header off r. The returned
+// addresses are nil for UNKNOWN and LOCAL headers, which mean the connection
+// is the load balancer's own.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("missing header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// the longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddrPort(net.JoinHostPort(ip, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 address: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(addr), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", head[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch head[12] & 0x0f {
+	case 0x00: // LOCAL
+		return nil, nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", head[12]&0x0f)
+	}
+
+	var ipLen int
+	switch head[13] >> 4 {
+	case 0x1: // AF_INET
+		ipLen = 4
+	case 0x2: // AF_INET6
+		ipLen = 16
+	default:
+		// AF_UNSPEC and AF_UNIX carry nothing we can report
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("short v2 address block")
+	}
+
+	srcIP, dstIP := net.IP(body[:ipLen]), net.IP(body[ipLen:2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
@@ -0,0 +1,274 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tests := []struct {
+		name    string
+		version string
+		network string
+		src     net.Addr
+		dst     net.Addr
+		tlvs    []proxyTLV
+		want    []byte
+	}{
+		{
+			name:    "v1 tcp4",
+			version: config.ProxyProtocolV1,
+			network: "tcp",
+			src:     v4src,
+			dst:     v4dst,
+			want:    []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"),
+		},
+		{
+			name:    "v1 mixed families",
+			version: config.ProxyProtocolV1,
+			network: "tcp",
+			src:     v4src,
+			dst:     v6dst,
+			want:    []byte("PROXY TCP6 ::ffff:192.168.0.1 2001:db8::1 56324 443\r\n"),
+		},
+		{
+			name:    "v1 unknown",
+			version: config.ProxyProtocolV1,
+			network: "tcp",
+			src:     &net.UnixAddr{Name: "/tmp/a", Net: "unix"},
+			dst:     v4dst,
+			want:    []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v2 tcp4 with authority",
+			version: config.ProxyProtocolV2,
+			network: "tcp",
+			src:     v4src,
+			dst:     v4dst,
+			tlvs:    []proxyTLV{{pp2TypeAuthority, []byte("a.com")}},
+			want: append(append([]byte{}, proxyV2Signature...),
+				0x21, 0x11, 0x00, 12+3+5,
+				192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb,
+				0x02, 0x00, 0x05, 'a', '.', 'c', 'o', 'm'),
+		},
+		{
+			name:    "v2 udp4",
+			version: config.ProxyProtocolV2,
+			network: "udp",
+			src:     &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+			dst:     &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53},
+			want: append(append([]byte{}, proxyV2Signature...),
+				0x21, 0x12, 0x00, 12,
+				10, 0, 0, 1, 10, 0, 0, 2, 0x00, 0x35, 0x00, 0x35),
+		},
+		{
+			name:    "v2 local",
+			version: config.ProxyProtocolV2,
+			network: "tcp",
+			src:     nil,
+			dst:     v4dst,
+			want:    append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proxyHeader(tt.version, tt.network, tt.src, tt.dst, tt.tlvs)
+			if err != nil {
+				t.Fatalf("proxyHeader() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("proxyHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := proxyHeader(config.ProxyProtocolV1, "udp", v4src, v4dst, nil); err == nil {
+		t.Error("Expected v1 to refuse udp")
+	}
+}
+
+func TestTcpProxy_SendProxyProtocol(t *testing.T) {
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer targetListener.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := targetListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr:      proxyAddr,
+		Target:        targetListener.Addr().String(),
+		ProxyProtocol: config.ProxyProtocolV1,
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	_, port, _ := net.SplitHostPort(proxyAddr)
+	want := "PROXY TCP4 127.0.0.1 127.0.0.1 " + strconv.Itoa(local.Port) + " " + port + "\r\n"
+
+	select {
+	case line := <-lines:
+		if line != want {
+			t.Errorf("Expected header %q, got %q", want, line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Target got no proxy protocol header")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	v2, err := proxyHeader(config.ProxyProtocolV2, "tcp", src, dst, []proxyTLV{{pp2TypeAuthority, []byte("a.com")}})
+	if err != nil {
+		t.Fatalf("proxyHeader() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		wantSrc string
+		wantErr bool
+	}{
+		{name: "v1", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"), wantSrc: "1.2.3.4:1111"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{name: "v1 bad port", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 x 2222\r\n"), wantErr: true},
+		{name: "v2", input: v2, wantSrc: "[2001:db8::1]:1234"},
+		{name: "v2 local", input: append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)},
+		{name: "missing", input: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.input, "payload"...)))
+			gotSrc, _, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := ""
+			if gotSrc != nil {
+				got = gotSrc.String()
+			}
+			if got != tt.wantSrc {
+				t.Errorf("readProxyHeader() src = %q, want %q", got, tt.wantSrc)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("Expected the header to be consumed, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyAcceptor_Trusts(t *testing.T) {
+	a := newProxyAcceptor(true, []string{"10.0.0.0/8", "192.168.1.1"})
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+	}
+	for _, tt := range tests {
+		if got := a.trusts(&net.TCPAddr{IP: net.ParseIP(tt.ip)}); got != tt.want {
+			t.Errorf("trusts(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if newProxyAcceptor(false, nil) != nil {
+		t.Error("Expected no acceptor when disabled")
+	}
+	if newProxyAcceptor(true, nil).trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("Expected an empty list to trust nobody")
+	}
+}
+
+// TestTcpProxy_RelayProxyProtocol checks that the client announced by a
+// downstream load balancer is what yarp announces to the target.
+func TestTcpProxy_RelayProxyProtocol(t *testing.T) {
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer targetListener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := targetListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr:            proxyAddr,
+		Target:              targetListener.Addr().String(),
+		ProxyProtocol:       config.ProxyProtocolV1,
+		AcceptProxyProtocol: true,
+		TrustedProxies:      []string{"127.0.0.0/8"},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	header := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"
+	conn.Write([]byte(header + "hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	defer conn.Close()
+
+	select {
+	case got := <-received:
+		if got != header+"hello" {
+			t.Errorf("Expected target to get %q, got %q", header+"hello", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Target got nothing")
+	}
+}
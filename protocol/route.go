@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"strings"
@@ -11,12 +12,228 @@ import (
 	"github.com/knwgo/yarp/config"
 )
 
+// errNoHost means no rule matches the requested host.
+var errNoHost = errors.New("no host found")
+
 type targetInfo struct {
-	url      *url.URL
+	url       *url.URL
 	wsEnabled bool
+
+	// host is the matched host name, route its rule and upstream the
+	// acquired first pick for the connection, nil if denied is set.
+	host     string
+	denied   bool
+	route    *hostRoute
+	upstream *lease
+}
+
+// hostRoute is the runtime form of a HostRule.
+type hostRoute struct {
+	rule    config.HostRule
+	targets string
+	lb      *balancer
+	dial    dialPolicy
+	acl     *acl
+	bw      *bandwidth
+	// certs is set if the rule terminates tls
+	certs *certificates
+}
+
+// newHostRoutes compiles the rules of the listener named listener, reusing
+// the upstreams of the matching rule in prev so that a reload keeps their
+// state.
+func newHostRoutes(listener string, rules []config.HostRule, sock *sockOptions, prev []*hostRoute) []*hostRoute {
+	old := make(map[string]*hostRoute, len(prev))
+	for _, r := range prev {
+		old[r.rule.Host] = r
+	}
+
+	routes := make([]*hostRoute, 0, len(rules))
+	for _, rule := range rules {
+		var prevLB *balancer
+		var prevBW *bandwidth
+		if r, ok := old[rule.Host]; ok {
+			prevLB, prevBW = r.lb, r.bw
+		}
+
+		certs, err := loadCertificates(listener+"/"+rule.Host, rule)
+		if err != nil {
+			klog.Errorf("[https] certificates of %s: %v", rule.Host, err)
+		}
+
+		upstreams := rule.Upstreams()
+		targets := targetsKey(upstreams)
+		routes = append(routes, &hostRoute{
+			rule:    rule,
+			targets: targets,
+			lb:      newBalancer(listener+"/"+rule.Host+"->"+targets, rule.Strategy, upstreams, prevLB),
+			dial:    newDialPolicy(rule.ConnectTimeout, rule.Retries, rule.RetryBackoff, sock, newUpstreamTLS(rule.UpstreamTLS)),
+			acl:     newACL(rule.Allow, rule.Deny),
+			bw:      newBandwidth(rule.Bandwidth, prevBW),
+			certs:   certs,
+		})
+	}
+
+	return routes
 }
 
-func getTargetUrl(srcHostPort string, rules []config.HostRule) (*targetInfo, error) {
+// startHostRoutes starts the health checks and outlier detection of routes
+// and the watching of their certificates.
+func startHostRoutes(routes []*hostRoute) {
+	for _, r := range routes {
+		r.lb.start(r.rule.HealthCheck, r.rule.Outlier, "tcp", r.dial.sock)
+		r.certs.start()
+	}
+}
+
+// closeHostRoutes stops routes that got replaced by next, which is nil if
+// their listener was removed.
+func closeHostRoutes(routes []*hostRoute, next []*hostRoute) {
+	keep := make(map[targetKey]bool)
+	for _, r := range next {
+		for target := range r.lb.targets() {
+			keep[target] = true
+		}
+	}
+
+	for _, r := range routes {
+		r.lb.stop(keep)
+		r.certs.stop()
+	}
+}
+
+// ipRoute is the runtime form of an IPRule.
+type ipRoute struct {
+	network string
+	rule    config.IPRule
+	ruleKey string
+	lb      *balancer
+	// sharedLB is set if lb is the balancer of another port of the range,
+	// whose route starts it
+	sharedLB bool
+	dial     dialPolicy
+	sock     *sockOptions
+	proxy    *proxyAcceptor
+	acl      *acl
+	limiter  *connLimiter
+	bw       *bandwidth
+}
+
+// portRule is a rule bound to a single port, expanded from a rule that may
+// bind a port range. Connections count towards the stats of ruleKey, the
+// range rule or, with PerPortStats, the port itself. Limits and bandwidth
+// are shared by all ports of a range and reported under rangeKey, and so is
+// the balancer of ports that forward to the same targets, with its health
+// checks and outlier detection.
+type portRule struct {
+	rule     config.IPRule
+	ruleKey  string
+	rangeKey string
+}
+
+// expandIPRules expands cfg into one portRule per bound port. Rules that do
+// not expand, which config validation reports, are skipped with an error.
+func expandIPRules(proto string, cfg []config.IPRule) ([]portRule, error) {
+	var rules []portRule
+	var errs []error
+	for _, rule := range cfg {
+		ports, err := rule.Expand()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", proto, rule.BindAddr, err))
+			continue
+		}
+
+		rangeKey := proto + ":" + rule.BindAddr + "->" + targetsKey(rule.Upstreams())
+		for _, port := range ports {
+			ruleKey := rangeKey
+			if rule.PerPortStats && len(ports) > 1 {
+				ruleKey = proto + ":" + port.BindAddr + "->" + targetsKey(port.Upstreams())
+			}
+			rules = append(rules, portRule{rule: port, ruleKey: ruleKey, rangeKey: rangeKey})
+		}
+	}
+	return rules, errors.Join(errs...)
+}
+
+// newIPRoute builds the route of pr, reusing the state of prev, the route it
+// replaces on its listener. sibling is the route of another port of the same
+// range, whose limiter and bandwidth pr shares, and its balancer if both
+// forward to the same targets.
+func newIPRoute(proto string, pr portRule, prev, sibling *ipRoute) *ipRoute {
+	rule := pr.rule
+	targets := rule.Upstreams()
+
+	var prevLB *balancer
+	var prevBW *bandwidth
+	limiter := newConnLimiter()
+	if prev != nil {
+		prevLB, prevBW = prev.lb, prev.bw
+		limiter = prev.limiter
+	}
+
+	var bw *bandwidth
+	if sibling != nil {
+		limiter, bw = sibling.limiter, sibling.bw
+	} else {
+		limiter.configure(pr.rangeKey, rule.MaxConns, rule.MaxConnsPerIP, rule.QueueTimeout)
+		bw = newBandwidth(rule.Bandwidth, prevBW)
+	}
+
+	var lb *balancer
+	shared := sibling != nil && targetsKey(sibling.rule.Upstreams()) == targetsKey(targets)
+	if shared {
+		lb = sibling.lb
+	} else {
+		lb = newBalancer(pr.rangeKey, rule.Strategy, targets, prevLB)
+	}
+
+	sock := newSockOptions(rule.Socket)
+	return &ipRoute{
+		network:  proto,
+		rule:     rule,
+		ruleKey:  pr.ruleKey,
+		lb:       lb,
+		sharedLB: shared,
+		dial:     newDialPolicy(rule.ConnectTimeout, rule.Retries, rule.RetryBackoff, sock, newUpstreamTLS(rule.UpstreamTLS)),
+		sock:     sock,
+		proxy:    newProxyAcceptor(rule.AcceptProxyProtocol, rule.TrustedProxies),
+		acl:      newACL(rule.Allow, rule.Deny),
+		limiter:  limiter,
+		bw:       bw,
+	}
+}
+
+func (r *ipRoute) start() {
+	if !r.sharedLB {
+		r.lb.start(r.rule.HealthCheck, r.rule.Outlier, r.network, r.sock)
+	}
+}
+
+// close stops r after it got replaced by next, which is nil if its listener
+// was removed. The ports of a range sharing a balancer all stop it, which
+// only has an effect the first time.
+func (r *ipRoute) close(next *ipRoute) {
+	var keep map[targetKey]bool
+	if next != nil {
+		keep = next.lb.targets()
+	}
+	r.lb.stop(keep)
+}
+
+// targetsKey names the targets of a rule in its stats key.
+func targetsKey(targets []config.Target) string {
+	addrs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		addrs = append(addrs, t.Addr)
+	}
+	return strings.Join(addrs, ",")
+}
+
+// getTargetUrl matches srcHostPort against routes and picks the upstream for
+// a new connection from client. The picked upstream must be released by the
+// caller once the connection is done, or handed to pipeHostWithStats. No
+// upstream is picked if the rule denies client.
+func getTargetUrl(srcHostPort string, routes []*hostRoute, client net.Addr) (*targetInfo, error) {
 	var host string
 	var err error
 
@@ -25,36 +242,50 @@ func getTargetUrl(srcHostPort string, rules []config.HostRule) (*targetInfo, err
 		host = srcHostPort
 	}
 
-	var target string
-	var wsEnabled bool
+	var matched *hostRoute
 
-	for _, rule := range rules {
-		if len(rule.Host) == 0 || len(rule.Target) == 0 {
-			klog.Fatal("host or target host are empty")
+	for _, route := range routes {
+		rule := route.rule
+		// broken rules are reported by config validation, never fail a request on them
+		if len(rule.Host) == 0 || len(route.lb.upstreams) == 0 {
+			continue
 		}
 
 		if rule.Host[0] == '*' {
 			if len(rule.Host) < 2 {
-				klog.Fatalf("invalid host format: %v", rule.Host)
+				continue
 			}
 
 			if strings.HasSuffix(host, rule.Host[1:]) {
-				target = rule.Target
-				wsEnabled = rule.Ws != nil && *rule.Ws
+				matched = route
 				break
 			}
 		} else {
 			if host == rule.Host {
-				target = rule.Target
-				wsEnabled = rule.Ws != nil && *rule.Ws
+				matched = route
 				break
 			}
 		}
 	}
 
-	if len(target) == 0 {
-		return nil, errors.New("no host found")
+	if matched == nil {
+		return nil, errNoHost
+	}
+
+	if !matched.acl.permits(client) {
+		return &targetInfo{host: host, denied: true, route: matched}, nil
+	}
+
+	up := matched.lb.pick(client, host)
+	if up == nil {
+		return nil, errors.New("no upstream available")
 	}
 
-	return &targetInfo{url: &url.URL{Host: target}, wsEnabled: wsEnabled}, nil
+	return &targetInfo{
+		url:       &url.URL{Host: up.addr},
+		wsEnabled: matched.rule.Ws != nil && *matched.rule.Ws,
+		host:      host,
+		route:     matched,
+		upstream:  up,
+	}, nil
 }
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/acme"
+	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/guard"
+)
+
+// Server runs every proxy described by a YARPConfig and keeps them in sync
+// with it across config reloads.
+type Server struct {
+	mu     sync.Mutex
+	closed bool
+
+	tcp   *TcpProxy
+	udp   *UdpProxy
+	http  *HTTPProxy
+	https *HTTPSProxy
+	mux   *MuxProxy
+
+	// conns are the connections accepted by all proxies but udp
+	conns *connTracker
+}
+
+func NewServer() *Server {
+	s := &Server{
+		tcp:   NewTcpProxy(nil),
+		udp:   NewUdpProxy(nil),
+		http:  &HTTPProxy{},
+		https: &HTTPSProxy{},
+		mux:   NewMuxProxy(nil),
+		conns: newConnTracker(),
+	}
+	s.tcp.conns = s.conns
+	s.http.listeners.conns = s.conns
+	s.https.listeners.conns = s.conns
+	s.mux.conns = s.conns
+	return s
+}
+
+// Apply starts, stops and updates listeners so that they match cfg. Piped
+// connections are never touched, rule changes only affect new connections.
+func (s *Server) Apply(cfg config.YARPConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("server is shutting down")
+	}
+
+	guard.Global.Configure(cfg.Guard)
+	setLingerTimeout(cfg.LingerTimeout)
+
+	var errs []error
+	if err := s.tcp.Reload(ruleList(cfg.TCP)); err != nil {
+		errs = append(errs, fmt.Errorf("tcp: %w", err))
+	}
+	if err := s.udp.Reload(ruleList(cfg.UDP)); err != nil {
+		errs = append(errs, fmt.Errorf("udp: %w", err))
+	}
+	if err := s.http.Reload(ruleList(cfg.Http)); err != nil {
+		errs = append(errs, fmt.Errorf("http: %w", err))
+	}
+	if err := s.https.Reload(ruleList(cfg.Https)); err != nil {
+		errs = append(errs, fmt.Errorf("https: %w", err))
+	}
+	if err := s.mux.Reload(ruleList(cfg.Mux)); err != nil {
+		errs = append(errs, fmt.Errorf("mux: %w", err))
+	}
+	if err := acme.Global.Configure(cfg.ACME, acmeHosts(cfg)); err != nil {
+		errs = append(errs, fmt.Errorf("acme: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Shutdown stops accepting on every listener and waits for in-flight
+// connections to finish. Once ctx expires whatever is still running gets
+// closed. UDP sessions have no end to wait for and are closed right away.
+// Byte counters are flushed into GlobalStats either way.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	_ = s.tcp.Reload(nil)
+	_ = s.http.Reload(nil)
+	_ = s.https.Reload(nil)
+	_ = s.mux.Reload(nil)
+	_ = acme.Global.Configure(nil, nil)
+
+	s.udp.Shutdown()
+
+	err := s.conns.wait(ctx)
+	if err != nil {
+		klog.Warningf("[shutdown] drain timeout, closing %d connections", s.conns.count())
+		s.conns.closeAll()
+
+		// give the pipes a moment to return and record their final stats
+		graceCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = s.conns.wait(graceCtx)
+		cancel()
+	}
+	return err
+}
+
+// acmeHosts lists the hosts of the tls rules with acme set.
+func acmeHosts(cfg config.YARPConfig) []string {
+	var hosts []string
+	add := func(rules []config.HostRule) {
+		for _, r := range rules {
+			if r.ACME && !slices.Contains(hosts, r.Host) {
+				hosts = append(hosts, r.Host)
+			}
+		}
+	}
+	for _, h := range ruleList(cfg.Https) {
+		add(h.Rules)
+	}
+	for _, m := range ruleList(cfg.Mux) {
+		add(m.TLS)
+	}
+	return hosts
+}
+
+func ruleList[T any](rules *[]T) []T {
+	if rules == nil {
+		return nil
+	}
+	return *rules
+}
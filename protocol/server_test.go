@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// TestServer_ShutdownDrains tests that shutdown stops accepting but waits for
+// in-flight connections to finish
+func TestServer_ShutdownDrains(t *testing.T) {
+	targetAddr := startTaggedServer(t, "t:")
+	proxyAddr := freeTCPAddr(t)
+
+	srv := NewServer()
+	err := srv.Apply(config.YARPConfig{
+		TCP: &[]config.IPRule{{BindAddr: proxyAddr, Target: targetAddr}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	if got := roundTrip(t, conn, "a"); got != "t:a" {
+		t.Fatalf("Expected %q, got %q", "t:a", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", proxyAddr, time.Second); err == nil {
+		c.Close()
+		t.Errorf("Expected listener to be closed during shutdown")
+	}
+
+	if got := roundTrip(t, conn, "b"); got != "t:b" {
+		t.Errorf("In-flight connection should keep working while draining, got %q", got)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the connection finished: %v", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the connection finished")
+	}
+
+	if err := srv.Apply(config.YARPConfig{}); err == nil {
+		t.Errorf("Expected Apply to fail after shutdown")
+	}
+}
+
+// TestServer_ShutdownTimeout tests that connections still running when the
+// drain timeout expires are closed
+func TestServer_ShutdownTimeout(t *testing.T) {
+	targetAddr := startTaggedServer(t, "t:")
+	proxyAddr := freeTCPAddr(t)
+
+	srv := NewServer()
+	err := srv.Apply(config.YARPConfig{
+		TCP: &[]config.IPRule{{BindAddr: proxyAddr, Target: targetAddr}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		t.Errorf("Expected drain timeout error")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected connection to be closed after drain timeout")
+	}
+}
+
+// TestServer_ShutdownClosesUDPSessions tests that a live udp session does not
+// hold the shutdown until it goes idle
+func TestServer_ShutdownClosesUDPSessions(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	defer target.Close()
+
+	srv := NewServer()
+	err = srv.Apply(config.YARPConfig{
+		UDP: &[]config.IPRule{{BindAddr: "127.0.0.1:0", Target: target.LocalAddr().String()}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+
+	l := srv.udp.listeners["127.0.0.1:0"]
+	client, err := net.Dial("udp", l.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+	deadline := time.Now().Add(3 * time.Second)
+	for l.sessions.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.sessions.Load() != 1 {
+		t.Fatal("Expected a session for the client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Shutdown waited %s for the udp session", took)
+	}
+	if n := l.sessions.Load(); n != 0 {
+		t.Errorf("Expected the session to be closed, %d left", n)
+	}
+}
+
+// TestConnTracker_RefusesAfterShutdown tests that a connection accepted right
+// before the shutdown is not tracked once the drain started
+func TestConnTracker_RefusesAfterShutdown(t *testing.T) {
+	ct := newConnTracker()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done, ok := ct.track(a)
+	if !ok {
+		t.Fatal("Expected the connection to be tracked")
+	}
+
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ct.wait(expired); err == nil {
+		t.Fatal("Expected the drain to time out while a connection is tracked")
+	}
+	if _, ok := ct.track(b); ok {
+		t.Error("Expected no connection to be tracked once the drain started")
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- ct.wait(context.Background())
+	}()
+
+	done()
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Errorf("Expected the drain to finish, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after the last connection finished")
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"net"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// sockOptions applies the SocketOptions of a rule to its sockets. A nil
+// *sockOptions keeps the defaults.
+type sockOptions struct {
+	cfg    config.SocketOptions
+	source net.IP
+}
+
+// fastOpenQueue is the TCP Fast Open queue length of a listener.
+const fastOpenQueue = 256
+
+func newSockOptions(cfg *config.SocketOptions) *sockOptions {
+	if cfg == nil {
+		return nil
+	}
+	return &sockOptions{cfg: *cfg, source: net.ParseIP(cfg.SourceAddr)}
+}
+
+// listenConfig returns the ListenConfig binding a listener.
+func (o *sockOptions) listenConfig() *net.ListenConfig {
+	if o == nil || !o.controlsListener() {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: o.control(true)}
+}
+
+func (o *sockOptions) controlsListener() bool {
+	return o.cfg.ReusePort || o.cfg.FastOpen || o.cfg.TOS != 0
+}
+
+// dialer returns the Dialer connecting to a target over network.
+func (o *sockOptions) dialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if o == nil {
+		return d
+	}
+
+	d.KeepAlive = o.cfg.KeepAlive
+	if o.cfg.FastOpen || o.cfg.TOS != 0 {
+		d.Control = o.control(false)
+	}
+	if o.source != nil && network != "unix" {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: o.source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: o.source}
+		}
+	}
+	return d
+}
+
+// apply tunes conn, an accepted or dialed connection or a udp listener.
+func (o *sockOptions) apply(conn any) {
+	if o == nil {
+		return
+	}
+
+	type buffered interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	}
+	if c, ok := conn.(buffered); ok {
+		if o.cfg.RecvBuffer > 0 {
+			_ = c.SetReadBuffer(o.cfg.RecvBuffer)
+		}
+		if o.cfg.SendBuffer > 0 {
+			_ = c.SetWriteBuffer(o.cfg.SendBuffer)
+		}
+	}
+
+	if c, ok := conn.(*net.TCPConn); ok {
+		if o.cfg.NoDelay != nil {
+			_ = c.SetNoDelay(*o.cfg.NoDelay)
+		}
+		if o.cfg.KeepAlive < 0 {
+			_ = c.SetKeepAlive(false)
+		} else if o.cfg.KeepAlive > 0 {
+			_ = c.SetKeepAlive(true)
+			_ = c.SetKeepAlivePeriod(o.cfg.KeepAlive)
+		}
+	}
+}
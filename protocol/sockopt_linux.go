@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control sets the raw socket options of a listener, or with listen unset
+// of a connection dialed to a target, before it is bound.
+func (o *sockOptions) control(listen bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = o.setsockopt(int(fd), network, listen)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+func (o *sockOptions) setsockopt(fd int, network string, listen bool) error {
+	if network == "unix" {
+		return nil
+	}
+
+	if listen && o.cfg.ReusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+	}
+
+	if o.cfg.FastOpen && strings.HasPrefix(network, "tcp") {
+		var err error
+		if listen {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueue)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.cfg.TOS != 0 {
+		if strings.HasSuffix(network, "6") {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.cfg.TOS); err != nil {
+				return err
+			}
+			// a dual stack socket sends ipv4 traffic too, which may fail
+			// on v6only sockets
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, o.cfg.TOS)
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, o.cfg.TOS); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func sockoptInt(t *testing.T, conn interface {
+	SyscallConn() (syscall.RawConn, error)
+}, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("Failed to get raw conn: %v", err)
+	}
+	var v int
+	var gerr error
+	if err := raw.Control(func(fd uintptr) { v, gerr = unix.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatalf("Failed to control socket: %v", err)
+	}
+	if gerr != nil {
+		t.Fatalf("Failed to get socket option: %v", gerr)
+	}
+	return v
+}
+
+func TestSockOptions_Listener(t *testing.T) {
+	sock := newSockOptions(&config.SocketOptions{ReusePort: true, TOS: 0xb8})
+
+	ln, err := sock.listenConfig().Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// SO_REUSEPORT lets a second listener share the port
+	ln2, err := sock.listenConfig().Listen(context.Background(), "tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected reusePort to allow a second listener: %v", err)
+	}
+	ln2.Close()
+
+	if tos := sockoptInt(t, ln.(*net.TCPListener), unix.IPPROTO_IP, unix.IP_TOS); tos != 0xb8 {
+		t.Errorf("Expected tos 0xb8 on the listener, got %#x", tos)
+	}
+}
+
+func TestSockOptions_Dial(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	noDelay := false
+	sock := newSockOptions(&config.SocketOptions{
+		NoDelay:    &noDelay,
+		RecvBuffer: 256 * 1024,
+		TOS:        0x20,
+		SourceAddr: "127.0.0.1",
+	})
+	conn, err := sock.dialer("tcp", time.Second).Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	sock.apply(conn)
+
+	tc := conn.(*net.TCPConn)
+	if ip := tc.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected to dial from 127.0.0.1, got %s", ip)
+	}
+	if tos := sockoptInt(t, tc, unix.IPPROTO_IP, unix.IP_TOS); tos != 0x20 {
+		t.Errorf("Expected tos 0x20, got %#x", tos)
+	}
+	if nd := sockoptInt(t, tc, unix.IPPROTO_TCP, unix.TCP_NODELAY); nd != 0 {
+		t.Error("Expected TCP_NODELAY to be off")
+	}
+	// the kernel doubles the requested size for its bookkeeping
+	if buf := sockoptInt(t, tc, unix.SOL_SOCKET, unix.SO_RCVBUF); buf < 256*1024 {
+		t.Errorf("Expected a receive buffer of at least 256KiB, got %d", buf)
+	}
+}
+
+func TestSockOptions_HealthProbeSource(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	from := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		from <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	sock := newSockOptions(&config.SocketOptions{SourceAddr: "127.0.0.2"})
+	hc := config.HealthCheck{}.WithDefaults("tcp")
+	if err := probe(ln.Addr().String(), hc, sock); err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+	if ip := (<-from).(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("Expected the probe to come from the source address, got %s", ip)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package protocol
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control refuses the raw socket options, which are only supported on linux.
+func (o *sockOptions) control(bool) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errors.New("reusePort, fastOpen and tos are only supported on linux")
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"io"
+	"net"
+)
+
+// spliceChunk bounds the bytes moved by one splice, so that the stats of a
+// long transfer stay current.
+const spliceChunk = 256 * 1024
+
+// copyConn copies src to dest through cw, which writes to dest. Between two
+// tcp connections the data is moved by the kernel, splice(2) on linux,
+// without passing through user space. Only the bytes a sniffing bufConn
+// already read are written by hand.
+//
+// Reads of src are bounded by the timeouts of cw.
+func copyConn(cw *countingWriter, dest, src net.Conn) error {
+	cw.timeouts.arm(src)
+	defer cw.timeouts.done()
+
+	rawDest, _ := rawTCP(dest, false)
+	rawSrc, _ := rawTCP(src, false)
+	if rawDest == nil || rawSrc == nil {
+		var r io.Reader = src
+		if cw.timeouts != nil {
+			r = timedReader{conn: src, timeouts: cw.timeouts}
+		}
+		_, err := io.Copy(cw, r)
+		return err
+	}
+
+	if _, pending := rawTCP(src, true); len(pending) > 0 {
+		if _, err := cw.Write(pending); err != nil {
+			return err
+		}
+	}
+	return cw.spliceFrom(rawDest, rawSrc)
+}
+
+// rawTCP returns the *net.TCPConn under the wrappers of c, nil if there is
+// none. With drain it empties the buffers of the wrappers and returns the
+// bytes they held, which come before anything still to be read from it.
+func rawTCP(c net.Conn, drain bool) (*net.TCPConn, []byte) {
+	var pending []byte
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, pending
+		case *bufConn:
+			if drain {
+				pending = append(pending, conn.drain()...)
+			}
+			c = conn.Conn
+		case *proxiedConn:
+			c = conn.Conn
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// spliceFrom copies src to dest, the raw connections under cw and its
+// source, chunk by chunk so that every chunk is counted and throttled.
+func (cw *countingWriter) spliceFrom(dest, src *net.TCPConn) error {
+	chunk := int64(spliceChunk)
+	if len(cw.throttle) > 0 {
+		chunk = throttleChunk
+	}
+
+	for {
+		n, err := dest.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		cw.record(n)
+		cw.throttle.wait(int(n))
+		if err != nil {
+			if err = cw.timeouts.check(src, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if n < chunk {
+			// ReadFrom stops short of the limit only at EOF
+			return nil
+		}
+	}
+}
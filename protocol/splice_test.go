@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Failed to accept")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestCopyConn_SniffedSource(t *testing.T) {
+	srcClient, srcServer := tcpPair(t)
+	destClient, destServer := tcpPair(t)
+
+	// sniff the start of the stream like the http proxies do
+	bc := newBufConn(srcServer, 16)
+	go func() {
+		_, _ = srcClient.Write([]byte("hello, spliced world"))
+		_ = srcClient.(*net.TCPConn).CloseWrite()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(bc, head); err != nil {
+		t.Fatalf("Failed to sniff: %v", err)
+	}
+	bc.Unread(head)
+
+	if raw, _ := rawTCP(bc, false); raw == nil {
+		t.Fatal("Expected a bufConn over tcp to splice")
+	}
+
+	var count int64
+	cw := &countingWriter{Writer: destServer, count: &count, bufferLimit: 1024}
+	if err := copyConn(cw, destServer, bc); err != nil {
+		t.Fatalf("Failed to copy: %v", err)
+	}
+	_ = destServer.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(destClient)
+	if err != nil {
+		t.Fatalf("Failed to read copy: %v", err)
+	}
+	if string(got) != "hello, spliced world" {
+		t.Errorf("Expected the whole stream, got %q", got)
+	}
+	if count != int64(len(got)) {
+		t.Errorf("Expected %d bytes counted, got %d", len(got), count)
+	}
+}
+
+func TestRawTCP_Wrapped(t *testing.T) {
+	_, server := tcpPair(t)
+	if raw, _ := rawTCP(struct{ net.Conn }{server}, false); raw != nil {
+		t.Error("Expected an unknown wrapper to hide the tcp connection")
+	}
+	if raw, _ := rawTCP(&proxiedConn{Conn: newBufConn(server, 16)}, false); raw != server {
+		t.Error("Expected proxiedConn and bufConn to unwrap")
+	}
+}
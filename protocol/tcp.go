@@ -1,8 +1,10 @@
 package protocol
 
 import (
-	"fmt"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"k8s.io/klog/v2"
 
@@ -11,48 +13,178 @@ import (
 
 type TcpProxy struct {
 	cfg []config.IPRule
+
+	mu        sync.Mutex
+	listeners map[string]*ipListener
+
+	// conns tracks the accepted connections for the shutdown of a Server
+	conns *connTracker
+}
+
+// ipListener is a running tcp listener whose route can be swapped on reload.
+type ipListener struct {
+	ln    net.Listener
+	route atomic.Pointer[ipRoute]
 }
 
 func NewTcpProxy(cfg []config.IPRule) *TcpProxy {
 	return &TcpProxy{
-		cfg: cfg,
+		cfg:       cfg,
+		listeners: make(map[string]*ipListener),
 	}
 }
 
-func (t TcpProxy) Start() error {
-	for _, rule := range t.cfg {
-		ln, err := net.Listen("tcp", rule.BindAddr)
+func (t *TcpProxy) Start() error {
+	return t.Reload(t.cfg)
+}
+
+// Reload makes the running listeners match cfg. New bindAddrs start listening,
+// removed ones are closed and changed targets only apply to new connections.
+func (t *TcpProxy) Reload(cfg []config.IPRule) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rules, err := expandIPRules("tcp", cfg)
+	errs := []error{err}
+
+	want := make(map[string]bool, len(rules))
+	for _, pr := range rules {
+		want[pr.rule.BindAddr] = true
+	}
+
+	for bindAddr, l := range t.listeners {
+		if !want[bindAddr] {
+			klog.Infof("[tcp] stop listening on %s", bindAddr)
+			_ = l.ln.Close()
+			l.route.Load().close(nil)
+			delete(t.listeners, bindAddr)
+		}
+	}
+
+	// the ports of a range share the limiter, bandwidth and balancer of the
+	// first
+	ranges := make(map[string]*ipRoute)
+	for _, pr := range rules {
+		rule := pr.rule
+		if l, ok := t.listeners[rule.BindAddr]; ok {
+			old := l.route.Load()
+			route := newIPRoute("tcp", pr, old, ranges[pr.rangeKey])
+			ranges[pr.rangeKey] = route
+			old.close(route)
+			route.start()
+			l.route.Store(route)
+			continue
+		}
+
+		ln, err := newSockOptions(rule.Socket).listenStream(rule.BindAddr)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
 
-		go func(listener net.Listener, target, bindAddr string) {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					klog.Errorf("failed to accept connection: %v", err)
-					continue
-				}
-				klog.Infof("[tcp] new conn form %s, %s -> %s", conn.RemoteAddr(), bindAddr, target)
+		l := &ipListener{ln: ln}
+		route := newIPRoute("tcp", pr, nil, ranges[pr.rangeKey])
+		ranges[pr.rangeKey] = route
+		route.start()
+		l.route.Store(route)
+		t.listeners[rule.BindAddr] = l
+		go t.serve(l)
+	}
+
+	t.cfg = cfg
+	return errors.Join(errs...)
+}
+
+func (t *TcpProxy) serve(l *ipListener) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			klog.Errorf("failed to accept connection: %v", err)
+			continue
+		}
 
-				go t.handleConnection(conn, target, bindAddr)
+		route := l.route.Load()
+		route.sock.apply(conn)
+		go func() {
+			done, ok := t.conns.track(conn)
+			if !ok {
+				_ = conn.Close()
+				return
 			}
-		}(ln, rule.Target, rule.BindAddr)
+			defer done()
+			t.handleConnection(conn, route)
+		}()
 	}
+}
+
+func (t *TcpProxy) handleConnection(conn net.Conn, route *ipRoute) {
+	proxied, err := route.proxy.accept(conn)
+	if err != nil {
+		klog.Errorf("[tcp] %v", err)
+		_ = conn.Close()
+		return
+	}
+	conn = proxied
 
-	return nil
+	if !admit("tcp", conn.RemoteAddr()) {
+		_ = conn.Close()
+		return
+	}
+	pipeIPRoute(conn, route)
 }
 
-func (t TcpProxy) handleConnection(conn net.Conn, target, bindAddr string) {
-	ruleKey := fmt.Sprintf("tcp:%s->%s", bindAddr, target)
+// pipeIPRoute forwards conn, a client admitted by the guard, to an upstream
+// of route.
+func pipeIPRoute(conn net.Conn, route *ipRoute) {
+	if !route.acl.permits(conn.RemoteAddr()) {
+		deny(route.ruleKey, conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
 
-	targetConn, err := net.Dial("tcp", target)
+	release, ok := route.limiter.acquire(conn.RemoteAddr())
+	if !ok {
+		klog.Warningf("[tcp] %s over connection limit, rejected %s", route.ruleKey, conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	defer release()
+
+	up := route.lb.pick(conn.RemoteAddr(), "")
+	if up == nil {
+		klog.Errorf("[tcp] no upstream available for %s", route.rule.BindAddr)
+		_ = conn.Close()
+		return
+	}
+
+	targetConn, up, err := route.dial.dial(route.lb, up, conn.RemoteAddr(), "")
 	if err != nil {
 		klog.Errorf("failed to dial target: %v", err)
+		_ = conn.Close()
+		return
+	}
+	defer up.release()
+
+	if err := sendProxyHeader(targetConn, route.rule.ProxyProtocol, conn, ""); err != nil {
+		klog.Errorf("failed to send proxy protocol header: %v", err)
+		_ = targetConn.Close()
+		_ = conn.Close()
 		return
 	}
+	if targetConn, err = route.dial.secure(targetConn, up.upstream); err != nil {
+		klog.Errorf("failed to secure target connection: %v", err)
+		up.reportFailure(err)
+		_ = conn.Close()
+		return
+	}
+
+	klog.Infof("[tcp] new conn form %s, %s -> %s", conn.RemoteAddr(), route.rule.BindAddr, up.addr)
 
-	if err := pipeWithStats(conn, targetConn, ruleKey); err != nil {
+	timeouts := newPipeTimeouts(route.rule.IdleTimeout, route.rule.MaxLifetime)
+	if err := pipeWithStats(conn, targetConn, route.ruleKey, up, route.bw, timeouts); err != nil {
 		klog.Errorf("failed to pipe connection: %v", err)
 	}
 }
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/stat"
 )
 
 // TestNewTcpProxy tests the constructor function
@@ -81,7 +83,7 @@ func TestTcpProxy_ProxyConnection(t *testing.T) {
 				return
 			}
 			rule := cfg[0]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -161,7 +163,7 @@ func TestTcpProxy_MultipleConnections(t *testing.T) {
 				return
 			}
 			rule := cfg[0]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -259,7 +261,7 @@ func TestTcpProxy_LargeData(t *testing.T) {
 				return
 			}
 			rule := cfg[0]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -380,7 +382,7 @@ func TestTcpProxy_MultipleRules(t *testing.T) {
 				return
 			}
 			rule := cfg[0]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -391,7 +393,7 @@ func TestTcpProxy_MultipleRules(t *testing.T) {
 				return
 			}
 			rule := cfg[1]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -430,6 +432,179 @@ func TestTcpProxy_MultipleRules(t *testing.T) {
 	}
 }
 
+// TestTcpProxy_Reload tests that a reload switches targets for new connections
+// only and closes listeners that were removed from the config
+func TestTcpProxy_Reload(t *testing.T) {
+	targetAddr1 := startTaggedServer(t, "one:")
+	targetAddr2 := startTaggedServer(t, "two:")
+	proxyAddr := freeTCPAddr(t)
+	removedAddr := freeTCPAddr(t)
+
+	proxy := NewTcpProxy([]config.IPRule{
+		{BindAddr: proxyAddr, Target: targetAddr1},
+		{BindAddr: removedAddr, Target: targetAddr1},
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	oldConn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer oldConn.Close()
+	if got := roundTrip(t, oldConn, "a"); got != "one:a" {
+		t.Fatalf("Expected %q before reload, got %q", "one:a", got)
+	}
+
+	if err := proxy.Reload([]config.IPRule{{BindAddr: proxyAddr, Target: targetAddr2}}); err != nil {
+		t.Fatalf("Failed to reload proxy: %v", err)
+	}
+
+	if got := roundTrip(t, oldConn, "b"); got != "one:b" {
+		t.Errorf("Existing connection should keep its target, got %q", got)
+	}
+
+	newConn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy after reload: %v", err)
+	}
+	defer newConn.Close()
+	if got := roundTrip(t, newConn, "c"); got != "two:c" {
+		t.Errorf("New connection should use the new target, got %q", got)
+	}
+
+	if conn, err := net.DialTimeout("tcp", removedAddr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Expected removed listener %s to be closed", removedAddr)
+	}
+}
+
+func TestTcpProxy_PortRange(t *testing.T) {
+	target := startTaggedServer(t, "range:")
+
+	// find three consecutive free ports
+	var proxy *TcpProxy
+	var first int
+	for attempt := 0; proxy == nil; attempt++ {
+		if attempt == 10 {
+			t.Fatal("Failed to find a free port range")
+		}
+		_, port, _ := net.SplitHostPort(freeTCPAddr(t))
+		first, _ = strconv.Atoi(port)
+		if first > 65533 {
+			continue
+		}
+		p := NewTcpProxy([]config.IPRule{{BindAddr: fmt.Sprintf("127.0.0.1:%d-%d", first, first+2), Target: target}})
+		if err := p.Start(); err != nil {
+			p.Reload(nil)
+			continue
+		}
+		proxy = p
+	}
+	defer proxy.Reload(nil)
+
+	for port := first; port <= first+2; port++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("Failed to connect to port %d of the range: %v", port, err)
+		}
+		defer conn.Close()
+		if got := roundTrip(t, conn, "x"); got != "range:x" {
+			t.Errorf("Port %d: expected %q, got %q", port, "range:x", got)
+		}
+	}
+
+	key := fmt.Sprintf("tcp:127.0.0.1:%d-%d->%s", first, first+2, target)
+	if got := stat.GlobalStats.Snapshot().RuleStats[key].ConnCount; got != 3 {
+		t.Errorf("Expected the range rule to count 3 connections, got %d", got)
+	}
+
+	// one balancer, and so one set of health checks, serves the whole range
+	for i := 0; i < 2; i++ {
+		lb := proxy.listeners[fmt.Sprintf("127.0.0.1:%d", first)].route.Load().lb
+		for port := first + 1; port <= first+2; port++ {
+			if proxy.listeners[fmt.Sprintf("127.0.0.1:%d", port)].route.Load().lb != lb {
+				t.Errorf("Expected port %d to share the balancer of the range", port)
+			}
+		}
+		if err := proxy.Reload(proxy.cfg); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+	}
+}
+
+// startTaggedServer starts a server that answers every read with tag+data
+func startTaggedServer(t *testing.T, tag string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(append([]byte(tag), buf[:n]...)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// testIPRoute builds the route of a rule binding a single port
+func testIPRoute(rule config.IPRule) *ipRoute {
+	return newIPRoute("tcp", portRule{
+		rule:     rule,
+		ruleKey:  "tcp:" + rule.BindAddr + "->" + targetsKey(rule.Upstreams()),
+		rangeKey: "tcp:" + rule.BindAddr + "->" + targetsKey(rule.Upstreams()),
+	}, nil, nil)
+}
+
+// freeTCPAddr returns a loopback address that was free a moment ago
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// roundTrip writes msg to conn and returns whatever is read back
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	return string(buf[:n])
+}
+
 // handleEchoConnection is a helper function that echoes back all data received
 func handleEchoConnection(conn net.Conn) {
 	defer conn.Close()
@@ -480,7 +655,7 @@ func BenchmarkTcpProxy_Proxy(b *testing.B) {
 				return
 			}
 			rule := cfg[0]
-			go proxy.handleConnection(conn, rule.Target, rule.BindAddr)
+			go proxy.handleConnection(conn, testIPRoute(rule))
 		}
 	}()
 
@@ -511,3 +686,84 @@ func BenchmarkTcpProxy_Proxy(b *testing.B) {
 		conn.Close()
 	}
 }
+
+// BenchmarkTcpProxy_Throughput pushes 1MB per op through the proxy, once on
+// the splice path and once with the client connection wrapped so that the
+// bytes are copied through user space.
+func BenchmarkTcpProxy_Throughput(b *testing.B) {
+	const size = 1 << 20
+
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer targetListener.Close()
+
+	// sink server acknowledging every size bytes with a single byte
+	go func() {
+		for {
+			conn, err := targetListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					if _, err := io.CopyN(io.Discard, c, size); err != nil {
+						return
+					}
+					if _, err := c.Write([]byte{1}); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	rule := config.IPRule{BindAddr: "127.0.0.1:0", Target: targetListener.Addr().String()}
+	for _, bc := range []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{"splice", func(c net.Conn) net.Conn { return c }},
+		{"copy", func(c net.Conn) net.Conn { return struct{ net.Conn }{c} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("Failed to create proxy listener: %v", err)
+			}
+			defer proxyListener.Close()
+
+			proxy := NewTcpProxy(nil)
+			go func() {
+				for {
+					conn, err := proxyListener.Accept()
+					if err != nil {
+						return
+					}
+					go proxy.handleConnection(bc.wrap(conn), testIPRoute(rule))
+				}
+			}()
+
+			conn, err := net.Dial("tcp", proxyListener.Addr().String())
+			if err != nil {
+				b.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			payload := make([]byte, size)
+			ack := make([]byte, 1)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatalf("Failed to write: %v", err)
+				}
+				if _, err := io.ReadFull(conn, ack); err != nil {
+					b.Fatalf("Failed to read ack: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// tokenBucket lets rate bytes per second pass, up to burst at once.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil, which never throttles, for a zero rate.
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until n bytes may pass. Callers going over the bucket run into
+// debt, so concurrent writers share the rate fairly.
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / b.rate * float64(time.Second)))
+	}
+}
+
+// throttle is the set of buckets one direction of a connection passes.
+type throttle []*tokenBucket
+
+// throttleChunk bounds the bytes taken from the buckets at once, so a large
+// write does not stall the others sharing a bucket.
+const throttleChunk = 16 * 1024
+
+func (t throttle) wait(n int) {
+	for _, b := range t {
+		b.wait(n)
+	}
+}
+
+// bandwidth holds the token buckets of a rule.
+type bandwidth struct {
+	cfg              config.Bandwidth
+	ruleUp, ruleDown *tokenBucket
+	clientsMu        sync.Mutex
+	clients          map[string]*clientBuckets
+}
+
+// clientBuckets are the buckets of a client ip, kept while it has
+// connections.
+type clientBuckets struct {
+	up, down *tokenBucket
+	refs     int
+}
+
+// newBandwidth returns nil, which never throttles, without cfg. prev is kept
+// if the config did not change so that a reload does not reset the rule
+// buckets.
+func newBandwidth(cfg *config.Bandwidth, prev *bandwidth) *bandwidth {
+	if cfg == nil {
+		return nil
+	}
+	if prev != nil && prev.cfg == *cfg {
+		return prev
+	}
+
+	return &bandwidth{
+		cfg:      *cfg,
+		ruleUp:   newTokenBucket(cfg.Rule.Up, cfg.Rule.Burst),
+		ruleDown: newTokenBucket(cfg.Rule.Down, cfg.Rule.Burst),
+		clients:  make(map[string]*clientBuckets),
+	}
+}
+
+// open returns the throttles of a new connection from client, up for client
+// to target, and a func to call once the connection is done.
+func (bw *bandwidth) open(client net.Addr) (up, down throttle, done func()) {
+	if bw == nil {
+		return nil, nil, func() {}
+	}
+
+	up = appendBucket(up, bw.ruleUp)
+	down = appendBucket(down, bw.ruleDown)
+	up = appendBucket(up, newTokenBucket(bw.cfg.Conn.Up, bw.cfg.Conn.Burst))
+	down = appendBucket(down, newTokenBucket(bw.cfg.Conn.Down, bw.cfg.Conn.Burst))
+
+	if bw.cfg.Client.Up <= 0 && bw.cfg.Client.Down <= 0 {
+		return up, down, func() {}
+	}
+
+	ip := clientIP(client)
+	bw.clientsMu.Lock()
+	cb, ok := bw.clients[ip]
+	if !ok {
+		cb = &clientBuckets{
+			up:   newTokenBucket(bw.cfg.Client.Up, bw.cfg.Client.Burst),
+			down: newTokenBucket(bw.cfg.Client.Down, bw.cfg.Client.Burst),
+		}
+		bw.clients[ip] = cb
+	}
+	cb.refs++
+	bw.clientsMu.Unlock()
+
+	var once sync.Once
+	return appendBucket(up, cb.up), appendBucket(down, cb.down), func() {
+		once.Do(func() {
+			bw.clientsMu.Lock()
+			defer bw.clientsMu.Unlock()
+			if cb.refs--; cb.refs == 0 {
+				delete(bw.clients, ip)
+			}
+		})
+	}
+}
+
+func appendBucket(t throttle, b *tokenBucket) throttle {
+	if b == nil {
+		return t
+	}
+	return append(t, b)
+}
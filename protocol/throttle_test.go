@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0, 0) != nil {
+		t.Error("Expected no bucket for a zero rate")
+	}
+
+	b := newTokenBucket(100*1024, 10*1024)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		b.wait(10 * 1024)
+	}
+	// the burst passes at once, the other 50KB take half a second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("Expected about 500ms for 60KB at 100KB/s, took %s", elapsed)
+	}
+}
+
+func TestBandwidth_ClientBuckets(t *testing.T) {
+	bw := newBandwidth(&config.Bandwidth{
+		Conn:   config.Rate{Up: 1000},
+		Client: config.Rate{Down: 1000},
+	}, nil)
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+
+	up1, down1, done1 := bw.open(a)
+	up2, down2, done2 := bw.open(a)
+	if len(up1) != 1 || len(up2) != 1 || up1[0] == up2[0] {
+		t.Error("Expected every connection to get its own upload bucket")
+	}
+	if len(down1) != 1 || len(down2) != 1 || down1[0] != down2[0] {
+		t.Error("Expected connections of a client to share its download bucket")
+	}
+
+	done1()
+	done1()
+	if len(bw.clients) != 1 {
+		t.Errorf("Expected the client buckets to stay while connected, got %d", len(bw.clients))
+	}
+	done2()
+	if len(bw.clients) != 0 {
+		t.Errorf("Expected the client buckets to be dropped, got %d", len(bw.clients))
+	}
+
+	if newBandwidth(&config.Bandwidth{Conn: config.Rate{Up: 1000}, Client: config.Rate{Down: 1000}}, bw) != bw {
+		t.Error("Expected an unchanged config to keep the buckets")
+	}
+}
+
+func TestTcpProxy_Bandwidth(t *testing.T) {
+	const size = 96 * 1024
+
+	targetListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer targetListener.Close()
+	go func() {
+		conn, err := targetListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, size))
+	}()
+
+	proxyAddr := freeTCPAddr(t)
+	proxy := NewTcpProxy([]config.IPRule{{
+		BindAddr:  proxyAddr,
+		Target:    targetListener.Addr().String(),
+		Bandwidth: &config.Bandwidth{Conn: config.Rate{Down: 64 * 1024, Burst: 16 * 1024}},
+	}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadFull(conn, make([]byte, size))
+	if err != nil {
+		t.Fatalf("Failed to read, got %d bytes: %v", n, err)
+	}
+	// 80KB past the burst at 64KB/s
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the download to be throttled, took %s", elapsed)
+	}
+}
@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errMaxLifetime = errors.New("max lifetime reached")
+)
+
+// pipeTimeouts ends a connection once no bytes moved in either direction for
+// idle, or once it lived for lifetime. A nil *pipeTimeouts never ends one.
+type pipeTimeouts struct {
+	idle, lifetime time.Duration
+	start          time.Time
+	last           atomic.Int64 // unix nano of the last bytes moved, see touch
+
+	mu sync.Mutex
+	// dirs are the directions of the connection, see direction
+	dirs []*timeoutDir
+}
+
+// newPipeTimeouts returns nil if neither timeout is set.
+func newPipeTimeouts(idle, lifetime time.Duration) *pipeTimeouts {
+	if idle <= 0 && lifetime <= 0 {
+		return nil
+	}
+
+	t := &pipeTimeouts{idle: idle, lifetime: lifetime, start: time.Now()}
+	t.touch()
+	return t
+}
+
+// touch records that bytes moved, for connections that are watched.
+func (t *pipeTimeouts) touch() {
+	if t != nil {
+		t.last.Store(time.Now().UnixNano())
+	}
+}
+
+// deadline returns when a connection last active at last ends unless bytes
+// move before, and the error it ends with.
+func (t *pipeTimeouts) deadline(last time.Time) (time.Time, error) {
+	var d time.Time
+	var reason error
+	if t.idle > 0 {
+		d, reason = last.Add(t.idle), errIdleTimeout
+	}
+	if t.lifetime > 0 {
+		if end := t.start.Add(t.lifetime); d.IsZero() || end.Before(d) {
+			d, reason = end, errMaxLifetime
+		}
+	}
+	return d, reason
+}
+
+// direction returns the state of one direction of a piped connection, both
+// of which read with deadlines. Bytes moved by a splice only show once it
+// returns, so only a direction itself knows when it was quiet and the
+// connection ends once both were quiet over the same idle span.
+func (t *pipeTimeouts) direction() *timeoutDir {
+	if t == nil {
+		return nil
+	}
+	d := &timeoutDir{t: t, last: time.Now()}
+	t.mu.Lock()
+	t.dirs = append(t.dirs, d)
+	t.mu.Unlock()
+	return d
+}
+
+// timeoutDir is one direction of a piped connection, used by the goroutine
+// copying it only.
+type timeoutDir struct {
+	t    *pipeTimeouts
+	last time.Time
+
+	// quiet is set while d is known to have moved nothing from since until,
+	// finished once its copy ended. Written under t.mu.
+	quiet        bool
+	finished     bool
+	since, until time.Time
+}
+
+// record notes that bytes moved in d, which is no longer quiet.
+func (d *timeoutDir) record() {
+	if d == nil {
+		return
+	}
+	d.last = time.Now()
+	if d.quiet {
+		d.t.mu.Lock()
+		d.quiet = false
+		d.t.mu.Unlock()
+	}
+}
+
+// arm sets the read deadline of conn, the source of d.
+func (d *timeoutDir) arm(conn net.Conn) {
+	if d == nil {
+		return
+	}
+	deadline, _ := d.t.deadline(d.last)
+	_ = conn.SetReadDeadline(deadline)
+}
+
+// check looks at err, returned by a read of conn. If the deadline passed but
+// the connection goes on, the deadline is pushed back and check returns nil,
+// the read should be retried. Otherwise it returns the error the connection
+// ends with.
+func (d *timeoutDir) check(conn net.Conn, err error) error {
+	if d == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+
+	deadline, reason := d.t.deadline(d.last)
+	if reason == errMaxLifetime && !time.Now().Before(deadline) {
+		return reason
+	}
+	if now := time.Now(); !now.Before(deadline) {
+		if d.silent(now) {
+			return errIdleTimeout
+		}
+		// wait for the other direction to go quiet as well
+		d.last = now
+	}
+
+	d.arm(conn)
+	return nil
+}
+
+// silent marks d quiet up to now and reports whether all directions were
+// quiet together for idle.
+func (d *timeoutDir) silent(now time.Time) bool {
+	d.t.mu.Lock()
+	defer d.t.mu.Unlock()
+	if !d.quiet {
+		d.quiet, d.since = true, d.last
+	}
+	d.until = now
+
+	since, until := d.since, d.until
+	for _, o := range d.t.dirs {
+		if o == d {
+			continue
+		}
+		if !o.quiet {
+			return false
+		}
+		since = later(since, o.since)
+		if !o.finished {
+			until = earlier(until, o.until)
+		}
+	}
+	return until.Sub(since) >= d.t.idle
+}
+
+// done marks d quiet for good once its copy finished.
+func (d *timeoutDir) done() {
+	if d == nil {
+		return
+	}
+	d.t.mu.Lock()
+	defer d.t.mu.Unlock()
+	if !d.quiet {
+		d.quiet, d.since = true, d.last
+	}
+	d.finished = true
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// watch calls expire with the reason once t expires, for connections whose
+// reads cannot be retried after a deadline, like websockets. The returned
+// func stops watching.
+func (t *pipeTimeouts) watch(expire func(reason error)) (stop func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	var mu sync.Mutex
+	stopped := false
+	var timer *time.Timer
+	var fire func()
+	fire = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		d, reason := t.deadline(time.Unix(0, t.last.Load()))
+		if wait := time.Until(d); wait > 0 {
+			timer = time.AfterFunc(wait, fire)
+			return
+		}
+		stopped = true
+		expire(reason)
+	}
+
+	d, _ := t.deadline(time.Unix(0, t.last.Load()))
+	mu.Lock()
+	timer = time.AfterFunc(time.Until(d), fire)
+	mu.Unlock()
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		timer.Stop()
+	}
+}
+
+// timedReader reads conn, retrying reads whose deadline passed while the
+// connection was still in use.
+type timedReader struct {
+	conn     net.Conn
+	timeouts *timeoutDir
+}
+
+func (r timedReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.conn.Read(p)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			// the bytes are recorded before the deadline is looked at, the
+			// next read fails right away
+			return n, nil
+		}
+		if err = r.timeouts.check(r.conn, err); err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
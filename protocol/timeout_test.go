@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestTcpProxy_IdleTimeout(t *testing.T) {
+	// the target sends a byte every 50ms for a while, then goes quiet
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 12; i++ {
+			if _, err := conn.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", startTCPProxy(t, config.IPRule{
+		Target:      ln.Addr().String(),
+		IdleTimeout: 200 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Expected the proxy to close the idle connection, got %v", err)
+	}
+	if len(got) != 12 {
+		t.Errorf("Expected the connection to live while the target talks, got %d of 12 bytes", len(got))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the idle connection to close soon after going quiet, took %s", elapsed)
+	}
+}
+
+func TestTcpProxy_IdleTimeoutResumed(t *testing.T) {
+	// the target sends a byte and then only listens
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer ln.Close()
+	received := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		_, _ = conn.Write([]byte{'x'})
+		n, _ := io.Copy(io.Discard, conn)
+		received <- int(n)
+	}()
+
+	conn, err := net.Dial("tcp", startTCPProxy(t, config.IPRule{
+		Target:      ln.Addr().String(),
+		IdleTimeout: 200 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// the client direction goes quiet first and resumes before the target
+	// direction does, which then stays quiet while the client talks
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 12; i++ {
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case n := <-received:
+		if n != 12 {
+			t.Errorf("Expected the connection to live while the client talks, target got %d of 12 bytes", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the connection to close once idle")
+	}
+}
+
+func TestTcpProxy_MaxLifetime(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoConnection(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", startTCPProxy(t, config.IPRule{
+		Target:      ln.Addr().String(),
+		IdleTimeout: time.Minute,
+		MaxLifetime: 300 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// keep the connection busy, it must still end with its lifetime
+	start := time.Now()
+	buf := make([]byte, 1)
+	for time.Since(start) < 3*time.Second {
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			break
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the connection to end after its 300ms lifetime, took %s", elapsed)
+	}
+}
+
+func TestUdpProxy_IdleTimeout(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	defer target.Close()
+
+	bindAddr := "127.0.0.1:0"
+	proxy := NewUdpProxy([]config.IPRule{{BindAddr: bindAddr, Target: target.LocalAddr().String(), IdleTimeout: 200 * time.Millisecond}})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	l := proxy.listeners[bindAddr]
+	client, err := net.Dial("udp", l.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for l.sessions.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.sessions.Load() != 1 {
+		t.Fatal("Expected a session for the client")
+	}
+	for l.sessions.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := l.sessions.Load(); n != 0 {
+		t.Errorf("Expected the idle session to expire, %d left", n)
+	}
+}
@@ -1,7 +1,8 @@
 package protocol
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -15,15 +16,47 @@ import (
 
 type UdpProxy struct {
 	cfg []config.IPRule
+
+	mu        sync.Mutex
+	listeners map[string]*udpListener
+}
+
+// udpListener is a running udp listener whose route can be swapped on
+// reload. Existing sessions keep talking to the target they were dialed with.
+type udpListener struct {
+	pc       net.PacketConn
+	bindAddr string
+	route    atomic.Pointer[ipRoute]
+
+	// sessions counts the live sessions of the listener
+	sessions atomic.Int32
+	// stopped is closed once the listener has shut down and flushed the
+	// byte counters of its sessions.
+	stopped chan struct{}
 }
 
 func NewUdpProxy(cfg []config.IPRule) *UdpProxy {
-	return &UdpProxy{cfg: cfg}
+	return &UdpProxy{
+		cfg:       cfg,
+		listeners: make(map[string]*udpListener),
+	}
 }
 
 type session struct {
 	clientAddr *net.UDPAddr
 	targetConn *net.UDPConn
+	ruleKey    string
+	upstream   *lease
+	// proxyHeader prefixes every datagram sent to the upstream, if set
+	proxyHeader []byte
+	// releaseLimit frees the slot of the session in its connLimiter
+	releaseLimit func()
+	// throttleUp and throttleDown pace the datagrams of the session, closing
+	// it calls throttleDone
+	throttleUp, throttleDown throttle
+	throttleDone             func()
+	// idleTimeout closes the session once no datagram passed for that long
+	idleTimeout time.Duration
 
 	writeCh chan []byte
 	closed  chan struct{}
@@ -37,12 +70,15 @@ type session struct {
 	pendingOut  int64 // src -> dest
 }
 
-func newSession(clientAddr *net.UDPAddr, targetConn *net.UDPConn) *session {
+func newSession(clientAddr *net.UDPAddr, targetConn *net.UDPConn, ruleKey string, up *lease) *session {
 	s := &session{
-		clientAddr: clientAddr,
-		targetConn: targetConn,
-		writeCh:    make(chan []byte, 256),
-		closed:     make(chan struct{}),
+		clientAddr:  clientAddr,
+		targetConn:  targetConn,
+		ruleKey:     ruleKey,
+		upstream:    up,
+		idleTimeout: config.DefaultUDPIdleTimeout,
+		writeCh:     make(chan []byte, 256),
+		closed:      make(chan struct{}),
 	}
 	s.touch()
 	return s
@@ -65,101 +101,185 @@ func (s *session) close() {
 		s.closedF = true
 		close(s.closed)
 		_ = s.targetConn.Close()
+		s.upstream.release()
+		if s.releaseLimit != nil {
+			s.releaseLimit()
+		}
+		if s.throttleDone != nil {
+			s.throttleDone()
+		}
 	}
 }
 
 func (u *UdpProxy) Start() error {
-	for _, rule := range u.cfg {
-		pc, err := net.ListenPacket("udp", rule.BindAddr)
+	return u.Reload(u.cfg)
+}
+
+// Reload makes the running listeners match cfg. New bindAddrs start listening,
+// removed ones are closed together with their sessions and changed targets
+// only apply to new sessions.
+func (u *UdpProxy) Reload(cfg []config.IPRule) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	rules, err := expandIPRules("udp", cfg)
+	errs := []error{err}
+
+	want := make(map[string]bool, len(rules))
+	for _, pr := range rules {
+		want[pr.rule.BindAddr] = true
+	}
+
+	for bindAddr, l := range u.listeners {
+		if !want[bindAddr] {
+			klog.Infof("[udp] stop listening on %s", bindAddr)
+			_ = l.pc.Close()
+			l.route.Load().close(nil)
+			delete(u.listeners, bindAddr)
+		}
+	}
+
+	// the ports of a range share the limiter, bandwidth and balancer of the
+	// first
+	ranges := make(map[string]*ipRoute)
+	for _, pr := range rules {
+		rule := pr.rule
+		if l, ok := u.listeners[rule.BindAddr]; ok {
+			old := l.route.Load()
+			route := newIPRoute("udp", pr, old, ranges[pr.rangeKey])
+			ranges[pr.rangeKey] = route
+			old.close(route)
+			route.start()
+			route.sock.apply(l.pc)
+			l.route.Store(route)
+			continue
+		}
+
+		pc, err := newSockOptions(rule.Socket).listenConfig().ListenPacket(context.Background(), "udp", rule.BindAddr)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-		go startUDPListener(pc, rule.Target, rule.BindAddr)
+
+		l := &udpListener{pc: pc, bindAddr: rule.BindAddr, stopped: make(chan struct{})}
+		route := newIPRoute("udp", pr, nil, ranges[pr.rangeKey])
+		ranges[pr.rangeKey] = route
+		route.start()
+		route.sock.apply(pc)
+		l.route.Store(route)
+		u.listeners[rule.BindAddr] = l
+		go startUDPListener(l)
 	}
-	return nil
+
+	u.cfg = cfg
+	return errors.Join(errs...)
 }
 
-func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
-	ruleKey := fmt.Sprintf("udp:%s->%s", bindAddr, targetAddr)
+// Shutdown closes every listener and its sessions, flushing their pending
+// byte counters into GlobalStats. A session only ends by going idle, so
+// waiting for them would just hold the shutdown for the idle timeout.
+func (u *UdpProxy) Shutdown() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for bindAddr, l := range u.listeners {
+		_ = l.pc.Close()
+		l.route.Load().close(nil)
+		<-l.stopped
+		delete(u.listeners, bindAddr)
+	}
+}
+
+func startUDPListener(l *udpListener) {
+	pc, bindAddr := l.pc, l.bindAddr
 
 	// sessions map: clientAddr.String() -> *session
 	sessions := make(map[string]*session)
+	// denied holds when the clients refused by the acl are forgotten, so
+	// that one is counted once while it keeps sending rather than per
+	// datagram. It is guarded by sessionsMu as well.
+	denied := make(map[string]time.Time)
 	var sessionsMu sync.Mutex
 
 	const (
-		idleTimeout           = 90 * time.Second
-		cleanupInterval       = 30 * time.Second
 		flushInterval         = 1 * time.Second
 		pendingFlushThreshold = 16 * 1024
 	)
 
-	rs := stat.GlobalStats.GetOrCreateRule(ruleKey)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+
+		sessionsMu.Lock()
+		for key, s := range sessions {
+			flushSession(s)
+			s.close()
+			delete(sessions, key)
+		}
+		l.sessions.Store(0)
+		sessionsMu.Unlock()
+
+		close(l.stopped)
+	}()
+
+	// seen remembers every rule and target this listener reported so that one
+	// whose sessions are all gone gets its ConnCount reset to zero.
+	type statKey struct{ rule, target string }
+	seen := make(map[statKey]bool)
+	storeConnCounts := func(active map[statKey]int32) {
+		rules := make(map[string]int32)
+		for key := range seen {
+			rules[key.rule] += active[key]
+			t := stat.GlobalStats.GetOrCreateTarget(key.rule, key.target)
+			atomic.StoreInt32(&t.ConnCount, active[key])
+		}
+		for key, n := range rules {
+			rs := stat.GlobalStats.GetOrCreateRule(key)
+			atomic.StoreInt32(&rs.ConnCount, n)
+		}
+	}
 
 	go func() {
 		ticker := time.NewTicker(flushInterval)
 		defer ticker.Stop()
-		for range ticker.C {
-			var totalIn int64
-			var totalOut int64
-			var activeCount int32
+		for {
+			select {
+			case <-done:
+				storeConnCounts(nil)
+				return
+			case <-ticker.C:
+			}
+
+			activeCount := make(map[statKey]int32)
 
 			sessionsMu.Lock()
 			now := time.Now()
 			for k, s := range sessions {
+				key := statKey{s.ruleKey, s.upstream.addr}
+				seen[key] = true
 				last := time.Unix(0, s.lastActive.Load())
-				if now.Sub(last) <= idleTimeout {
-					activeCount++
+				if now.Sub(last) <= s.idleTimeout {
+					activeCount[key]++
 				}
 
-				s.pendingLock.Lock()
-				in := s.pendingIn
-				out := s.pendingOut
-				s.pendingIn = 0
-				s.pendingOut = 0
-				s.pendingLock.Unlock()
-
-				totalIn += in
-				totalOut += out
+				flushSession(s)
 
+				if now.Sub(last) > s.idleTimeout {
+					s.close()
+				}
 				if s.isClosed() {
 					delete(sessions, k)
+					l.sessions.Add(-1)
 				}
 			}
-			sessionsMu.Unlock()
-
-			if totalIn != 0 || totalOut != 0 {
-				stat.GlobalStats.AddBytes(ruleKey, totalIn, totalOut)
-			}
-
-			atomic.StoreInt32(&rs.ConnCount, activeCount)
-		}
-	}()
-
-	go func() {
-		ticker := time.NewTicker(cleanupInterval)
-		defer ticker.Stop()
-		for range ticker.C {
-			now := time.Now()
-			sessionsMu.Lock()
-			for key, s := range sessions {
-				last := time.Unix(0, s.lastActive.Load())
-				if now.Sub(last) > idleTimeout {
-					s.pendingLock.Lock()
-					in := s.pendingIn
-					out := s.pendingOut
-					s.pendingIn = 0
-					s.pendingOut = 0
-					s.pendingLock.Unlock()
-
-					if in != 0 || out != 0 {
-						stat.GlobalStats.AddBytes(ruleKey, in, out)
-					}
-
-					s.close()
-					delete(sessions, key)
+			for k, until := range denied {
+				if now.After(until) {
+					delete(denied, k)
 				}
 			}
 			sessionsMu.Unlock()
+
+			storeConnCounts(activeCount)
 		}
 	}()
 
@@ -167,6 +287,9 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 	for {
 		n, addr, err := pc.ReadFrom(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			klog.Errorf("[udp] read error on %s: %v", bindAddr, err)
 			continue
 		}
@@ -181,25 +304,81 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 		sessionsMu.Lock()
 		sess, ok := sessions[key]
 		if !ok {
+			route := l.route.Load()
+			if !admit("udp", udpAddr) {
+				sessionsMu.Unlock()
+				continue
+			}
+			if !route.acl.permits(udpAddr) {
+				if _, ok := denied[key]; !ok {
+					deny(route.ruleKey, udpAddr)
+				}
+				idle := config.DefaultUDPIdleTimeout
+				if route.rule.IdleTimeout > 0 {
+					idle = route.rule.IdleTimeout
+				}
+				denied[key] = time.Now().Add(idle)
+				sessionsMu.Unlock()
+				continue
+			}
+
+			// queueing is rejected by config validation, acquire never blocks
+			releaseLimit, ok := route.limiter.acquire(udpAddr)
+			if !ok {
+				klog.Warningf("[udp] %s over session limit, dropped datagram from %s", route.ruleKey, udpAddr)
+				sessionsMu.Unlock()
+				continue
+			}
+
+			up := route.lb.pick(udpAddr, "")
+			if up == nil {
+				klog.Errorf("[udp] no upstream available for %s", bindAddr)
+				releaseLimit()
+				sessionsMu.Unlock()
+				continue
+			}
+			targetAddr := up.addr
+
 			// Dial UDP target once for this client session
 			targetUDPAddr, err := net.ResolveUDPAddr("udp", targetAddr)
 			if err != nil {
 				klog.Errorf("[udp] resolve target %s error: %v", targetAddr, err)
+				up.release()
+				releaseLimit()
 				sessionsMu.Unlock()
 				continue
 			}
-			tc, err := net.DialUDP("udp", nil, targetUDPAddr)
+			conn, err := route.sock.dialer("udp", 0).Dial("udp", targetUDPAddr.String())
 			if err != nil {
 				klog.Errorf("[udp] dial target %s error: %v", targetAddr, err)
+				up.reportFailure(err)
+				up.release()
+				releaseLimit()
 				sessionsMu.Unlock()
 				continue
 			}
 
-			sess = newSession(udpAddr, tc)
+			tc := conn.(*net.UDPConn)
+			route.sock.apply(tc)
+
+			sess = newSession(udpAddr, tc, route.ruleKey, up)
+			sess.releaseLimit = releaseLimit
+			if route.rule.IdleTimeout > 0 {
+				sess.idleTimeout = route.rule.IdleTimeout
+			}
+			sess.throttleUp, sess.throttleDown, sess.throttleDone = route.bw.open(udpAddr)
+			if v := route.rule.ProxyProtocol; v != "" {
+				sess.proxyHeader, err = proxyHeader(v, "udp", udpAddr, pc.LocalAddr(), nil)
+				if err != nil {
+					klog.Errorf("[udp] proxy protocol header for %s error: %v", udpAddr, err)
+				}
+			}
 			sessions[key] = sess
+			l.sessions.Add(1)
 
 			go func(s *session) {
 				readBuf := make([]byte, 64*1024)
+				answered := false
 				for {
 					select {
 					case <-s.closed:
@@ -209,16 +388,26 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 
 					nr, err := s.targetConn.Read(readBuf)
 					if err != nil {
+						// an icmp port unreachable surfaces as ECONNREFUSED on a connected socket
+						if isReset(err) {
+							s.upstream.reportFailure(err)
+							s.close()
+						}
 						return
 					}
 					if nr <= 0 {
 						continue
 					}
+					if !answered {
+						answered = true
+						s.upstream.reportSuccess()
+					}
 
 					s.pendingLock.Lock()
 					s.pendingIn += int64(nr)
 					s.pendingLock.Unlock()
 
+					s.throttleDown.wait(nr)
 					_, _ = pc.WriteTo(readBuf[:nr], s.clientAddr)
 					s.touch()
 				}
@@ -231,10 +420,15 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 						if data == nil {
 							return
 						}
+						s.throttleUp.wait(len(data))
+						if s.proxyHeader != nil {
+							data = append(s.proxyHeader[:len(s.proxyHeader):len(s.proxyHeader)], data...)
+						}
 						w, err := s.targetConn.Write(data)
 						if err != nil {
 							return
 						}
+						w -= len(s.proxyHeader)
 						// 增加 pendingOut，并在超过阈值时尽快写回 GlobalStats（避免长时间占用内存）
 						s.pendingLock.Lock()
 						s.pendingOut += int64(w)
@@ -244,7 +438,8 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 							s.pendingIn = 0
 							s.pendingOut = 0
 							s.pendingLock.Unlock()
-							stat.GlobalStats.AddBytes(ruleKey, inP, outP)
+							stat.GlobalStats.AddBytes(s.ruleKey, inP, outP)
+							stat.GlobalStats.AddTargetBytes(s.ruleKey, s.upstream.addr, inP, outP)
 						} else {
 							s.pendingLock.Unlock()
 						}
@@ -268,3 +463,18 @@ func startUDPListener(pc net.PacketConn, targetAddr string, bindAddr string) {
 		sessionsMu.Unlock()
 	}
 }
+
+// flushSession moves the pending byte counters of s into GlobalStats.
+func flushSession(s *session) {
+	s.pendingLock.Lock()
+	in := s.pendingIn
+	out := s.pendingOut
+	s.pendingIn = 0
+	s.pendingOut = 0
+	s.pendingLock.Unlock()
+
+	if in != 0 || out != 0 {
+		stat.GlobalStats.AddBytes(s.ruleKey, in, out)
+		stat.GlobalStats.AddTargetBytes(s.ruleKey, s.upstream.addr, in, out)
+	}
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// streamNetwork splits a tcp rule address into the network and address to
+// dial or listen on, "unix" for a unix socket and "tcp" otherwise.
+func streamNetwork(addr string) (string, string) {
+	if path, ok := config.UnixPath(addr); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// listenStream listens on addr, a host:port or unix socket. A socket file
+// left behind by a process that is gone is replaced, and the new one gets the
+// mode and ownership of o. Closing the listener removes the file again.
+func (o *sockOptions) listenStream(addr string) (net.Listener, error) {
+	network, address := streamNetwork(addr)
+	if network != "unix" || strings.HasPrefix(address, "@") {
+		return o.listenConfig().Listen(context.Background(), network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	ln, err := (&net.ListenConfig{}).Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.chmodSocket(address); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path unless something still
+// accepts connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (o *sockOptions) chmodSocket(path string) error {
+	if o == nil {
+		return nil
+	}
+
+	if o.cfg.Mode != "" {
+		mode, err := strconv.ParseUint(o.cfg.Mode, 8, 32)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if o.cfg.Owner == "" && o.cfg.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.cfg.Owner != "" {
+		id, err := lookupID(o.cfg.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if o.cfg.Group != "" {
+		id, err := lookupID(o.cfg.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupID resolves a numeric id or a name with lookup.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
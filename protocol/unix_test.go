@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knwgo/yarp/config"
+)
+
+func TestTcpProxy_Unix(t *testing.T) {
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "target.sock")
+	proxyPath := filepath.Join(dir, "proxy.sock")
+
+	targetLn, err := net.Listen("unix", targetPath)
+	if err != nil {
+		t.Fatalf("Failed to create target listener: %v", err)
+	}
+	defer targetLn.Close()
+	go func() {
+		for {
+			conn, err := targetLn.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoConnection(conn)
+		}
+	}()
+
+	// a socket file left behind by a previous run
+	stale, err := net.Listen("unix", proxyPath)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tcpAddr := freeTCPAddr(t)
+	proxy := NewTcpProxy([]config.IPRule{
+		{BindAddr: "unix:" + proxyPath, Target: "unix:" + targetPath, Socket: &config.SocketOptions{Mode: "0600"}},
+		{BindAddr: tcpAddr, Target: "unix:" + targetPath},
+	})
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+
+	fi, err := os.Stat(proxyPath)
+	if err != nil {
+		t.Fatalf("Failed to stat proxy socket: %v", err)
+	}
+	if got := fi.Mode().Perm(); got != 0o600 {
+		t.Errorf("Expected socket mode 0600, got %o", got)
+	}
+
+	for _, dial := range [][2]string{{"unix", proxyPath}, {"tcp", tcpAddr}} {
+		conn, err := net.Dial(dial[0], dial[1])
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", dial[1], err)
+		}
+		if got := roundTrip(t, conn, "hello"); got != "hello" {
+			t.Errorf("%s: expected %q, got %q", dial[1], "hello", got)
+		}
+		conn.Close()
+	}
+
+	if err := proxy.Reload(nil); err != nil {
+		t.Fatalf("Failed to stop proxy: %v", err)
+	}
+	if _, err := os.Stat(proxyPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestRemoveStaleSocket_InUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("Expected a socket still accepting connections to be kept")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Live socket was removed: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// upstreamTLS is how a rule encrypts the connections to its targets.
+type upstreamTLS struct {
+	serverName string
+	cfg        *tls.Config
+	// err is why the settings failed to load. Connections then fail rather
+	// than going out in the clear.
+	err error
+}
+
+// newUpstreamTLS loads the files of u, nil if it is not enabled.
+func newUpstreamTLS(u *config.UpstreamTLS) *upstreamTLS {
+	if !u.Enabled() {
+		return nil
+	}
+
+	t := &upstreamTLS{
+		serverName: u.ServerName,
+		cfg:        &tls.Config{InsecureSkipVerify: u.InsecureSkipVerify},
+	}
+	var errs []error
+	version, err := config.TLSVersion(u.MinVersion)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	t.cfg.MinVersion = version
+	if u.CA != "" {
+		pool, err := loadCertPool(u.CA)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ca: %w", err))
+		}
+		t.cfg.RootCAs = pool
+	}
+	if u.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(u.Cert, u.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cert: %w", err))
+		}
+		t.cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.err = errors.Join(errs...); t.err != nil {
+		klog.Errorf("[tls] upstream tls settings, failing the connections to the targets: %v", t.err)
+	}
+	return t
+}
+
+// config returns the tls config of a connection to addr.
+func (t *upstreamTLS) config(addr string) (*tls.Config, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	cfg := t.cfg.Clone()
+	cfg.ServerName = t.serverName
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg, nil
+}
+
+// secure starts tls on conn to up if the rule encrypts the connections to
+// its targets, after any PROXY protocol header went out in the clear. conn
+// is closed if the handshake fails.
+func (p dialPolicy) secure(conn net.Conn, up *upstream) (net.Conn, error) {
+	if p.tls == nil {
+		return conn, nil
+	}
+
+	cfg, err := p.tls.config(up.addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	_ = tlsConn.SetDeadline(time.Now().Add(p.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", up.addr, err)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/knwgo/yarp/config"
+)
+
+// writeServerCA writes the certificate of a tls test server as a ca bundle.
+func writeServerCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "upstream-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("Failed to write ca: %v", err)
+	}
+	return file
+}
+
+func TestTcpProxy_UpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "backend", time.Now().Add(time.Hour), "backend.internal")
+	writeTestCert(t, dir, "other", time.Now().Add(time.Hour), "other.internal")
+	clientCert := writeTestCert(t, dir, "client", time.Now().Add(time.Hour), "yarp")
+
+	keyPair, err := tls.LoadX509KeyPair(filepath.Join(dir, "backend.crt"), filepath.Join(dir, "backend.key"))
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	// echoes the common name of the client certificate and what it receives
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn.Write([]byte(tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName + ":"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	good := config.UpstreamTLS{
+		Enable:     true,
+		ServerName: "backend.internal",
+		CA:         filepath.Join(dir, "backend.crt"),
+		Cert:       filepath.Join(dir, "client.crt"),
+		Key:        filepath.Join(dir, "client.key"),
+		MinVersion: "1.3",
+	}
+	untrusted := good
+	untrusted.CA = filepath.Join(dir, "other.crt")
+	wrongName := good
+	wrongName.ServerName = "other.internal"
+	skipVerify := wrongName
+	skipVerify.CA, skipVerify.InsecureSkipVerify = "", true
+
+	for name, tc := range map[string]struct {
+		upstream config.UpstreamTLS
+		ok       bool
+	}{
+		"verified":       {good, true},
+		"untrusted ca":   {untrusted, false},
+		"wrong name":     {wrongName, false},
+		"skip verifying": {skipVerify, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			proxyAddr := freeTCPAddr(t)
+			upstream := tc.upstream
+			proxy := NewTcpProxy([]config.IPRule{{BindAddr: proxyAddr, Target: ln.Addr().String(), UpstreamTLS: &upstream}})
+			if err := proxy.Start(); err != nil {
+				t.Fatalf("Failed to start proxy: %v", err)
+			}
+			defer proxy.Reload(nil)
+
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+			conn.Write([]byte("hello"))
+			buf := make([]byte, len("yarp:hello"))
+			_, err = io.ReadFull(conn, buf)
+			if tc.ok && (err != nil || string(buf) != "yarp:hello") {
+				t.Errorf("Expected the echo over tls, got %q, %v", buf, err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("Expected the connection to be closed, got %q", buf)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy_UpstreamTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, append([]byte("wss:"), msg...))
+			return
+		}
+		w.Write([]byte("https:" + r.Host))
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "https://")
+
+	// the test server certificate is issued for example.com
+	upstream := &config.UpstreamTLS{Enable: true, ServerName: "example.com", CA: writeServerCA(t, backend)}
+	proxyAddr := freeTCPAddr(t)
+	proxy := &HTTPProxy{}
+	err := proxy.Reload([]config.Http{{BindAddr: proxyAddr, Rules: []config.HostRule{
+		{Host: "web.example.com", Target: backendAddr, Ws: boolPtr(true), UpstreamTLS: upstream},
+	}}})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Reload(nil)
+
+	client := &http.Client{Timeout: 3 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+proxyAddr+"/", nil)
+	req.Host = "web.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "https:web.example.com" {
+		t.Errorf("Expected the request re-encrypted to the backend, got %q", body)
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: 3 * time.Second}
+	ws, _, err := dialer.Dial("ws://"+proxyAddr+"/", http.Header{"Host": {"web.example.com"}})
+	if err != nil {
+		t.Fatalf("Websocket handshake failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "wss:hello" {
+		t.Errorf("Expected the message over wss, got %q, %v", msg, err)
+	}
+}
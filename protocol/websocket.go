@@ -3,6 +3,8 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"github.com/gorilla/websocket"
 	"k8s.io/klog/v2"
 
+	"github.com/knwgo/yarp/config"
 	"github.com/knwgo/yarp/stat"
 )
 
@@ -31,7 +34,18 @@ func isWebSocketRequest(header []byte) bool {
 	return hasUpgrade && hasConnection
 }
 
-func handleWsConnection(clientConn net.Conn, targetHost string, ruleKey string) {
+// handleWsConnection proxies a websocket connection to the upstream picked
+// for target, retrying others according to its rule. It takes over
+// target.upstream.
+func handleWsConnection(clientConn net.Conn, target *targetInfo, ruleKey string) {
+	// up is the upstream currently owned, nil once a failed dial released it
+	up := target.upstream
+	defer func() {
+		if up != nil {
+			up.release()
+		}
+	}()
+
 	// Read the HTTP request from client
 	bc := newBufConn(clientConn, 8192)
 	headerBuf, err := readHTTPHeaders(bc)
@@ -72,15 +86,53 @@ func handleWsConnection(clientConn net.Conn, targetHost string, ruleKey string)
 	filteredHeader.Set("X-Forwarded-For", clientConn.RemoteAddr().String())
 
 	// Dial to target as WebSocket client
-	wsTarget, _, err := websocket.DefaultDialer.Dial(
-		"ws://"+targetHost+path,
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+		conn, u, err := target.route.dial.dial(target.route.lb, up, clientConn.RemoteAddr(), target.host)
+		up = u
+		if err != nil {
+			return nil, err
+		}
+		if err := sendProxyHeader(conn, target.route.rule.ProxyProtocol, clientConn, target.host); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	scheme := "ws://"
+	if target.route.dial.tls != nil {
+		// the handshake is ours to verify the upstream a retry ended up on
+		scheme = "wss://"
+		dialer.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.NetDialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return target.route.dial.secure(conn, up.upstream)
+		}
+	}
+	// a unix socket has no host to put in the url, the dialer ignores it
+	urlHost := up.addr
+	if _, ok := config.UnixPath(urlHost); ok {
+		urlHost = target.host
+	}
+	wsTarget, _, err := dialer.Dial(
+		scheme+urlHost+path,
 		filteredHeader,
 	)
 	if err != nil {
 		klog.Errorf("dial target websocket error: %v", err)
+		// a refused upgrade still means the target answered
+		if up != nil && errors.Is(err, websocket.ErrBadHandshake) {
+			up.reportSuccess()
+		} else if up != nil {
+			up.reportFailure(err)
+		}
 		_ = clientConn.Close()
 		return
 	}
+	up.reportSuccess()
+	targetHost := up.addr
 	defer wsTarget.Close()
 
 	// Upgrade client connection to WebSocket
@@ -92,20 +144,33 @@ func handleWsConnection(clientConn net.Conn, targetHost string, ruleKey string)
 	}
 	defer wsClient.Close()
 
+	throttleUp, throttleDown, done := target.route.bw.open(clientConn.RemoteAddr())
+	defer done()
+
 	// Start statistics tracking
 	stat.GlobalStats.AddConn(ruleKey)
 	defer stat.GlobalStats.RemoveConn(ruleKey)
+	stat.GlobalStats.AddTargetConn(ruleKey, targetHost)
+	defer stat.GlobalStats.RemoveTargetConn(ruleKey, targetHost)
 
 	klog.Infof("[ws] new connection: %s -> %s", clientConn.RemoteAddr(), targetHost)
 
+	rule := target.route.rule
+	timeouts := newPipeTimeouts(rule.IdleTimeout, rule.MaxLifetime)
+	defer timeouts.watch(func(reason error) {
+		klog.Infof("[ws] %s -> %s: %v, closing", clientConn.RemoteAddr(), targetHost, reason)
+		wsClient.Close()
+		wsTarget.Close()
+	})()
+
 	// Bidirectional copy with stats
-	done := make(chan struct{})
+	finished := make(chan struct{})
 
 	go func() {
 		defer func() {
 			wsClient.Close()
 			wsTarget.Close()
-			close(done)
+			close(finished)
 		}()
 
 		for {
@@ -113,11 +178,14 @@ func handleWsConnection(clientConn net.Conn, targetHost string, ruleKey string)
 			if err != nil {
 				break
 			}
+			throttleUp.wait(len(msg))
 			err = wsTarget.WriteMessage(mt, msg)
 			if err != nil {
 				break
 			}
+			timeouts.touch()
 			stat.GlobalStats.AddBytes(ruleKey, 0, int64(len(msg)))
+			stat.GlobalStats.AddTargetBytes(ruleKey, targetHost, 0, int64(len(msg)))
 		}
 	}()
 
@@ -132,15 +200,18 @@ func handleWsConnection(clientConn net.Conn, targetHost string, ruleKey string)
 			if err != nil {
 				break
 			}
+			throttleDown.wait(len(msg))
 			err = wsClient.WriteMessage(mt, msg)
 			if err != nil {
 				break
 			}
+			timeouts.touch()
 			stat.GlobalStats.AddBytes(ruleKey, int64(len(msg)), 0)
+			stat.GlobalStats.AddTargetBytes(ruleKey, targetHost, int64(len(msg)), 0)
 		}
 	}()
 
-	<-done
+	<-finished
 }
 
 // responseWriter wraps net.Conn to implement http.ResponseWriter and http.Hijacker
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/netip"
+	"time"
 
 	"github.com/knwgo/yarp/config"
+	"github.com/knwgo/yarp/guard"
 )
 
 func StartDashboard(dc *config.Dashboard) {
@@ -23,8 +26,15 @@ func StartDashboard(dc *config.Dashboard) {
 		hf = basicAuth(dashboardHandler, dc.HttpUser, dc.HttpPassword)
 	}
 
+	// without credentials anyone reaching the dashboard could ban clients
+	bans := readOnly(bansAPI)
+	if dc.HttpPassword != "" && dc.HttpUser != "" {
+		bans = basicAuth(bansAPI, dc.HttpUser, dc.HttpPassword)
+	}
+
 	http.HandleFunc("/", hf)
 	http.HandleFunc("/api/stats", statsAPI)
+	http.HandleFunc("/api/bans", bans)
 	go func() {
 		fmt.Printf("[dashboard] running at http://%s\n", dc.BindAddr)
 		_ = http.ListenAndServe(dc.BindAddr, nil)
@@ -44,12 +54,74 @@ func basicAuth(next http.HandlerFunc, user, pwd string) http.HandlerFunc {
 	}
 }
 
+// readOnly refuses the requests of next changing anything.
+func readOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "read only, set httpUser and httpPassword of the dashboard to make changes", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func statsAPI(w http.ResponseWriter, _ *http.Request) {
 	snapshot := GlobalStats.Snapshot()
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(snapshot)
 }
 
+// bansAPI lists the ban list on GET, bans {"ip", "duration", "reason"} on
+// POST and lifts the ban of ?ip= on DELETE.
+func bansAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			IP       string `json:"ip"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ip, err := netip.ParseAddr(req.IP)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			if d, err = time.ParseDuration(req.Duration); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "banned from dashboard"
+		}
+		guard.Global.Ban(ip, d, req.Reason)
+	case http.MethodDelete:
+		ip, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !guard.Global.Unban(ip) {
+			http.Error(w, "not banned", http.StatusNotFound)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(guard.Global.Bans())
+}
+
 func dashboardHandler(w http.ResponseWriter, _ *http.Request) {
 	tpl := `
 <!DOCTYPE html>
@@ -70,11 +142,17 @@ body { font-family: sans-serif; margin: 40px; background: #fafafa; position: rel
 	box-shadow: 0 0 3px rgba(0,0,0,0.2);
 }
 table { border-collapse: collapse; width: 100%; background: white; margin-top: 50px; }
+table + table { margin-top: 20px; }
 th, td { border: 1px solid #ccc; padding: 8px; text-align: left; }
 th.sortable { background: #eee; cursor: pointer; user-select: none; }
 th.sortable:hover { background: #ddd; }
 th.sorted-asc::after { content: " ↑"; }
 th.sorted-desc::after { content: " ↓"; }
+tr.target td { color: #666; font-size: 13px; }
+td.up { color: #2a2; }
+td.down, td.open { color: #c22; font-weight: bold; }
+td.half-open { color: #c80; }
+td.expiring { color: #c80; font-weight: bold; }
 </style>
 <script>
 let currentSort = { key: null, asc: true };
@@ -90,6 +168,10 @@ function formatBytes(bytes) {
 	return num.toFixed(2) + ' ' + units[i];
 }
 
+function escapeHTML(s) {
+	return s.replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c]));
+}
+
 async function refresh() {
 	let res = await fetch('/api/stats');
 	let snapshot = await res.json();
@@ -111,24 +193,121 @@ async function refresh() {
 	let html = '<table><tr>' +
 		'<th class="sortable" data-key="rule" onclick="sortBy(this)">Rule</th>' +
 		'<th class="sortable" data-key="ConnCount" onclick="sortBy(this)">Conn</th>' +
+		'<th class="sortable" data-key="ConnUsage" onclick="sortBy(this)">Limit</th>' +
+		'<th class="sortable" data-key="Rejected" onclick="sortBy(this)">Rejected</th>' +
 		'<th class="sortable" data-key="BytesIn" onclick="sortBy(this)">BytesIn</th>' +
 		'<th class="sortable" data-key="BytesOut" onclick="sortBy(this)">BytesOut</th>' +
 		'<th class="sortable" data-key="RateInKBps" onclick="sortBy(this)">RateIn(KB/s)</th>' +
 		'<th class="sortable" data-key="RateOutKBps" onclick="sortBy(this)">RateOut(KB/s)</th>' +
+		'<th class="sortable" data-key="Denied" onclick="sortBy(this)">Denied</th>' +
+		'<th class="sortable" data-key="CertRejected" onclick="sortBy(this)">Cert Rejected</th>' +
 		'</tr>';
 
 	for (let v of data) {
 		html += '<tr>' +
-			'<td>' + v.rule + '</td>' +
+			'<td>' + escapeHTML(v.rule) + '</td>' +
 			'<td>' + v.ConnCount + '</td>' +
+			'<td>' + (v.ConnLimit > 0 ? v.ConnUsage + ' / ' + v.ConnLimit : '') + '</td>' +
+			'<td>' + v.Rejected + '</td>' +
 			'<td>' + formatBytes(v.BytesIn) + '</td>' +
 			'<td>' + formatBytes(v.BytesOut) + '</td>' +
 			'<td>' + v.RateInKBps.toFixed(2) + '</td>' +
 			'<td>' + v.RateOutKBps.toFixed(2) + '</td>' +
+			'<td>' + v.Denied + '</td>' +
+			'<td>' + v.CertRejected + '</td>' +
 			'</tr>';
+
+		// 多个 target 时逐个展示
+		let targets = Object.entries(v.Targets || {});
+		if (targets.length > 1) {
+			targets.sort((a, b) => a[0].localeCompare(b[0]));
+			for (let [target, t] of targets) {
+				html += '<tr class="target">' +
+					'<td>&nbsp;&nbsp;↳ ' + escapeHTML(target) + '</td>' +
+					'<td>' + t.ConnCount + '</td>' +
+					'<td></td><td></td>' +
+					'<td>' + formatBytes(t.BytesIn) + '</td>' +
+					'<td>' + formatBytes(t.BytesOut) + '</td>' +
+					'<td></td><td></td><td></td><td></td>' +
+					'</tr>';
+			}
+		}
 	}
 
 	html += '</table>';
+
+	// 健康检查状态
+	let rules = Object.entries(snapshot.targets || {}).sort((a, b) => a[0].localeCompare(b[0]));
+	if (rules.length > 0) {
+		html += '<table><tr><th>Rule</th><th>Target</th><th>Health</th><th>Last Check</th><th>Last Error</th><th>Circuit</th><th>Ejections</th></tr>';
+		for (let [rule, targets] of rules) {
+			for (let [target, t] of Object.entries(targets).sort((a, b) => a[0].localeCompare(b[0]))) {
+				html += '<tr>' +
+					'<td>' + escapeHTML(rule) + '</td>' +
+					'<td>' + escapeHTML(target) + '</td>' +
+					'<td class="' + (t.Health || '') + '">' + (t.Health || '-').toUpperCase() + '</td>' +
+					'<td>' + (t.LastCheck ? new Date(t.LastCheck).toLocaleString() : '') + '</td>' +
+					'<td>' + escapeHTML(t.LastError || '') + '</td>' +
+					'<td class="' + (t.Circuit || '') + '">' + (t.Circuit || '-') + '</td>' +
+					'<td>' + (t.Ejections || 0) + '</td>' +
+					'</tr>';
+			}
+		}
+		html += '</table>';
+	}
+
+	// 证书
+	let certRules = Object.entries(snapshot.certs || {}).sort((a, b) => a[0].localeCompare(b[0]));
+	if (certRules.length > 0) {
+		html += '<table><tr><th>Rule</th><th>Certificate</th><th>Subject</th><th>SANs</th><th>Expires</th><th>Last Error</th></tr>';
+		for (let [rule, certs] of certRules) {
+			for (let [file, c] of Object.entries(certs).sort((a, b) => a[0].localeCompare(b[0]))) {
+				let expires = c.NotAfter ? new Date(c.NotAfter).toLocaleString() : '';
+				html += '<tr>' +
+					'<td>' + escapeHTML(rule) + '</td>' +
+					'<td>' + escapeHTML(file) + '</td>' +
+					'<td>' + escapeHTML(c.Subject || '') + '</td>' +
+					'<td>' + escapeHTML((c.SANs || []).join(', ')) + '</td>' +
+					'<td class="' + (c.ExpiresSoon ? 'expiring' : '') + '">' + expires + (c.ExpiresSoon ? ' (expires soon)' : '') + '</td>' +
+					'<td>' + escapeHTML(c.LastError || '') + '</td>' +
+					'</tr>';
+			}
+		}
+		html += '</table>';
+	}
+
+	// ACME
+	let acme = Object.entries(snapshot.acme || {}).sort((a, b) => a[0].localeCompare(b[0]));
+	if (acme.length > 0) {
+		html += '<table><tr><th>ACME Host</th><th>Expires</th><th>Next Renewal</th><th>Renewals</th><th>Failures</th><th>Last Error</th></tr>';
+		for (let [host, a] of acme) {
+			html += '<tr>' +
+				'<td>' + escapeHTML(host) + '</td>' +
+				'<td>' + (a.NotAfter ? new Date(a.NotAfter).toLocaleString() : '') + '</td>' +
+				'<td>' + (a.NextRenewal ? new Date(a.NextRenewal).toLocaleString() : '') + '</td>' +
+				'<td>' + (a.Renewals || 0) + '</td>' +
+				'<td class="' + (a.Failures ? 'down' : '') + '">' + (a.Failures || 0) + ' (' + (a.TotalFailures || 0) + ' total)</td>' +
+				'<td>' + escapeHTML(a.LastError || '') + '</td>' +
+				'</tr>';
+		}
+		html += '</table>';
+	}
+
+	// 封禁列表
+	let bans = await (await fetch('/api/bans')).json();
+	if (bans.length > 0) {
+		html += '<table><tr><th>Banned IP</th><th>Until</th><th>Reason</th><th></th></tr>';
+		for (let b of bans) {
+			html += '<tr>' +
+				'<td>' + escapeHTML(b.ip) + '</td>' +
+				'<td>' + new Date(b.until).toLocaleString() + '</td>' +
+				'<td>' + escapeHTML(b.reason) + '</td>' +
+				'<td><button onclick="unban(\'' + escapeHTML(b.ip) + '\')">Unban</button></td>' +
+				'</tr>';
+		}
+		html += '</table>';
+	}
+
 	document.getElementById('statsTable').innerHTML = html;
 
 	// 设置列头箭头状态
@@ -143,6 +322,11 @@ async function refresh() {
 	document.getElementById('lastUpdated').innerText = 'Last Updated: ' + t.toLocaleString();
 }
 
+async function unban(ip) {
+	await fetch('/api/bans?ip=' + encodeURIComponent(ip), { method: 'DELETE' });
+	refresh();
+}
+
 function sortBy(th) {
 	const key = th.dataset.key;
 	if (currentSort.key === key) {
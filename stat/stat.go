@@ -1,6 +1,7 @@
 package stat
 
 import (
+	"crypto/x509"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,20 +17,111 @@ type RuleStats struct {
 	ConnCount   int32
 	RateInKBps  float64
 	RateOutKBps float64
+	// Denied counts the connections refused by the allow/deny lists.
+	Denied uint64
+	// ConnLimit is the maxConns of the rule, zero if unlimited, ConnUsage the
+	// connections holding a slot and Rejected those turned away by a limit.
+	ConnLimit int32
+	ConnUsage int32
+	Rejected  uint64
+	// CertRejected counts the tls handshakes failed for lacking a client
+	// certificate the rule accepts.
+	CertRejected uint64
+
+	// Targets holds the share of every upstream target of the rule.
+	Targets map[string]*TargetStats `json:",omitempty"`
+}
+
+type TargetStats struct {
+	BytesIn   uint64
+	BytesOut  uint64
+	ConnCount int32
+}
+
+// TargetState is what yarp knows about the health of one upstream address.
+type TargetState struct {
+	// Health is "up" or "down", or empty if the target is not checked.
+	Health    string    `json:",omitempty"`
+	LastCheck time.Time `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+
+	// Circuit is "closed", "open" or "half-open", or empty without outlier
+	// detection.
+	Circuit      string    `json:",omitempty"`
+	Ejections    uint64    `json:",omitempty"`
+	EjectedUntil time.Time `json:",omitempty"`
+}
+
+// CertState describes a certificate yarp terminates tls with.
+type CertState struct {
+	Subject  string
+	SANs     []string  `json:",omitempty"`
+	NotAfter time.Time `json:",omitempty"`
+	// ExpiresSoon is set within CertExpiryWarning of NotAfter.
+	ExpiresSoon bool
+	// LastError is why the file failed to load, the certificate above being
+	// the one still served.
+	LastError string `json:",omitempty"`
+}
+
+// NewCertState describes leaf.
+func NewCertState(leaf *x509.Certificate) CertState {
+	cs := CertState{Subject: leaf.Subject.String(), NotAfter: leaf.NotAfter}
+	cs.SANs = append(cs.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		cs.SANs = append(cs.SANs, ip.String())
+	}
+	return cs
+}
+
+// CertExpiryWarning is how long before it expires a certificate is flagged.
+const CertExpiryWarning = 14 * 24 * time.Hour
+
+// ACMEState describes the certificate of a host obtained through ACME.
+type ACMEState struct {
+	NotAfter    time.Time `json:",omitempty"`
+	NextRenewal time.Time `json:",omitempty"`
+	LastRenewal time.Time `json:",omitempty"`
+	Renewals    uint64
+	// Failures counts failed attempts since the last renewal, LastError
+	// being why the latest one failed.
+	Failures      uint64
+	TotalFailures uint64
+	LastError     string `json:",omitempty"`
 }
 
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
 type StatsManager struct {
 	mu    sync.RWMutex
 	stats map[string]*RuleStats
+	// targets holds the TargetState of each target by rule
+	targets map[string]map[string]*TargetState
+	// certs holds the CertState of each certificate file by rule
+	certs map[string]map[string]CertState
+	acme  map[string]ACMEState
 }
 
 type Snapshot struct {
-	RuleStats      map[string]RuleStats `json:"ruleStats"`
-	LastUpdateTime time.Time            `json:"lastUpdateTime"`
+	RuleStats      map[string]RuleStats              `json:"ruleStats"`
+	Targets        map[string]map[string]TargetState `json:"targets"`
+	Certs          map[string]map[string]CertState   `json:"certs"`
+	ACME           map[string]ACMEState              `json:"acme"`
+	LastUpdateTime time.Time                         `json:"lastUpdateTime"`
 }
 
 var GlobalStats = &StatsManager{
-	stats: make(map[string]*RuleStats),
+	stats:   make(map[string]*RuleStats),
+	targets: make(map[string]map[string]*TargetState),
+	certs:   make(map[string]map[string]CertState),
+	acme:    make(map[string]ACMEState),
 }
 
 func (m *StatsManager) GetOrCreateRule(key string) *RuleStats {
@@ -43,6 +135,37 @@ func (m *StatsManager) GetOrCreateRule(key string) *RuleStats {
 	return s
 }
 
+func (m *StatsManager) GetOrCreateTarget(key, target string) *TargetStats {
+	s := m.GetOrCreateRule(key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := s.Targets[target]; ok {
+		return t
+	}
+	if s.Targets == nil {
+		s.Targets = make(map[string]*TargetStats)
+	}
+	t := &TargetStats{}
+	s.Targets[target] = t
+	return t
+}
+
+func (m *StatsManager) AddTargetConn(key, target string) {
+	t := m.GetOrCreateTarget(key, target)
+	atomic.AddInt32(&t.ConnCount, 1)
+}
+
+func (m *StatsManager) RemoveTargetConn(key, target string) {
+	t := m.GetOrCreateTarget(key, target)
+	atomic.AddInt32(&t.ConnCount, -1)
+}
+
+func (m *StatsManager) AddTargetBytes(key, target string, in, out int64) {
+	t := m.GetOrCreateTarget(key, target)
+	atomic.AddUint64(&t.BytesIn, uint64(in))
+	atomic.AddUint64(&t.BytesOut, uint64(out))
+}
+
 func (m *StatsManager) AddConn(key string) {
 	s := m.GetOrCreateRule(key)
 	atomic.AddInt32(&s.ConnCount, 1)
@@ -59,22 +182,221 @@ func (m *StatsManager) AddBytes(key string, in, out int64) {
 	atomic.AddUint64(&s.BytesOut, uint64(out))
 }
 
+func (m *StatsManager) AddDenied(key string) {
+	s := m.GetOrCreateRule(key)
+	atomic.AddUint64(&s.Denied, 1)
+}
+
+func (m *StatsManager) AddCertRejected(key string) {
+	s := m.GetOrCreateRule(key)
+	atomic.AddUint64(&s.CertRejected, 1)
+}
+
+func (m *StatsManager) SetConnLimit(key string, limit, usage int32) {
+	s := m.GetOrCreateRule(key)
+	atomic.StoreInt32(&s.ConnLimit, limit)
+	atomic.StoreInt32(&s.ConnUsage, usage)
+}
+
+func (m *StatsManager) SetConnUsage(key string, usage int32) {
+	s := m.GetOrCreateRule(key)
+	atomic.StoreInt32(&s.ConnUsage, usage)
+}
+
+func (m *StatsManager) AddRejected(key string) {
+	s := m.GetOrCreateRule(key)
+	atomic.AddUint64(&s.Rejected, 1)
+}
+
+func (m *StatsManager) getOrCreateTargetState(rule, target string) *TargetState {
+	targets, ok := m.targets[rule]
+	if !ok {
+		targets = make(map[string]*TargetState)
+		m.targets[rule] = targets
+	}
+	ts, ok := targets[target]
+	if !ok {
+		ts = &TargetState{}
+		targets[target] = ts
+	}
+	return ts
+}
+
+// SetTargetHealth records the result of a health check of target by rule. An
+// empty health means the target is no longer checked.
+func (m *StatsManager) SetTargetHealth(rule, target, health string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.getOrCreateTargetState(rule, target)
+	ts.Health = health
+	ts.LastCheck = time.Now()
+	ts.LastError = ""
+	if err != nil {
+		ts.LastError = err.Error()
+	}
+	if health == "" {
+		ts.LastCheck = time.Time{}
+	}
+	m.pruneTargetState(rule, target)
+}
+
+// SetTargetCircuit records the circuit breaker state of target for rule.
+func (m *StatsManager) SetTargetCircuit(rule, target, circuit string, ejections uint64, ejectedUntil time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.getOrCreateTargetState(rule, target)
+	ts.Circuit = circuit
+	ts.Ejections = ejections
+	ts.EjectedUntil = ejectedUntil
+	m.pruneTargetState(rule, target)
+}
+
+// pruneTargetState drops the state of a target that nothing watches.
+func (m *StatsManager) pruneTargetState(rule, target string) {
+	if ts := m.targets[rule][target]; ts.Health == "" && ts.Circuit == "" && ts.Ejections == 0 {
+		m.removeTarget(rule, target)
+	}
+}
+
+// RemoveTarget forgets target once rule does not use it anymore.
+func (m *StatsManager) RemoveTarget(rule, target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeTarget(rule, target)
+}
+
+func (m *StatsManager) removeTarget(rule, target string) {
+	delete(m.targets[rule], target)
+	if len(m.targets[rule]) == 0 {
+		delete(m.targets, rule)
+	}
+}
+
+// SetCert records the certificate rule loaded from file.
+func (m *StatsManager) SetCert(rule, file string, cs CertState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	certs, ok := m.certs[rule]
+	if !ok {
+		certs = make(map[string]CertState)
+		m.certs[rule] = certs
+	}
+	certs[file] = cs
+}
+
+// RemoveCert forgets the certificate of file once rule no longer serves it.
+func (m *StatsManager) RemoveCert(rule, file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.certs[rule], file)
+	if len(m.certs[rule]) == 0 {
+		delete(m.certs, rule)
+	}
+}
+
+// ACMERenewed records a certificate obtained for host.
+func (m *StatsManager) ACMERenewed(host string, notAfter, next time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.acme[host]
+	s.NotAfter = notAfter
+	s.NextRenewal = next
+	s.LastRenewal = time.Now()
+	s.Renewals++
+	s.Failures = 0
+	s.LastError = ""
+	m.acme[host] = s
+}
+
+// ACMEFailed records a failed attempt to obtain a certificate for host, the
+// next one being due at next.
+func (m *StatsManager) ACMEFailed(host string, err error, next time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.acme[host]
+	s.NextRenewal = next
+	s.Failures++
+	s.TotalFailures++
+	s.LastError = err.Error()
+	m.acme[host] = s
+}
+
+// ACMEScheduled records the certificate of host found in storage and when
+// it is due for renewal.
+func (m *StatsManager) ACMEScheduled(host string, notAfter, next time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.acme[host]
+	s.NotAfter = notAfter
+	s.NextRenewal = next
+	m.acme[host] = s
+}
+
+// RemoveACME forgets host once its certificate is no longer managed.
+func (m *StatsManager) RemoveACME(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.acme, host)
+}
+
 func (m *StatsManager) Snapshot() Snapshot {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	snapshot := Snapshot{
 		RuleStats:      make(map[string]RuleStats, len(m.stats)),
+		Targets:        make(map[string]map[string]TargetState, len(m.targets)),
+		Certs:          make(map[string]map[string]CertState, len(m.certs)),
+		ACME:           make(map[string]ACMEState, len(m.acme)),
 		LastUpdateTime: time.Now(),
 	}
 
+	for rule, certs := range m.certs {
+		snapshot.Certs[rule] = make(map[string]CertState, len(certs))
+		for file, cs := range certs {
+			cs.ExpiresSoon = !cs.NotAfter.IsZero() && snapshot.LastUpdateTime.Add(CertExpiryWarning).After(cs.NotAfter)
+			snapshot.Certs[rule][file] = cs
+		}
+	}
+	for host, s := range m.acme {
+		snapshot.ACME[host] = s
+	}
+
+	for rule, targets := range m.targets {
+		snapshot.Targets[rule] = make(map[string]TargetState, len(targets))
+		for target, v := range targets {
+			ts := *v
+			// an open circuit lets a trial connection through once its ejection is over
+			if ts.Circuit == CircuitOpen && !snapshot.LastUpdateTime.Before(ts.EjectedUntil) {
+				ts.Circuit = CircuitHalfOpen
+			}
+			snapshot.Targets[rule][target] = ts
+		}
+	}
+
 	for k, v := range m.stats {
-		snapshot.RuleStats[k] = RuleStats{
-			BytesIn:     atomic.LoadUint64(&v.BytesIn),
-			BytesOut:    atomic.LoadUint64(&v.BytesOut),
-			ConnCount:   atomic.LoadInt32(&v.ConnCount),
-			RateInKBps:  v.RateInKBps,
-			RateOutKBps: v.RateOutKBps,
+		rs := RuleStats{
+			BytesIn:      atomic.LoadUint64(&v.BytesIn),
+			BytesOut:     atomic.LoadUint64(&v.BytesOut),
+			ConnCount:    atomic.LoadInt32(&v.ConnCount),
+			RateInKBps:   v.RateInKBps,
+			RateOutKBps:  v.RateOutKBps,
+			Denied:       atomic.LoadUint64(&v.Denied),
+			ConnLimit:    atomic.LoadInt32(&v.ConnLimit),
+			ConnUsage:    atomic.LoadInt32(&v.ConnUsage),
+			Rejected:     atomic.LoadUint64(&v.Rejected),
+			CertRejected: atomic.LoadUint64(&v.CertRejected),
+		}
+		if len(v.Targets) > 0 {
+			rs.Targets = make(map[string]*TargetStats, len(v.Targets))
+			for target, t := range v.Targets {
+				rs.Targets[target] = &TargetStats{
+					BytesIn:   atomic.LoadUint64(&t.BytesIn),
+					BytesOut:  atomic.LoadUint64(&t.BytesOut),
+					ConnCount: atomic.LoadInt32(&t.ConnCount),
+				}
+			}
 		}
+		snapshot.RuleStats[k] = rs
 	}
 	return snapshot
 }